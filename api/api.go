@@ -0,0 +1,306 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "api")
+
+func init() {
+	bridge.Register(new(Factory), "api")
+}
+
+// KeyPrefix prefix of the key of services registered by API
+const KeyPrefix = "api://"
+
+// Defaults of the unix socket and state file
+const (
+	DefaultSocket = "/var/run/registrator.sock"
+	DefaultState  = "/var/lib/registrator/api.json"
+)
+
+// pidCheckInterval interval of checking whether bound processes are alive
+const pidCheckInterval = time.Second
+
+type Factory struct{}
+
+// New returns the source of self-registration API listening on unix socket,
+// e.g. api:///var/run/registrator.sock?listen=127.0.0.1:4100&state=/var/lib/registrator/api.json,
+// the optional listen must be a loopback address
+func (f *Factory) New(uri *url.URL) bridge.Source {
+	query := uri.Query()
+
+	s := &Source{
+		socket:  uri.Path,
+		listen:  query.Get("listen"),
+		state:   query.Get("state"),
+		entries: make(map[string]*entry),
+	}
+	if s.socket == "" {
+		s.socket = DefaultSocket
+	}
+	if s.state == "" {
+		s.state = DefaultState
+	}
+	if s.listen != "" {
+		host, _, err := net.SplitHostPort(s.listen)
+		if err != nil {
+			log.Fatalf("api: invalid listen address %s: %v", s.listen, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Fatalf("api: listen address %s must be loopback", s.listen)
+		}
+	}
+
+	if err := s.load(); err != nil {
+		log.Fatalf("api: load state %s failed: %v", s.state, err)
+	}
+
+	return s
+}
+
+// Source services registered by local processes through the API, they are
+// persisted in state file across restarts
+type Source struct {
+	sync.Mutex
+	socket  string
+	listen  string
+	state   string
+	entries map[string]*entry
+	events  chan<- *bridge.SourceEvent
+	stop    <-chan struct{}
+}
+
+// entry service registered by API, it's deregistered automatically when the
+// bound process exits If PID is specified. The start time of process tells
+// whether the PID has been reused by another process
+type entry struct {
+	Definition json.RawMessage `json:"definition"`
+	PID        int             `json:"pid,omitempty"`
+	StartTime  uint64          `json:"start_time,omitempty"`
+	service    *bridge.Service
+}
+
+// alive returns whether the bound process is running
+func (e *entry) alive() bool {
+	return alive(e.PID, e.StartTime)
+}
+
+func (s *Source) Services() (map[string]*bridge.Service, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	services := make(map[string]*bridge.Service, len(s.entries))
+	for id, e := range s.entries {
+		services[KeyPrefix+id] = e.service
+	}
+	return services, nil
+}
+
+func (s *Source) Watch(events chan<- *bridge.SourceEvent, stop <-chan struct{}) {
+	s.Lock()
+	s.events = events
+	s.stop = stop
+	s.Unlock()
+
+	servers, err := s.serve()
+	if err != nil {
+		log.Errorf("api: serve failed: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(pidCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkProcesses()
+		case <-stop:
+			for _, server := range servers {
+				server.Close()
+			}
+			os.Remove(s.socket)
+			return
+		}
+	}
+}
+
+// put adds or replaces the service registered by API
+func (s *Source) put(id string, definition []byte, pid int) (*bridge.Service, error) {
+	service, err := parseService(id, definition)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{Definition: definition, PID: pid, service: service}
+	if pid > 0 {
+		if e.StartTime, err = startTime(pid); err != nil && !os.IsNotExist(err) {
+			log.Warnf("api: get start time of process %d failed: %v", pid, err)
+		}
+		if !e.alive() {
+			return nil, fmt.Errorf("process %d is not running", pid)
+		}
+	}
+
+	s.Lock()
+	eventType := bridge.EventAdd
+	if _, exists := s.entries[id]; exists {
+		eventType = bridge.EventUpdate
+	}
+	s.entries[id] = e
+	err = s.flush()
+	s.Unlock()
+	if err != nil {
+		log.Errorf("api: persistent state failed: %v", err)
+	}
+
+	s.emit(&bridge.SourceEvent{Type: eventType, Key: KeyPrefix + id, Service: service})
+	return service, nil
+}
+
+// delete removes the service registered by API, returns false If not exists
+func (s *Source) delete(id string) bool {
+	s.Lock()
+	if _, exists := s.entries[id]; !exists {
+		s.Unlock()
+		return false
+	}
+	delete(s.entries, id)
+	err := s.flush()
+	s.Unlock()
+	if err != nil {
+		log.Errorf("api: persistent state failed: %v", err)
+	}
+
+	s.emit(&bridge.SourceEvent{Type: bridge.EventRemove, Key: KeyPrefix + id})
+	return true
+}
+
+// checkProcesses removes the services whose bound process has exited
+func (s *Source) checkProcesses() {
+	s.Lock()
+	var exited []string
+	for id, e := range s.entries {
+		if e.PID > 0 && !e.alive() {
+			exited = append(exited, id)
+		}
+	}
+	s.Unlock()
+
+	for _, id := range exited {
+		log.Infof("api: bound process of %s has exited", id)
+		s.delete(id)
+	}
+}
+
+func (s *Source) emit(event *bridge.SourceEvent) {
+	s.Lock()
+	events, stop := s.events, s.stop
+	s.Unlock()
+
+	select {
+	case events <- event:
+	case <-stop:
+	}
+}
+
+// load loads the persisted services, the ones whose bound process has exited
+// while registrator was down are dropped
+func (s *Source) load() error {
+	bs, err := ioutil.ReadFile(s.state)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries map[string]*entry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return err
+	}
+
+	for id, e := range entries {
+		if e.PID > 0 && !e.alive() {
+			log.Infof("api: bound process of %s has exited, dropped", id)
+			continue
+		}
+		service, err := parseService(id, e.Definition)
+		if err != nil {
+			log.Warnf("api: invalid definition of %s, dropped: %v", id, err)
+			continue
+		}
+		e.service = service
+		s.entries[id] = e
+	}
+	return nil
+}
+
+func (s *Source) flush() error {
+	bs, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.state), 0755); err != nil {
+		return err
+	}
+	tmp := s.state + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.state)
+}
+
+// parseService parses the definition of service, the service id is scoped by
+// the API id, so it doesn't collide with the identical definitions of other
+// ids or sources
+func parseService(id string, definition []byte) (*bridge.Service, error) {
+	service, err := bridge.ParseService(definition)
+	if err != nil {
+		return nil, err
+	}
+	service.ID = bridge.ScopedServiceID(KeyPrefix+id, definition, service.Port)
+	return service, nil
+}
+
+// alive returns whether the process is running, and it's the one started at
+// start If known, rather than another process which reused the pid
+func alive(pid int, start uint64) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	if start == 0 {
+		return true
+	}
+	current, err := startTime(pid)
+	return err != nil || current == start
+}
+
+// startTime returns the start time of process in clock ticks after boot, the
+// 22nd field of /proc/<pid>/stat
+func startTime(pid int) (uint64, error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command in parentheses may contain spaces, the fields after it start from the 3rd
+	stat := string(bs)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
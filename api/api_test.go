@@ -0,0 +1,80 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+const definition = `{"name":"mtail","port":3903}`
+
+func TestParseService(t *testing.T) {
+	bridge.HardwareID = "test"
+
+	a, err := parseService("a", []byte(definition))
+	if err != nil {
+		t.Fatalf("parseService() = %v", err)
+	}
+	b, _ := parseService("b", []byte(definition))
+	file, _ := bridge.ParseService([]byte(definition))
+	if a.ID == b.ID || a.ID == file.ID {
+		t.Errorf("service ids of identical definitions collide: %s %s %s", a.ID, b.ID, file.ID)
+	}
+	if again, _ := parseService("a", []byte(definition)); again.ID != a.ID {
+		t.Errorf("service id = %s, want %s", again.ID, a.ID)
+	}
+}
+
+func TestAlive(t *testing.T) {
+	pid := os.Getpid()
+	start, err := startTime(pid)
+	if err != nil {
+		t.Skipf("start time is not available: %v", err)
+	}
+	if !alive(pid, start) {
+		t.Error("alive() = false, want true")
+	}
+	if !alive(pid, 0) {
+		t.Error("alive() with unknown start time = false, want true")
+	}
+	// the pid has been reused by another process
+	if alive(pid, start+1) {
+		t.Error("alive() with another start time = true, want false")
+	}
+}
+
+func TestPut(t *testing.T) {
+	bridge.HardwareID = "test"
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Source{
+		state:   filepath.Join(dir, "api.json"),
+		entries: make(map[string]*entry),
+	}
+	events := make(chan *bridge.SourceEvent, 1)
+	s.events, s.stop = events, make(chan struct{})
+
+	if _, err := s.put("mtail", []byte(definition), os.Getpid()); err != nil {
+		t.Fatalf("put() = %v", err)
+	}
+	if event := <-events; event.Type != bridge.EventAdd || event.Key != KeyPrefix+"mtail" {
+		t.Errorf("event = %+v", event)
+	}
+	if e := s.entries["mtail"]; e.PID != os.Getpid() || e.StartTime == 0 {
+		t.Errorf("entry = %+v", e)
+	}
+
+	loaded := &Source{state: s.state, entries: make(map[string]*entry)}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("load() = %v", err)
+	}
+	if e := loaded.entries["mtail"]; e == nil || e.service.ID != s.entries["mtail"].service.ID {
+		t.Errorf("loaded entry = %+v", e)
+	}
+}
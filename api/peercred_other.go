@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package api
+
+import (
+	"errors"
+	"net"
+)
+
+// peerPID returns the pid of the process on the other side of unix socket
+func peerPID(conn net.Conn) (int, error) {
+	return 0, errors.New("pid=self is only supported on linux")
+}
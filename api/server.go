@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+var idPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+var errInvalidPID = errors.New("invalid pid")
+
+type connKey struct{}
+
+// serve starts the API servers on unix socket and the optional loopback address
+//
+//	GET    /v1/services          list services registered by API
+//	GET    /v1/services/:id      get service
+//	PUT    /v1/services/:id      register service with definition in body,
+//	                             ?pid=<pid> binds it to the process, ?pid=self
+//	                             binds it to the caller on unix socket
+//	DELETE /v1/services/:id      deregister service
+//	GET    /v1/status            backend connectivity
+func (s *Source) serve() ([]*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/services", s.handleServices)
+	mux.HandleFunc("/v1/services/", s.handleService)
+	mux.HandleFunc("/v1/status", s.handleStatus)
+
+	newServer := func() *http.Server {
+		return &http.Server{
+			Handler: mux,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, connKey{}, c)
+			},
+		}
+	}
+
+	// remove the stale socket left by unclean shutdown
+	os.Remove(s.socket)
+	listener, err := net.Listen("unix", s.socket)
+	if err != nil {
+		return nil, err
+	}
+	servers := []*http.Server{newServer()}
+	go servers[0].Serve(listener)
+	log.Infof("api: listening on %s", s.socket)
+
+	if s.listen != "" {
+		listener, err := net.Listen("tcp", s.listen)
+		if err != nil {
+			servers[0].Close()
+			return nil, err
+		}
+		server := newServer()
+		servers = append(servers, server)
+		go server.Serve(listener)
+		log.Infof("api: listening on %s", s.listen)
+	}
+
+	return servers, nil
+}
+
+func (s *Source) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	writeJSON(w, http.StatusOK, s.entries)
+}
+
+func (s *Source) handleService(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/services/")
+	if !idPattern.MatchString(id) {
+		http.Error(w, "invalid service id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.Lock()
+		e, ok := s.entries[id]
+		s.Unlock()
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+
+	case http.MethodPut:
+		pid, err := s.callerPID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		definition, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		service, err := s.put(id, definition, pid)
+		if err != nil {
+			http.Error(w, "invalid service definition: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Infof("api: put %s %s (pid %d)", id, service.ID, pid)
+		writeJSON(w, http.StatusOK, service)
+
+	case http.MethodDelete:
+		if !s.delete(id) {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		log.Infof("api: deleted %s", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Source) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"backend": bridge.Backend()})
+}
+
+// callerPID returns the pid which the registration is bound to, zero If not bound
+func (s *Source) callerPID(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("pid")
+	if value == "" {
+		return 0, nil
+	}
+	if value == "self" {
+		conn, _ := r.Context().Value(connKey{}).(net.Conn)
+		return peerPID(conn)
+	}
+	pid, err := strconv.Atoi(value)
+	if err != nil || pid <= 0 {
+		return 0, errInvalidPID
+	}
+	return pid, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -7,10 +7,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
-	"path/filepath"
+	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -23,13 +26,33 @@ var log = logrus.WithField("component", "bridge")
 type Bridge struct {
 	sync.Mutex
 	registry RegistryAdapter
-	// services map[string]*Service
-	store  *Storage
-	config Config
+	sources  map[string]Source
+	gates    map[string]Gate
+	// checker runs health checks locally, nil If backend runs them
+	checker    *HealthChecker
+	readiness  *ReadinessTracker
+	predicates *PredicateTracker
+	// desired services of sources, include the ones which are not allowed by gates
+	candidates map[string]*candidate
+	// registered services
+	services map[string]*Service
+	// draining services, they're refreshed until deregistered
+	draining map[string]*Service
+	store    *Storage
+	config   Config
+}
+
+type candidate struct {
+	source  string
+	service *Service
 }
 
 // New returns a new registry bridge
 func New(adapterURI string, config Config) (*Bridge, error) {
+	if hardwareIDErr != nil {
+		return nil, hardwareIDErr
+	}
+
 	uri, err := url.Parse(adapterURI)
 	if err != nil {
 		return nil, errors.New("bad adapter uri: " + adapterURI)
@@ -45,13 +68,61 @@ func New(adapterURI string, config Config) (*Bridge, error) {
 		return nil, errors.New("init local filesystem store: " + err.Error())
 	}
 
+	if config.HostIP != "" {
+		LocalNode.Address = config.HostIP
+	}
+	for k, v := range config.NodeMeta {
+		LocalNode.Meta[k] = v
+	}
+
+	if config.PredicateInterval > 0 {
+		atomic.StoreInt64(&predicateInterval, int64(time.Duration(config.PredicateInterval)*time.Second))
+	}
+
+	if len(config.Sources) == 0 {
+		config.Sources = []string{"file://" + config.ConfDir}
+	}
+	sources := make(map[string]Source, len(config.Sources))
+	for _, sourceURI := range config.Sources {
+		uri, err := url.Parse(sourceURI)
+		if err != nil {
+			return nil, errors.New("bad source uri: " + sourceURI)
+		}
+		factory, found := SourceFactories.Lookup(uri.Scheme)
+		if !found {
+			return nil, errors.New("unreconized source: " + sourceURI)
+		}
+		if _, exists := sources[uri.Scheme]; exists {
+			return nil, errors.New("duplicated source: " + sourceURI)
+		}
+		log.Infof("using %s source: %s", uri.Scheme, sourceURI)
+		sources[uri.Scheme] = factory.New(uri)
+	}
+
 	log.Infof("using %s adapter: %s", uri.Scheme, adapterURI)
 
+	registry := factory.New(uri)
+	if adapter, ok := registry.(LeasingAdapter); ok && adapter.RequiresRefresh() && config.RefreshInterval <= 0 {
+		return nil, fmt.Errorf("%s adapter requires -ttl-refresh, the services expire unless they are refreshed", uri.Scheme)
+	}
+	var checker *HealthChecker
+	if adapter, ok := registry.(CheckingAdapter); config.LocalChecks || !ok || !adapter.RunsChecks() {
+		log.Infof("running health checks locally")
+		checker = NewHealthChecker()
+	}
+
 	return &Bridge{
-		config:   config,
-		registry: factory.New(uri),
-		// services: make(map[string]*Service),
-		store: store,
+		config:     config,
+		registry:   registry,
+		sources:    sources,
+		gates:      Gates.All(),
+		checker:    checker,
+		readiness:  NewReadinessTracker(config.ReadyPolicy),
+		predicates: NewPredicateTracker(),
+		candidates: make(map[string]*candidate),
+		services:   make(map[string]*Service),
+		draining:   make(map[string]*Service),
+		store:      store,
 	}, nil
 }
 
@@ -60,75 +131,56 @@ func (b *Bridge) Ping() error {
 	return b.registry.Ping()
 }
 
-// Add try to add service to backend
-func (b *Bridge) Add(path string) {
-	b.Lock()
-	defer b.Unlock()
-
-	b.add(path, false)
-}
-
-// Remove try to remove service to backend
-func (b *Bridge) Remove(path string) {
-	b.remove(path)
-}
-
-// Rename try to remove service to backend If rename path has already registered
-func (b *Bridge) Rename(path string) {
-	// validate service has already registered
-	if _, ok := b.store.GetServiceID(path); !ok {
+// Close releases the adapter on exit, it's a no-op If the adapter holds nothing
+func (b *Bridge) Close() {
+	adapter, ok := b.registry.(ClosableAdapter)
+	if !ok {
 		return
 	}
-	b.remove(path)
-}
-
-// Update try to update service to backend
-func (b *Bridge) Update(path string) {
-	b.Remove(path)
-	b.Add(path)
+	if err := adapter.Close(); err != nil {
+		log.Errorf("close adapter failed: %v", err)
+	}
 }
 
-// Refresh refresh service registry ttl
+// Refresh refreshes the TTL of registered and draining services, e.g. sends
+// the heartbeats of backends which expire the services not renewed
 func (b *Bridge) Refresh() {
+	b.Lock()
+	defer b.Unlock()
 
+	for _, services := range []map[string]*Service{b.services, b.draining} {
+		for key, service := range services {
+			if err := b.registry.Refresh(service); err != nil {
+				log.Errorf("refresh %s %s failed: %v", key, service.ID, err)
+			}
+		}
+	}
 }
 
-// Sync sync service to backend
+// Sync sync services of all sources to backend
 func (b *Bridge) Sync(quiet bool) {
 	b.Lock()
 	defer b.Unlock()
 
-	paths, err := RecursiveFilesLookup(b.config.ConfDir, "*json")
-	if err != nil && quiet {
-		log.Errorf("recursive lookup confdir failed: %v", err)
-		return
-	} else if err != nil && !quiet {
-		log.Fatal(err)
+	extServices, err := b.registry.Services()
+	if err != nil {
+		// drift detection is unavailable, register all services unconditionally
+		log.Errorf("list services from backend failed: %v", err)
+	}
+	registered := make(map[string]*Service, len(extServices))
+	for _, extService := range extServices {
+		registered[extService.ID] = extService
 	}
 
-	log.Infof("syncing services on %d files (include storage.json)", len(paths))
-
-	registered := []string{}
-
-	for _, path := range paths {
-		if filepath.Base(path) == b.store.FileName {
-			continue
-		}
-		service := b.newService(path)
-		registered = append(registered, service.ID)
-
-		if sid, ok := b.store.GetServiceID(path); !ok || sid != service.ID {
-			b.add(path, quiet)
-		} else {
-			err := b.registry.Register(service)
-			if err != nil {
-				log.Errorf("sync register failed: %v %v", service, err)
-			}
+	for name := range b.sources {
+		if serr := b.syncSource(name, registered, err == nil); serr != nil && quiet {
+			log.Errorf("sync %s source failed: %v", name, serr)
+		} else if serr != nil && !quiet {
+			log.Fatal(serr)
 		}
 	}
 
 	if b.config.Cleanup {
-		extServices, err := b.registry.Services()
 		if err != nil {
 			log.Errorf("cleanup failed: %v", err)
 			return
@@ -166,66 +218,488 @@ func (b *Bridge) Sync(quiet bool) {
 	}
 }
 
-func (b *Bridge) add(path string, quiet bool) {
-	service := b.newService(path)
-	if id, ok := b.store.GetServiceID(path); ok && service.ID == id {
-		log.Warnf("ignored service registry request, it's already registered path: %s, service_id: %s", path, id)
+// syncSource sync the snapshot of source to backend, the registered services
+// of source but not in snapshot are removed, registered is the services of
+// backend and only available If listed
+func (b *Bridge) syncSource(name string, registered map[string]*Service, listed bool) error {
+	services, err := b.sources[name].Services()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("syncing %d services of %s source", len(services), name)
+
+	for key, service := range services {
+		b.identify(service)
+		service = b.tag(service)
+		b.candidates[key] = &candidate{source: name, service: service}
+		if !b.allowed(service) {
+			b.hold(key, service)
+			continue
+		}
+		b.ensure(name, key, service, registered, listed)
+	}
+
+	for key, c := range b.candidates {
+		if _, ok := services[key]; !ok && c.source == name {
+			delete(b.candidates, key)
+		}
+	}
+	for key, meta := range b.store.All() {
+		if _, ok := services[key]; !ok && meta.Source == name {
+			b.remove(key)
+		}
+	}
+
+	return nil
+}
+
+// ensure makes sure the service is registered and identical with the copy of backend
+func (b *Bridge) ensure(source string, key string, service *Service, registered map[string]*Service, listed bool) {
+	if meta, ok := b.store.Get(key); !ok || meta.ID != service.ID || meta.Draining() {
+		b.add(source, key, service)
 		return
 	}
+	b.services[key] = service
+
+	if extService, ok := registered[service.ID]; ok {
+		fields := b.diff(service, extService)
+		if len(fields) == 0 {
+			log.Debugf("in sync: %s %s", key, service.ID)
+			return
+		}
+		log.Infof("drifted: %s %s %v", key, service.ID, fields)
+	} else if listed {
+		log.Infof("missing: %s %s", key, service.ID)
+	}
+
+	if err := b.registry.Register(b.registration(service)); err != nil {
+		log.Errorf("sync register failed: %v %v", service, err)
+	}
+}
+
+// registration returns the service to be registered, it's a copy with the
+// initial status of checks critical If the readiness policy requires, so that
+// the desired service of source is never changed
+func (b *Bridge) registration(service *Service) *Service {
+	if !b.readiness.Critical(service) {
+		return service
+	}
+	critical := *service
+	critical.Checks = make([]*Check, len(service.Checks))
+	for i, check := range service.Checks {
+		c := *check
+		c.Status = "critical"
+		critical.Checks[i] = &c
+	}
+	return &critical
+}
+
+// Listen applies the change events of all sources until stop closed
+func (b *Bridge) Listen(stop <-chan struct{}) {
+	type sourceEvent struct {
+		source string
+		*SourceEvent
+	}
+
+	changes := make(chan struct{})
+	for _, gate := range b.gates {
+		go gate.Watch(changes, stop)
+	}
+	go b.readiness.Run(b.candidateServices, changes, stop)
+	go b.predicates.Run(b.candidateServices, changes, stop)
+	if b.checker != nil {
+		go b.checker.Run(b.candidateServices, changes, stop)
+	}
 
-	if service == nil {
-		if !quiet {
-			log.Warnf("new service with file %s failed, ignored", path)
+	events := make(chan sourceEvent)
+	for name, source := range b.sources {
+		sourceEvents := make(chan *SourceEvent)
+		go source.Watch(sourceEvents, stop)
+		go func(name string) {
+			for {
+				select {
+				case event := <-sourceEvents:
+					select {
+					case events <- sourceEvent{name, event}:
+					case <-stop:
+						return
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(name)
+	}
+
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+
+	log.Infof("listening for source events ...")
+	for {
+		select {
+		case event := <-events:
+			b.handle(event.source, event.SourceEvent)
+		case <-changes:
+			b.reevaluate()
+		case now := <-ticker.C:
+			b.expireDrains(now)
+		case <-stop:
+			return
 		}
+	}
+}
+
+func (b *Bridge) handle(source string, event *SourceEvent) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch event.Type {
+	case EventAdd, EventUpdate:
+		b.identify(event.Service)
+		event.Service = b.tag(event.Service)
+		b.candidates[event.Key] = &candidate{source: source, service: event.Service}
+		if !b.allowed(event.Service) {
+			b.hold(event.Key, event.Service)
+			return
+		}
+		b.add(source, event.Key, event.Service)
+	case EventRemove:
+		b.remove(event.Key)
+	case EventResync:
+		extServices, err := b.registry.Services()
+		if err != nil {
+			log.Errorf("list services from backend failed: %v", err)
+		}
+		registered := make(map[string]*Service, len(extServices))
+		for _, extService := range extServices {
+			registered[extService.ID] = extService
+		}
+		if err := b.syncSource(source, registered, err == nil); err != nil {
+			log.Errorf("sync %s source failed: %v", source, err)
+		}
+	}
+}
+
+// reevaluate registers the candidates which become allowed by gates, replaces
+// the previous definitions kept while the edited ones were pending, and
+// withdraws the registered services which are no longer allowed
+func (b *Bridge) reevaluate() {
+	b.Lock()
+	defer b.Unlock()
+
+	for key, c := range b.candidates {
+		meta, registered := b.store.Get(key)
+		allowed := b.allowed(c.service)
+		if allowed && (!registered || meta.ID != c.service.ID) {
+			b.add(c.source, key, c.service)
+		} else if !allowed && registered {
+			b.hold(key, c.service)
+		}
+	}
+}
+
+// allowed returns whether the service is allowed to be registered by all gates,
+// its enabled_if predicate holds, it is ready, and is healthy If health checks
+// run locally
+func (b *Bridge) allowed(service *Service) bool {
+	for name, gate := range b.gates {
+		if !gate.Allow(service) {
+			log.Debugf("%s gate disallowed: %s", name, service.ID)
+			return false
+		}
+	}
+	registered := b.registered(service.ID)
+	if !b.predicates.Holds(service, registered) {
+		log.Debugf("enabled_if doesn't hold, disallowed: %s", service.ID)
+		return false
+	}
+	if !b.readiness.Ready(service, registered) {
+		log.Debugf("not ready, disallowed: %s", service.ID)
+		return false
+	}
+	if b.checker != nil && !b.checker.Healthy(service, registered) {
+		log.Debugf("unhealthy, disallowed: %s", service.ID)
+		return false
+	}
+	return true
+}
+
+// pending returns whether the service is not allowed only because its
+// enabled_if predicate, readiness or health checks are not known yet
+func (b *Bridge) pending(service *Service) bool {
+	for _, gate := range b.gates {
+		if !gate.Allow(service) {
+			return false
+		}
+	}
+	known := true
+	if !b.predicates.Holds(service, false) {
+		known = false
+		if !b.predicates.Pending(service) {
+			return false
+		}
+	}
+	if !b.readiness.Ready(service, false) {
+		known = false
+		if !b.readiness.Pending(service) {
+			return false
+		}
+	}
+	if b.checker != nil && !b.checker.Healthy(service, false) {
+		known = false
+		if !b.checker.Pending(service) {
+			return false
+		}
+	}
+	return !known
+}
+
+// registered returns whether the service has been registered and not draining
+func (b *Bridge) registered(id string) bool {
+	for _, meta := range b.store.All() {
+		if meta.ID == id && !meta.Draining() {
+			return true
+		}
+	}
+	return false
+}
+
+// candidateServices returns the desired services of all sources
+func (b *Bridge) candidateServices() []*Service {
+	b.Lock()
+	defer b.Unlock()
+
+	services := make([]*Service, 0, len(b.candidates))
+	for _, c := range b.candidates {
+		services = append(services, c.service)
+	}
+	return services
+}
+
+// Watch reconciles services which have been changed or removed out-of-band
+// until stop closed, it's a no-op If the adapter is unable to watch backend
+func (b *Bridge) Watch(stop <-chan struct{}) {
+	watcher, ok := b.registry.(WatchableAdapter)
+	if !ok {
+		log.Debugf("adapter doesn't support watch, skip")
+		return
+	}
+
+	services := make(chan []*Service)
+	go watcher.Watch(services, stop)
+
+	log.Infof("watching services of backend ...")
+	for {
+		select {
+		case extServices := <-services:
+			b.reconcile(extServices)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reconcile re-registers the locally owned services which have disappeared
+// from backend or drifted from definition
+func (b *Bridge) reconcile(extServices []*Service) {
+	b.Lock()
+	defer b.Unlock()
+
+	registered := make(map[string]*Service, len(extServices))
+	for _, extService := range extServices {
+		registered[extService.ID] = extService
+	}
+
+	for key, service := range b.services {
+		extService, ok := registered[service.ID]
+		if !ok {
+			log.Infof("disappeared: %s %s", key, service.ID)
+		} else if fields := b.diff(service, extService); len(fields) > 0 {
+			log.Infof("drifted: %s %s %v", key, service.ID, fields)
+		} else {
+			continue
+		}
+
+		if err := b.registry.Register(b.registration(service)); err != nil {
+			log.Errorf("reconcile register failed: %v %v", service, err)
+			continue
+		}
+		log.Infof("reconciled: %s %s", key, service.ID)
+	}
+}
+
+func (b *Bridge) add(source string, key string, service *Service) {
+	meta, ok := b.store.Get(key)
+	if ok && meta.Draining() && service.ID == meta.ID {
+		// definition reappeared
+		b.undrain(source, key, service)
 		return
 	}
-	err := b.registry.Register(service)
+
+	id := meta.ID
+	if ok && service.ID == id {
+		log.Warnf("ignored service registry request, it's already registered key: %s, service_id: %s", key, id)
+		b.services[key] = service
+		return
+	}
+
+	if ok {
+		// definition has been changed, deregister the stale one
+		log.Infof("replaced: %s %s", key, id)
+		if err := b.registry.Deregister(&Service{ID: id}); err != nil {
+			log.Errorf("deregister service failed: %v", err)
+		}
+		delete(b.draining, key)
+	}
+
+	err := b.registry.Register(b.registration(service))
 	if err != nil {
 		log.Errorf("register service failed: %v", err)
 		return
 	}
+	b.services[key] = service
 
-	err = b.store.Add(path, service.ID)
+	err = b.store.Add(key, service.ID, source, service.Drain)
 	if err != nil {
 		log.Errorf("register service succeed, but persistent in local storage failed: %v", err)
 		return
 	}
 
-	log.Infof("added: %s %s", path, service.ID)
+	log.Infof("added: %s %s", key, service.ID)
 }
 
-func (b *Bridge) remove(path string) {
-	b.Lock()
-	defer b.Unlock()
+// remove deregisters the service which has been removed from source, it's
+// drained first If drain period is specified
+func (b *Bridge) remove(key string) {
+	if meta, ok := b.store.Get(key); ok && !meta.Draining() {
+		if period := b.drainPeriod(meta); period > 0 {
+			b.drain(key, meta, period)
+		} else {
+			log.Infof("removed: %s %s", key, meta.ID)
+			svc := &Service{ID: meta.ID}
+			b.registry.Deregister(svc)
+			b.store.Remove(key)
+		}
+	}
+	delete(b.services, key)
+	delete(b.candidates, key)
+}
+
+// hold withdraws the registration of key as its service is not allowed. If
+// the definition has been edited and the new one is pending, the registration
+// of previous definition is kept until the new one is allowed or rejected, so
+// that editing doesn't take the service out of rotation
+func (b *Bridge) hold(key string, service *Service) {
+	if meta, ok := b.store.Get(key); ok && meta.ID != service.ID && !meta.Draining() && b.pending(service) {
+		log.Debugf("pending, keep the previous registration: %s %s", key, meta.ID)
+		return
+	}
+	b.withdraw(key)
+}
 
-	if id, ok := b.store.GetServiceID(path); ok {
-		log.Infof("removed: %s %s", path, id)
+// withdraw deregisters the service which is not allowed by gates, but keeps
+// it as candidate to be registered again once allowed
+func (b *Bridge) withdraw(key string) {
+	if id, ok := b.store.GetServiceID(key); ok {
+		log.Infof("withdrawn: %s %s", key, id)
 		svc := &Service{ID: id}
 		b.registry.Deregister(svc)
-		b.store.Remove(path)
+		b.store.Remove(key)
+	}
+	delete(b.services, key)
+	delete(b.draining, key)
+}
+
+// identify generates service id by the signature of its encoded definition
+// unless it has been identified by source, e.g. ParseService
+func (b *Bridge) identify(service *Service) {
+	if service.ID == "" {
+		s := *service
+		s.TTL = 0
+		definition, _ := json.Marshal(s)
+		service.ID = serviceID(definition, service.Port)
+	}
+	service.TTL = b.config.RefreshTTL
+	service.RefreshInterval = b.config.RefreshInterval
+}
+
+// tag returns a copy of service with the global tags, they are not part of
+// the signature so that the service is updated in place rather than replaced
+// when they changed
+func (b *Bridge) tag(service *Service) *Service {
+	if len(b.config.Tags) == 0 {
+		return service
 	}
 
+	tagged := *service
+	tagged.Tags = append([]string{}, service.Tags...)
+Outer:
+	for _, tag := range b.config.Tags {
+		for _, t := range service.Tags {
+			if t == tag {
+				continue Outer
+			}
+		}
+		tagged.Tags = append(tagged.Tags, tag)
+	}
+	return &tagged
+}
+
+// Reconfigure applies the settings which can be changed while running, i.e.
+// cleanup, drain, tags, refresh and predicate interval, the services are resynced If
+// the tags changed
+func (b *Bridge) Reconfigure(config Config) {
+	b.Lock()
+	b.config.Cleanup = config.Cleanup
+	b.config.Drain = config.Drain
+	b.config.RefreshInterval = config.RefreshInterval
+	resync := !reflect.DeepEqual(b.config.Tags, config.Tags)
+	b.config.Tags = config.Tags
+	if config.PredicateInterval > 0 {
+		atomic.StoreInt64(&predicateInterval, int64(time.Duration(config.PredicateInterval)*time.Second))
+	}
+	b.Unlock()
+
+	if resync {
+		log.Infof("tags changed, resyncing all services")
+		b.Sync(true)
+	}
 }
 
-func (b *Bridge) newService(path string) *Service {
+// ParseService parses and validates service definition, the service id is
+// generated by the signature of definition
+func ParseService(definition []byte) (*Service, error) {
 	service := new(Service)
-	configBytes, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Errorf("read service definition config %s failed: %v", path, err)
-		return nil
+	if err := json.Unmarshal(definition, service); err != nil {
+		return nil, err
 	}
-	if err = json.Unmarshal(configBytes, service); err != nil {
-		log.Errorf("parse service definition config %s failed: %v", path, err)
-		return nil
+	if err := service.Validate(); err != nil {
+		return nil, err
 	}
+	service.ID = serviceID(definition, service.Port)
+	return service, nil
+}
 
-	service.ID = fmt.Sprintf("[%s]:%s:%d", HardwareID, b.signature(configBytes), service.Port)
-	service.TTL = b.config.RefreshTTL
+// ScopedServiceID returns the service id of definition scoped by the key of
+// source, so that the identical definitions of different keys, e.g. the ones
+// of a file and API, are registered as different services
+func ScopedServiceID(key string, definition []byte, port int) string {
+	return serviceID(append([]byte(key+"\n"), definition...), port)
+}
+
+// IsLocalServiceID returns whether the service id was generated by registrator
+// on local node
+func IsLocalServiceID(id string) bool {
+	matches := serviceIDPattern.FindStringSubmatch(id)
+	return len(matches) == 3 && matches[1] == HardwareID
+}
 
-	return service
+func serviceID(definition []byte, port int) string {
+	return fmt.Sprintf("[%s]:%s:%d", HardwareID, signature(definition), port)
 }
 
-func (b *Bridge) signature(bytes []byte) string {
+func signature(bytes []byte) string {
 	bs := sha1.Sum(bytes)
 	return fmt.Sprintf("%x", bs)
 }
@@ -233,10 +707,27 @@ func (b *Bridge) signature(bytes []byte) string {
 // HardwareID node identifier by main board SN
 var HardwareID string
 
+// LocalNode identity of this node, address is set by config HostIP
+var LocalNode Node
+
+// hardwareIDErr error of reading main board SN, it's returned by New rather
+// than panicking on init, so that the packages can be tested on any host
+var hardwareIDErr error
+
 func init() {
 	bs, err := ioutil.ReadFile("/sys/class/dmi/id/board_serial")
 	if err != nil {
-		panic(fmt.Sprintf("couldn't get main board SN from /sys/class/dmi/id/board_serial: %s", err.Error()))
+		hardwareIDErr = fmt.Errorf("couldn't get main board SN from /sys/class/dmi/id/board_serial: %s", err.Error())
 	}
 	HardwareID = strings.TrimSuffix(string(bs), "\n")
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		panic(fmt.Sprintf("couldn't get hostname: %s", err.Error()))
+	}
+	LocalNode = Node{
+		ID:   HardwareID,
+		Name: hostname,
+		Meta: make(map[string]string),
+	}
 }
@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// leasingAdapter the stand-in of adapter of which backend expires services
+type leasingAdapter struct{}
+
+func (a *leasingAdapter) Ping() error                       { return nil }
+func (a *leasingAdapter) Register(service *Service) error   { return nil }
+func (a *leasingAdapter) Deregister(service *Service) error { return nil }
+func (a *leasingAdapter) Refresh(service *Service) error    { return nil }
+func (a *leasingAdapter) Services() ([]*Service, error)     { return nil, nil }
+func (a *leasingAdapter) RequiresRefresh() bool             { return true }
+func (a *leasingAdapter) New(uri *url.URL) RegistryAdapter  { return a }
+
+// staticSource the stand-in of source without services
+type staticSource struct{}
+
+func (s *staticSource) Services() (map[string]*Service, error)                 { return nil, nil }
+func (s *staticSource) Watch(events chan<- *SourceEvent, stop <-chan struct{}) {}
+func (s *staticSource) New(uri *url.URL) Source                                { return s }
+
+func TestNewRequiresRefresh(t *testing.T) {
+	hardwareIDErr = nil
+	Register(new(leasingAdapter), "leasing-test")
+	Register(new(staticSource), "static-test")
+	defer Unregister("leasing-test")
+	defer Unregister("static-test")
+
+	dir, err := ioutil.TempDir("", "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Config{ConfDir: dir, Sources: []string{"static-test://"}}
+	if _, err := New("leasing-test://", config); err == nil || !strings.Contains(err.Error(), "-ttl-refresh") {
+		t.Errorf("New() without refresh interval = %v", err)
+	}
+
+	config.RefreshInterval, config.RefreshTTL = 10, 30
+	b, err := New("leasing-test://", config)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	service := &Service{Name: "web", Port: 80}
+	b.identify(service)
+	if service.TTL != 30 || service.RefreshInterval != 10 {
+		t.Errorf("identified service = %+v", service)
+	}
+}
+
+// fakeAdapter the stand-in of adapter keeping services in memory and
+// recording the calls
+type fakeAdapter struct {
+	sync.Mutex
+	services map[string]*Service
+	calls    []string
+	pingErr  error
+	// endpoint the endpoint in use, it fails over as FailoverAdapter
+	endpoint string
+}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{services: make(map[string]*Service)}
+}
+
+func (a *fakeAdapter) New(uri *url.URL) RegistryAdapter { return a }
+
+func (a *fakeAdapter) Ping() error {
+	a.Lock()
+	defer a.Unlock()
+	return a.pingErr
+}
+
+func (a *fakeAdapter) Endpoint() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.endpoint
+}
+
+func (a *fakeAdapter) Register(service *Service) error {
+	a.Lock()
+	defer a.Unlock()
+	a.calls = append(a.calls, "register "+service.ID)
+	a.services[service.ID] = service
+	return nil
+}
+
+func (a *fakeAdapter) Deregister(service *Service) error {
+	a.Lock()
+	defer a.Unlock()
+	a.calls = append(a.calls, "deregister "+service.ID)
+	delete(a.services, service.ID)
+	return nil
+}
+
+func (a *fakeAdapter) Refresh(service *Service) error {
+	a.Lock()
+	defer a.Unlock()
+	a.calls = append(a.calls, "refresh "+service.ID)
+	return nil
+}
+
+func (a *fakeAdapter) Services() ([]*Service, error) {
+	a.Lock()
+	defer a.Unlock()
+	services := make([]*Service, 0, len(a.services))
+	for _, service := range a.services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// reset returns the recorded calls and forgets them
+func (a *fakeAdapter) reset() []string {
+	a.Lock()
+	defer a.Unlock()
+	calls := a.calls
+	a.calls = nil
+	return calls
+}
+
+// mapSource the stand-in of source of which services are set by tests
+type mapSource struct {
+	sync.Mutex
+	services map[string]*Service
+}
+
+func (s *mapSource) New(uri *url.URL) Source { return s }
+
+func (s *mapSource) Services() (map[string]*Service, error) {
+	s.Lock()
+	defer s.Unlock()
+	services := make(map[string]*Service, len(s.services))
+	for key, service := range s.services {
+		// the source returns a new copy each time as the real ones
+		copied := *service
+		services[key] = &copied
+	}
+	return services, nil
+}
+
+func (s *mapSource) Watch(events chan<- *SourceEvent, stop <-chan struct{}) {}
+
+func (s *mapSource) set(key string, service *Service) {
+	s.Lock()
+	defer s.Unlock()
+	if service == nil {
+		delete(s.services, key)
+		return
+	}
+	s.services[key] = service
+}
+
+// newTestBridge returns the bridge of adapter and source, the state is stored
+// in config.ConfDir so a bridge of the same dir is the one after restart
+func newTestBridge(t *testing.T, adapter RegistryAdapter, source Source, config Config) *Bridge {
+	t.Helper()
+	hardwareIDErr = nil
+	HardwareID = "test"
+	Register(adapter, "fake-test")
+	Register(source, "map-test")
+	t.Cleanup(func() {
+		Unregister("fake-test")
+		Unregister("map-test")
+	})
+
+	config.Sources = []string{"map-test://"}
+	b, err := New("fake-test://", config)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	return b
+}
+
+// tempDir returns a temporary directory removed after test
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
@@ -0,0 +1,96 @@
+package bridge
+
+import (
+	"time"
+)
+
+// DrainingTag tag of draining service for the backends without maintenance mode
+const DrainingTag = "draining"
+
+// drainTick granularity of deregistering drained services
+const drainTick = time.Second
+
+// drainPeriod returns the drain period of service, the one of service takes
+// precedence over the global one
+func (b *Bridge) drainPeriod(meta ServiceMeta) time.Duration {
+	if meta.Drain != "" {
+		period, _ := time.ParseDuration(meta.Drain)
+		return period
+	}
+	return time.Duration(b.config.Drain) * time.Second
+}
+
+// drain takes the removed service out of rotation, it's deregistered once the
+// period elapsed, and refreshed meanwhile so that it doesn't expire on the
+// backends with leases. The pending state is persisted in storage across restarts
+func (b *Bridge) drain(key string, meta ServiceMeta, period time.Duration) {
+	service := b.services[key]
+	if service == nil {
+		service = &Service{ID: meta.ID}
+	}
+
+	if adapter, ok := b.registry.(MaintenanceAdapter); ok {
+		if err := adapter.EnableMaintenance(service, "draining"); err != nil {
+			log.Errorf("enable maintenance failed: %s %v", meta.ID, err)
+		}
+		if service.Name != "" {
+			b.draining[key] = service
+		}
+	} else if service.Name != "" {
+		draining := *service
+		draining.Tags = append(append([]string{}, service.Tags...), DrainingTag)
+		if err := b.registry.Register(&draining); err != nil {
+			log.Errorf("tag draining service failed: %s %v", meta.ID, err)
+		}
+		// the tagged one is refreshed, so it's kept tagged If registered again
+		b.draining[key] = &draining
+	} else {
+		// definition is unknown after restart, it can't be tagged
+		log.Warnf("definition of %s is unknown, drained without tagging", meta.ID)
+	}
+
+	until := time.Now().Add(period)
+	if err := b.store.Drain(key, until); err != nil {
+		log.Errorf("persistent draining state failed: %v", err)
+	}
+	log.Infof("draining: %s %s until %s", key, meta.ID, until.Format(time.RFC3339))
+}
+
+// undrain brings the draining service back into rotation as its definition reappeared
+func (b *Bridge) undrain(source string, key string, service *Service) {
+	var err error
+	if adapter, ok := b.registry.(MaintenanceAdapter); ok {
+		err = adapter.DisableMaintenance(service)
+	} else {
+		err = b.registry.Register(b.registration(service))
+	}
+	if err != nil {
+		log.Errorf("cancel draining failed: %s %v", service.ID, err)
+		return
+	}
+	b.services[key] = service
+	delete(b.draining, key)
+
+	if err := b.store.Add(key, service.ID, source, service.Drain); err != nil {
+		log.Errorf("persistent in local storage failed: %v", err)
+	}
+	log.Infof("draining cancelled: %s %s", key, service.ID)
+}
+
+// expireDrains deregisters the services which have been drained
+func (b *Bridge) expireDrains(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	for key, meta := range b.store.All() {
+		if !meta.Draining() || now.Unix() < meta.DrainUntil {
+			continue
+		}
+		log.Infof("removed: %s %s", key, meta.ID)
+		if err := b.registry.Deregister(&Service{ID: meta.ID}); err != nil {
+			log.Errorf("deregister service failed: %v", err)
+		}
+		b.store.Remove(key)
+		delete(b.draining, key)
+	}
+}
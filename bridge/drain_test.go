@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func drainingBridge(t *testing.T, dir string, adapter *fakeAdapter, source *mapSource) (*Bridge, string) {
+	t.Helper()
+	Unregister("fake-test")
+	Unregister("map-test")
+	b := newTestBridge(t, adapter, source, Config{ConfDir: dir, Drain: 30})
+	b.Sync(false)
+	meta, _ := b.store.Get("web")
+	return b, meta.ID
+}
+
+func TestDrain(t *testing.T) {
+	adapter := newFakeAdapter()
+	source := &mapSource{services: map[string]*Service{"web": {Name: "web", Port: 80, Tags: []string{"http"}}}}
+	b, id := drainingBridge(t, tempDir(t), adapter, source)
+	adapter.reset()
+
+	source.set("web", nil)
+	b.Sync(false)
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Fatalf("calls on drain = %v", calls)
+	}
+	if tags := adapter.services[id].Tags; len(tags) != 2 || tags[1] != DrainingTag {
+		t.Errorf("tags of draining service = %v", tags)
+	}
+
+	// the draining service is refreshed until deregistered
+	b.Refresh()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "refresh "+id {
+		t.Errorf("calls on refresh = %v", calls)
+	}
+	b.expireDrains(time.Now())
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Errorf("service is deregistered before drained: %v", calls)
+	}
+	b.expireDrains(time.Now().Add(31 * time.Second))
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "deregister "+id {
+		t.Errorf("calls on expiry = %v", calls)
+	}
+	b.Refresh()
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Errorf("deregistered service is refreshed: %v", calls)
+	}
+	if _, ok := b.store.Get("web"); ok {
+		t.Error("deregistered service is kept in storage")
+	}
+}
+
+func TestUndrain(t *testing.T) {
+	adapter := newFakeAdapter()
+	web := &Service{Name: "web", Port: 80}
+	source := &mapSource{services: map[string]*Service{"web": web}}
+	b, id := drainingBridge(t, tempDir(t), adapter, source)
+
+	source.set("web", nil)
+	b.Sync(false)
+	adapter.reset()
+
+	// the definition reappeared
+	source.set("web", web)
+	b.Sync(false)
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Fatalf("calls on undrain = %v", calls)
+	}
+	if tags := adapter.services[id].Tags; len(tags) != 0 {
+		t.Errorf("tags of undrained service = %v", tags)
+	}
+	if meta, _ := b.store.Get("web"); meta.Draining() {
+		t.Error("undrained service is draining")
+	}
+	b.expireDrains(time.Now().Add(31 * time.Second))
+	b.Refresh()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "refresh "+id {
+		t.Errorf("calls after undrain = %v", calls)
+	}
+}
+
+func TestDrainRestart(t *testing.T) {
+	dir := tempDir(t)
+	adapter := newFakeAdapter()
+	source := &mapSource{services: map[string]*Service{"web": {Name: "web", Port: 80}}}
+	b, id := drainingBridge(t, dir, adapter, source)
+
+	source.set("web", nil)
+	b.Sync(false)
+
+	// the draining state is restored after restart and expires as before
+	b, _ = drainingBridge(t, dir, adapter, source)
+	adapter.reset()
+	meta, ok := b.store.Get("web")
+	if !ok || !meta.Draining() || meta.ID != id {
+		t.Fatalf("draining state after restart = %+v", meta)
+	}
+	b.expireDrains(time.Now())
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Errorf("service is deregistered before drained: %v", calls)
+	}
+	b.expireDrains(time.Now().Add(31 * time.Second))
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "deregister "+id {
+		t.Errorf("calls on expiry after restart = %v", calls)
+	}
+}
@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Diff compares the service definition with the copy of backend field by field,
+// returns the names of fields which have drifted, empty If they are identical.
+//
+// TTL is a runtime setting rather than part of definition, the status of
+// checks is maintained by backend, and the args, grpc, ttl, rise and fall of
+// checks could not be reported by every backend, so all of them are not compared.
+func Diff(desired, actual *Service) []string {
+	var fields []string
+
+	if desired.Name != actual.Name {
+		fields = append(fields, "name")
+	}
+	if desired.Port != actual.Port {
+		fields = append(fields, "port")
+	}
+	if desired.IP != actual.IP {
+		fields = append(fields, "address")
+	}
+	if !equalTags(desired.Tags, actual.Tags) {
+		fields = append(fields, "tags")
+	}
+	if !equalAttrs(desired.Attrs, actual.Attrs) {
+		fields = append(fields, "attrs")
+	}
+	if !equalChecks(desired.Checks, actual.Checks) {
+		fields = append(fields, "checks")
+	}
+
+	return fields
+}
+
+// diff returns the drifted fields of service, the checks are not compared If
+// backend doesn't run them, as it may not keep them
+func (b *Bridge) diff(desired, actual *Service) []string {
+	if adapter, ok := b.registry.(NormalizingAdapter); ok {
+		desired = adapter.Normalize(desired)
+	}
+	fields := Diff(desired, actual)
+	if adapter, ok := b.registry.(CheckingAdapter); ok && adapter.RunsChecks() {
+		return fields
+	}
+	for i, field := range fields {
+		if field == "checks" {
+			return append(fields[:i], fields[i+1:]...)
+		}
+	}
+	return fields
+}
+
+func equalTags(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	a := append([]string(nil), x...)
+	b := append([]string(nil), y...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
+
+func equalAttrs(x, y map[string]string) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, v := range x {
+		if w, ok := y[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func equalChecks(x, y []*Check) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		a, b := x[i], y[i]
+		if a.ID != b.ID || a.Name != b.Name ||
+			a.HTTP != b.HTTP || a.Method != b.Method || a.TCP != b.TCP ||
+			a.TLSSkipVerify != b.TLSSkipVerify ||
+			len(a.Header) != len(b.Header) || (len(a.Header) > 0 && !reflect.DeepEqual(a.Header, b.Header)) ||
+			!equalDuration(a.Interval, b.Interval) ||
+			!equalDuration(a.Timeout, b.Timeout) ||
+			!equalDuration(a.DeregisterCriticalServiceAfter, b.DeregisterCriticalServiceAfter) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalDuration compares durations in different formats, e.g. 1m and 60s
+func equalDuration(x, y string) bool {
+	if x == y {
+		return true
+	}
+	a, err := time.ParseDuration(x)
+	if err != nil {
+		return false
+	}
+	b, err := time.ParseDuration(y)
+	if err != nil {
+		return false
+	}
+	return a == b
+}
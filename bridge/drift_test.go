@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	desired := func() *Service {
+		return &Service{
+			ID: "web", Name: "web", Port: 80, IP: "10.0.0.5",
+			Tags:  []string{"http", "prod"},
+			Attrs: map[string]string{"team": "edge"},
+			Checks: []*Check{{
+				HTTP: "http://127.0.0.1/health", Method: "GET", Header: map[string][]string{"Host": {"web"}},
+				Interval: "10s", Timeout: "1s", DeregisterCriticalServiceAfter: "1m", Status: "critical",
+			}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *Service)
+		fields []string
+	}{
+		{"identical", func(s *Service) {}, nil},
+		{"status of check", func(s *Service) { s.Checks[0].Status = "passing" }, nil},
+		{"args of check", func(s *Service) { s.Checks[0].Args = []string{"true"} }, nil},
+		{"rise and fall of check", func(s *Service) { s.Checks[0].Rise, s.Checks[0].Fall = 2, 3 }, nil},
+		{"order of tags", func(s *Service) { s.Tags = []string{"prod", "http"} }, nil},
+		{"format of duration", func(s *Service) { s.Checks[0].DeregisterCriticalServiceAfter = "60s" }, nil},
+		{"name", func(s *Service) { s.Name = "api" }, []string{"name"}},
+		{"port", func(s *Service) { s.Port = 8080 }, []string{"port"}},
+		{"address", func(s *Service) { s.IP = "10.0.0.6" }, []string{"address"}},
+		{"tags", func(s *Service) { s.Tags = []string{"http"} }, []string{"tags"}},
+		{"value of attr", func(s *Service) { s.Attrs["team"] = "core" }, []string{"attrs"}},
+		{"attr added", func(s *Service) { s.Attrs["version"] = "1" }, []string{"attrs"}},
+		{"http of check", func(s *Service) { s.Checks[0].HTTP = "http://127.0.0.1/ping" }, []string{"checks"}},
+		{"header of check", func(s *Service) { s.Checks[0].Header = nil }, []string{"checks"}},
+		{"interval of check", func(s *Service) { s.Checks[0].Interval = "5s" }, []string{"checks"}},
+		{"check added", func(s *Service) { s.Checks = append(s.Checks, &Check{TCP: "127.0.0.1:80"}) }, []string{"checks"}},
+		{"checks removed", func(s *Service) { s.Checks = nil }, []string{"checks"}},
+		{"tags and checks", func(s *Service) { s.Tags = nil; s.Checks[0].TCP = "127.0.0.1:80" }, []string{"tags", "checks"}},
+	}
+	for _, test := range tests {
+		actual := desired()
+		test.change(actual)
+		if fields := Diff(desired(), actual); !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: Diff() = %v, want %v", test.name, fields, test.fields)
+		}
+	}
+}
+
+func TestBridgeDiffWithoutChecks(t *testing.T) {
+	desired := &Service{ID: "web", Name: "web", Port: 80, Tags: []string{"http"}, Checks: []*Check{{TCP: "127.0.0.1:80"}}}
+	actual := &Service{ID: "web", Name: "web", Port: 80}
+
+	// the checks are not kept by the backend which doesn't run them
+	b := &Bridge{registry: &fakeAdapter{}}
+	if fields := b.diff(desired, actual); len(fields) != 1 || fields[0] != "tags" {
+		t.Errorf("diff() = %v, want [tags]", fields)
+	}
+}
@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ParseEndpoints returns the comma separated endpoints in the host of adapter
+// URI, e.g. consul://127.0.0.1:8500,10.0.0.2:8500, nil If the host is empty
+func ParseEndpoints(uri *url.URL) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(uri.Host, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// Endpoints endpoints of backend with health-aware failover, the earlier one
+// is preferred, e.g. the local agent first and then the fallback ones
+type Endpoints struct {
+	sync.RWMutex
+	endpoints []string
+	current   int
+}
+
+// NewEndpoints returns the endpoints, the first one is used until failover
+func NewEndpoints(endpoints []string) *Endpoints {
+	return &Endpoints{endpoints: endpoints}
+}
+
+// All returns all the endpoints in the order of preference
+func (e *Endpoints) All() []string {
+	return e.endpoints
+}
+
+// Current returns the index of endpoint in use
+func (e *Endpoints) Current() int {
+	e.RLock()
+	defer e.RUnlock()
+	return e.current
+}
+
+// Failover pings the endpoints in the order of preference and switches to
+// the first healthy one, so that it fails back once the preferred one comes
+// back. It returns the error of the last endpoint If none is healthy
+func (e *Endpoints) Failover(ping func(i int) error) error {
+	var err error
+	for i, endpoint := range e.endpoints {
+		if err = ping(i); err != nil {
+			if len(e.endpoints) > 1 {
+				log.Warnf("endpoint %s is unhealthy: %v", endpoint, err)
+			}
+			continue
+		}
+
+		e.Lock()
+		if i != e.current {
+			log.Infof("failover from endpoint %s to %s", e.endpoints[e.current], endpoint)
+			e.current = i
+		}
+		e.Unlock()
+		return nil
+	}
+	return err
+}
+
+// Call calls fn with the index of endpoint in use. If the endpoint is
+// unreachable it fails over by ping, and calls fn once more on the new one
+func (e *Endpoints) Call(fn func(i int) error, unreachable func(err error) bool, ping func() error) error {
+	current := e.Current()
+	err := fn(current)
+	if err == nil || len(e.endpoints) == 1 || !unreachable(err) {
+		return err
+	}
+	if ping() != nil || e.Current() == current {
+		return err
+	}
+	log.Warnf("endpoint %s is unreachable, retry on %s: %v", e.endpoints[current], e.endpoints[e.Current()], err)
+	return fn(e.Current())
+}
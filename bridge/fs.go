@@ -1,13 +1,14 @@
 package bridge
 
 import (
-	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // StorageName is the storage file name
@@ -15,8 +16,19 @@ const StorageName = "storage.json"
 
 // ServiceMeta is represent service registered metadata
 type ServiceMeta struct {
-	ID   string `json:"service_id"`
-	SHA1 string `json:"service_sha1"`
+	ID     string `json:"service_id"`
+	SHA1   string `json:"service_sha1"`
+	Source string `json:"source,omitempty"`
+	// Drain drain period of service on removal, empty If not specified
+	Drain string `json:"drain,omitempty"`
+	// DrainUntil unix time when the draining service is to be deregistered,
+	// zero If it's not draining
+	DrainUntil int64 `json:"drain_until,omitempty"`
+}
+
+// Draining returns whether the service is draining
+func (m ServiceMeta) Draining() bool {
+	return m.DrainUntil > 0
 }
 
 // Storage is a way to store
@@ -46,41 +58,55 @@ func NewStore(configdir string) (*Storage, error) {
 		return nil, err
 	}
 
-	// rebuild storage
-	rebuild := false
-	for path := range storage.Metadata {
-		info, err := os.Stat(path)
-		if os.IsNotExist(err) || info.IsDir() {
-			rebuild = true
-			delete(storage.Metadata, path)
+	// services registered by earlier versions are all defined by file, the
+	// stale ones are removed by the sync of file source
+	for path, meta := range storage.Metadata {
+		if meta.Source == "" && isFile(path) {
+			meta.Source = "file"
+			storage.Metadata[path] = meta
 		}
 	}
-	if rebuild {
-		storage.flush()
-	}
 
 	return &storage, nil
 }
 
-// Add add registered service to local storage
-func (fs *Storage) Add(name string, serviceID string) error {
+// Add add registered service to local storage, name is the path of definition
+// file or the key of service which is not defined by file, source is the name
+// of source which the service comes from, drain is the drain period of service
+func (fs *Storage) Add(name string, serviceID string, source string, drain string) error {
 	fs.Lock()
 	defer fs.Unlock()
 
-	configBytes, err := ioutil.ReadFile(name)
-	if err != nil {
-		return err
+	matches := serviceIDPattern.FindStringSubmatch(serviceID)
+	if len(matches) != 3 {
+		return fmt.Errorf("invalid service id: %s", serviceID)
 	}
 
 	meta := ServiceMeta{
-		ID:   serviceID,
-		SHA1: fmt.Sprintf("%x", sha1.Sum(configBytes)),
+		ID:     serviceID,
+		SHA1:   matches[2],
+		Source: source,
+		Drain:  drain,
 	}
 
 	fs.Metadata[name] = meta
 	return fs.flush()
 }
 
+// Drain marks registered service as draining until the time
+func (fs *Storage) Drain(name string, until time.Time) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	meta, ok := fs.Metadata[name]
+	if !ok {
+		return fmt.Errorf("service not found: %s", name)
+	}
+	meta.DrainUntil = until.Unix()
+	fs.Metadata[name] = meta
+	return fs.flush()
+}
+
 // Remove remove registered service from local storage
 func (fs *Storage) Remove(name string) error {
 	fs.Lock()
@@ -91,6 +117,15 @@ func (fs *Storage) Remove(name string) error {
 	return fs.flush()
 }
 
+// Get returns the metadata of registered service If exists
+func (fs *Storage) Get(name string) (ServiceMeta, bool) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	meta, ok := fs.Metadata[name]
+	return meta, ok
+}
+
 // GetServiceID returns a service register id If exists
 func (fs *Storage) GetServiceID(name string) (string, bool) {
 	fs.Lock()
@@ -118,6 +153,25 @@ func (fs *Storage) Services() []ServiceMeta {
 	return results
 }
 
+// All returns a copy of registered service metadata keyed by path
+func (fs *Storage) All() map[string]ServiceMeta {
+	fs.Lock()
+	defer fs.Unlock()
+
+	results := make(map[string]ServiceMeta, len(fs.Metadata))
+	for path, meta := range fs.Metadata {
+		results[path] = meta
+	}
+
+	return results
+}
+
+// isFile returns whether the name is path of definition file, services which
+// are not defined by file are keyed in the form scheme://id
+func isFile(name string) bool {
+	return !strings.Contains(name, "://")
+}
+
 func (fs *Storage) flush() error {
 	configBytes, err := json.Marshal(fs)
 	if err != nil {
@@ -0,0 +1,110 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcServing SERVING of grpc.health.v1.HealthCheckResponse.ServingStatus
+const grpcServing = 1
+
+// h2cClient client of gRPC over plaintext HTTP/2
+var h2cClient = &http.Client{
+	Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	},
+}
+
+// probeGRPC calls the standard gRPC health checking protocol, the target is in
+// the form host:port/service, it passes If the status is SERVING
+func probeGRPC(ctx context.Context, target string) error {
+	address, service := target, ""
+	if i := strings.Index(target, "/"); i >= 0 {
+		address, service = target[:i], target[i+1:]
+	}
+
+	// HealthCheckRequest{service = 1}
+	var message []byte
+	if service != "" {
+		message = append(message, 0x0a)
+		message = appendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+	// length-prefixed message, uncompressed
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	frame = append(frame, message...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"http://"+address+"/grpc.health.v1.Health/Check", bytes.NewReader(frame))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := h2cClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	// the status is in headers If the response is trailers-only
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return fmt.Errorf("grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message"))
+	}
+
+	if len(body) < 5 || len(body) < 5+int(binary.BigEndian.Uint32(body[1:5])) {
+		return fmt.Errorf("malformed response")
+	}
+	message = body[5 : 5+int(binary.BigEndian.Uint32(body[1:5]))]
+
+	// HealthCheckResponse{status = 1}, it's UNKNOWN If omitted
+	serving := uint64(0)
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 || tag&7 != 0 {
+			return fmt.Errorf("malformed response")
+		}
+		value, m := binary.Uvarint(message[n:])
+		if m <= 0 {
+			return fmt.Errorf("malformed response")
+		}
+		if tag>>3 == 1 {
+			serving = value
+		}
+		message = message[n+m:]
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("grpc serving status %d", serving)
+	}
+	return nil
+}
+
+func appendUvarint(bs []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(bs, buf[:binary.PutUvarint(buf, v)]...)
+}
@@ -0,0 +1,353 @@
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// defaults of the health checks run locally
+const (
+	DefaultCheckInterval = 10 * time.Second
+	DefaultCheckTimeout  = 10 * time.Second
+)
+
+// checkTick granularity of scheduling checks
+const checkTick = time.Second
+
+// HealthChecker runs the health checks of services locally for the backends
+// which don't run them, the service is registered only while all its checks
+// are passing. The ttl checks can't be run locally and are ignored
+type HealthChecker struct {
+	sync.Mutex
+	// monitors of services keyed by service id
+	monitors map[string]*monitor
+}
+
+type monitor struct {
+	checks  []*checkState
+	healthy bool
+}
+
+type checkState struct {
+	check     *Check
+	interval  time.Duration
+	timeout   time.Duration
+	next      time.Time
+	running   bool
+	known     bool
+	passing   bool
+	successes int
+	failures  int
+}
+
+type checkResult struct {
+	serviceID string
+	index     int
+	check     *Check
+	timeout   time.Duration
+	err       error
+}
+
+// NewHealthChecker returns a new local health checker
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{monitors: make(map[string]*monitor)}
+}
+
+// Healthy returns whether all the checks of service are passing, the service
+// is unhealthy until the first results are known unless the initial status is
+// passing. The service which has been registered, e.g. before restart, is kept
+// until its checks fail Fall times
+func (h *HealthChecker) Healthy(service *Service, registered bool) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	m, ok := h.monitors[service.ID]
+	if !ok {
+		m = newMonitor(service)
+		if m == nil {
+			return true
+		}
+		h.monitors[service.ID] = m
+	}
+	if registered && !m.healthy {
+		m.keep()
+	}
+	return m.healthy
+}
+
+// Pending returns whether the results of some checks of service are not known yet
+func (h *HealthChecker) Pending(service *Service) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	m, ok := h.monitors[service.ID]
+	if !ok {
+		return false
+	}
+	for _, c := range m.checks {
+		if !c.known {
+			return true
+		}
+	}
+	return false
+}
+
+// Run runs the due checks of services until stop closed, services returns the
+// services to be checked, changes is signaled each time a service becomes
+// healthy or unhealthy
+func (h *HealthChecker) Run(services func() []*Service, changes chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkTick)
+	defer ticker.Stop()
+
+	results := make(chan checkResult)
+	for {
+		select {
+		case now := <-ticker.C:
+			h.track(services())
+			for _, r := range h.due(now) {
+				go func(r checkResult) {
+					r.err = probe(r.check, r.timeout)
+					select {
+					case results <- r:
+					case <-stop:
+					}
+				}(r)
+			}
+
+		case r := <-results:
+			if !h.update(r) {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			case <-stop:
+				return
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// track starts monitoring the new services and stops the removed ones
+func (h *HealthChecker) track(services []*Service) {
+	h.Lock()
+	defer h.Unlock()
+
+	ids := make(map[string]bool, len(services))
+	for _, service := range services {
+		ids[service.ID] = true
+		if _, ok := h.monitors[service.ID]; ok {
+			continue
+		}
+		if m := newMonitor(service); m != nil {
+			h.monitors[service.ID] = m
+		}
+	}
+	for id := range h.monitors {
+		if !ids[id] {
+			delete(h.monitors, id)
+		}
+	}
+}
+
+// due returns the checks to run and marks them running
+func (h *HealthChecker) due(now time.Time) []checkResult {
+	h.Lock()
+	defer h.Unlock()
+
+	var due []checkResult
+	for id, m := range h.monitors {
+		for i, c := range m.checks {
+			if c.running || now.Before(c.next) {
+				continue
+			}
+			c.running = true
+			c.next = now.Add(c.interval)
+			due = append(due, checkResult{serviceID: id, index: i, check: c.check, timeout: c.timeout})
+		}
+	}
+	return due
+}
+
+// update applies the check result, returns whether the service has become
+// healthy or unhealthy
+func (h *HealthChecker) update(r checkResult) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	m, ok := h.monitors[r.serviceID]
+	if !ok {
+		// service has been removed
+		return false
+	}
+	c := m.checks[r.index]
+	c.running = false
+
+	rise, fall := c.check.Rise, c.check.Fall
+	if rise < 1 {
+		rise = 1
+	}
+	if fall < 1 {
+		fall = 1
+	}
+	if r.err == nil {
+		c.successes++
+		c.failures = 0
+		if !c.known || (!c.passing && c.successes >= rise) {
+			c.known, c.passing = true, true
+		}
+	} else {
+		log.Debugf("check %d of %s failed: %v", r.index, r.serviceID, r.err)
+		c.failures++
+		c.successes = 0
+		if !c.known || (c.passing && c.failures >= fall) {
+			c.known, c.passing = true, false
+		}
+	}
+
+	healthy := true
+	for _, c := range m.checks {
+		healthy = healthy && c.known && c.passing
+	}
+	if healthy == m.healthy {
+		return false
+	}
+	m.healthy = healthy
+	if healthy {
+		log.Infof("healthy: %s", r.serviceID)
+	} else {
+		log.Infof("unhealthy: %s %v", r.serviceID, r.err)
+	}
+	return true
+}
+
+// newMonitor returns the monitor of checks which can be run locally, nil If none
+func newMonitor(service *Service) *monitor {
+	m := new(monitor)
+	for _, check := range service.Checks {
+		if check.HTTP == "" && check.TCP == "" && check.GRPC == "" && len(check.Args) == 0 {
+			continue
+		}
+		c := &checkState{
+			check:    check,
+			interval: parseCheckDuration(check.Interval, DefaultCheckInterval),
+			timeout:  parseCheckDuration(check.Timeout, DefaultCheckTimeout),
+		}
+		switch check.Status {
+		case "passing":
+			c.known, c.passing = true, true
+		case "warning", "critical":
+			c.known = true
+		}
+		m.checks = append(m.checks, c)
+	}
+	if len(m.checks) == 0 {
+		return nil
+	}
+
+	m.healthy = true
+	for _, c := range m.checks {
+		m.healthy = m.healthy && c.known && c.passing
+	}
+	return m
+}
+
+// keep regards the checks which have never been run as passing, so that they
+// fail after Fall failures rather than the first one
+func (m *monitor) keep() {
+	m.healthy = true
+	for _, c := range m.checks {
+		if c.successes == 0 && c.failures == 0 {
+			c.known, c.passing = true, true
+		}
+		m.healthy = m.healthy && c.known && c.passing
+	}
+}
+
+func parseCheckDuration(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// probe runs the check once, returns nil If passing
+func probe(check *Check, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch {
+	case check.HTTP != "":
+		return probeHTTP(ctx, check)
+	case check.TCP != "":
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", check.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case check.GRPC != "":
+		return probeGRPC(ctx, check.GRPC)
+	case len(check.Args) > 0:
+		return exec.CommandContext(ctx, check.Args[0], check.Args[1:]...).Run()
+	}
+	return errors.New("unsupported check")
+}
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	insecureHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+)
+
+// probeHTTP passes If the response status is 2xx
+func probeHTTP(ctx context.Context, check *Check) error {
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, check.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	for k, values := range check.Header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	client := httpClient
+	if check.TLSSkipVerify {
+		client = insecureHTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestRiseFall(t *testing.T) {
+	service := &Service{ID: "web", Checks: []*Check{{TCP: "127.0.0.1:80", Rise: 2, Fall: 3}}}
+	h := NewHealthChecker()
+	if h.Healthy(service, false) {
+		t.Fatal("healthy before the first result")
+	}
+	result := func(err error) bool {
+		return h.update(checkResult{serviceID: "web", index: 0, err: err})
+	}
+
+	// the first result is applied at once, then Rise successes and Fall failures
+	// are required to change
+	for i, c := range []struct {
+		err     error
+		changed bool
+		healthy bool
+	}{
+		{nil, true, true},
+		{errFailed, false, true},
+		{errFailed, false, true},
+		{errFailed, true, false},
+		{nil, false, false},
+		{errFailed, false, false},
+		{nil, false, false},
+		{nil, true, true},
+	} {
+		if changed := result(c.err); changed != c.changed || h.Healthy(service, false) != c.healthy {
+			t.Errorf("%d: changed %v healthy %v, want %v %v", i, changed, h.Healthy(service, false), c.changed, c.healthy)
+		}
+	}
+}
+
+var errFailed = errors.New("connection refused")
+
+func TestHealthyRegistered(t *testing.T) {
+	service := &Service{ID: "web", Checks: []*Check{{HTTP: "http://127.0.0.1/health", Fall: 2}, {TTL: "10s"}}}
+	h := NewHealthChecker()
+	h.track([]*Service{service})
+
+	// the registered service is kept until its checks fail Fall times
+	if !h.Healthy(service, true) {
+		t.Fatal("registered service is unhealthy before the first result")
+	}
+	h.update(checkResult{serviceID: "web", index: 0, err: errFailed})
+	if !h.Healthy(service, true) {
+		t.Error("registered service is unhealthy after one failure")
+	}
+	h.update(checkResult{serviceID: "web", index: 0, err: errFailed})
+	if h.Healthy(service, true) {
+		t.Error("registered service is healthy after Fall failures")
+	}
+
+	// services without local checks are healthy
+	if !h.Healthy(&Service{ID: "db", Checks: []*Check{{TTL: "10s"}}}, false) {
+		t.Error("service without local checks is unhealthy")
+	}
+}
+
+func TestRestartKeepsHealthCheckedService(t *testing.T) {
+	dir := tempDir(t)
+	adapter := newFakeAdapter()
+	source := &mapSource{services: map[string]*Service{
+		"web": {Name: "web", Port: 80, Checks: []*Check{{TCP: "127.0.0.1:80", Fall: 2}}},
+	}}
+
+	b := newTestBridge(t, adapter, source, Config{ConfDir: dir})
+	b.Sync(false)
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Fatalf("unhealthy service is registered: %v", calls)
+	}
+	id := b.candidates["web"].service.ID
+	b.checker.update(checkResult{serviceID: id, index: 0})
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Fatalf("healthy service is not registered: %v", calls)
+	}
+
+	// the registered service is neither withdrawn nor registered again after restart
+	Unregister("fake-test")
+	Unregister("map-test")
+	b = newTestBridge(t, adapter, source, Config{ConfDir: dir})
+	b.Sync(false)
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Fatalf("registered service is churned on restart: %v", calls)
+	}
+
+	b.checker.update(checkResult{serviceID: id, index: 0, err: errFailed})
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Fatalf("service is withdrawn before Fall failures: %v", calls)
+	}
+	b.checker.update(checkResult{serviceID: id, index: 0, err: errFailed})
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "deregister "+id {
+		t.Fatalf("unhealthy service is not withdrawn: %v", calls)
+	}
+}
+
+func TestProbeHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Method != http.MethodHead || r.Host != "web.local" || r.Header.Get("X-Probe") != "1":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	check := &Check{HTTP: server.URL + "/health", Method: http.MethodHead, Header: map[string][]string{"Host": {"web.local"}, "X-Probe": {"1"}}}
+	if err := probe(check, time.Second); err != nil {
+		t.Errorf("probe() = %v", err)
+	}
+	check.HTTP = server.URL + "/down"
+	if err := probe(check, time.Second); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("probe() of 503 = %v", err)
+	}
+	if err := probe(&Check{HTTP: server.URL}, time.Second); err == nil {
+		t.Error("probe() of bad request succeeded")
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	if err := probe(&Check{TCP: address}, time.Second); err != nil {
+		t.Errorf("probe() = %v", err)
+	}
+	l.Close()
+	if err := probe(&Check{TCP: address}, time.Second); err == nil {
+		t.Error("probe() of closed port succeeded")
+	}
+}
+
+func TestProbeGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the health service of gRPC over plaintext HTTP/2, web is serving, db is
+	// not serving and the others are unknown
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make([]byte, 512)
+		n, _ := r.Body.Read(body)
+		service := ""
+		if n > 7 {
+			service = string(body[7:n])
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		var status byte
+		switch service {
+		case "web":
+			status = 1
+		case "db":
+			status = 2
+		default:
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+		frame := make([]byte, 5, 7)
+		binary.BigEndian.PutUint32(frame[1:], 2)
+		w.Write(append(frame, 0x08, status))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go new(http2.Server).ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+
+	address := l.Addr().String()
+	if err := probe(&Check{GRPC: address + "/web"}, time.Second); err != nil {
+		t.Errorf("probe() of serving service = %v", err)
+	}
+	if err := probe(&Check{GRPC: address + "/db"}, time.Second); err == nil || !strings.Contains(err.Error(), "serving status 2") {
+		t.Errorf("probe() of not serving service = %v", err)
+	}
+	if err := probe(&Check{GRPC: address + "/cache"}, time.Second); err == nil || !strings.Contains(err.Error(), "grpc status 5") {
+		t.Errorf("probe() of unknown service = %v", err)
+	}
+}
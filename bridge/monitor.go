@@ -0,0 +1,148 @@
+package bridge
+
+import (
+	"sync"
+	"time"
+)
+
+// Connectivity state of backend connectivity
+type Connectivity int
+
+const (
+	// Connected backend is reachable
+	Connected Connectivity = iota
+	// Degraded backend has been unreachable for less than DisconnectThreshold pings
+	Degraded
+	// Disconnected backend has been unreachable for DisconnectThreshold pings
+	Disconnected
+)
+
+// DisconnectThreshold consecutive failed pings before backend is disconnected
+const DisconnectThreshold = 3
+
+func (c Connectivity) String() string {
+	switch c {
+	case Connected:
+		return "connected"
+	case Degraded:
+		return "degraded"
+	case Disconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the state as its name
+func (c Connectivity) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// BackendStatus backend connectivity of the running bridge
+type BackendStatus struct {
+	State Connectivity `json:"state"`
+	// Since time of the last transition
+	Since time.Time `json:"since"`
+	// Error the last ping error, empty If connected
+	Error string `json:"error,omitempty"`
+	// Endpoint the endpoint in use If the adapter fails over among endpoints
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+var backendStatus = struct {
+	sync.Mutex
+	BackendStatus
+}{
+	BackendStatus: BackendStatus{State: Connected, Since: time.Now()},
+}
+
+// Backend returns the backend connectivity of the running bridge, it's
+// connected until monitored otherwise
+func Backend() BackendStatus {
+	backendStatus.Lock()
+	defer backendStatus.Unlock()
+	return backendStatus.BackendStatus
+}
+
+// Monitor pings backend every interval until stop closed, and resyncs all
+// services as soon as backend comes back, as they may have been lost e.g.
+// the agent restarted
+func (b *Bridge) Monitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// the endpoint may also be switched by adapter between pings, e.g. on the
+	// failures of registration
+	m := &backendMonitor{endpoint: b.endpoint()}
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		b.monitor(m)
+	}
+}
+
+// backendMonitor state of monitoring across pings
+type backendMonitor struct {
+	endpoint string
+	failures int
+}
+
+// monitor pings backend once, updates the connectivity and resyncs all
+// services If backend recovered or the endpoint switched
+func (b *Bridge) monitor(m *backendMonitor) {
+	err := b.Ping()
+	switched := err == nil && b.endpoint() != m.endpoint
+	if err == nil {
+		m.endpoint = b.endpoint()
+	}
+	state := Connected
+	if err != nil {
+		m.failures++
+		state = Degraded
+		if m.failures >= DisconnectThreshold {
+			state = Disconnected
+		}
+		log.Warnf("ping backend failed (%d): %v", m.failures, err)
+	} else {
+		m.failures = 0
+	}
+
+	backendStatus.Lock()
+	last := backendStatus.State
+	if state != last {
+		backendStatus.State = state
+		backendStatus.Since = time.Now()
+	}
+	backendStatus.Endpoint = b.endpoint()
+	backendStatus.Error = ""
+	if err != nil {
+		backendStatus.Error = err.Error()
+	}
+	backendStatus.Unlock()
+
+	switch {
+	case state == last:
+	case state == Connected:
+		log.Infof("backend %s -> %s", last, state)
+	default:
+		log.Warnf("backend %s -> %s: %v", last, state, err)
+	}
+	if state == Connected && state != last {
+		log.Infof("backend recovered, resyncing all services")
+		b.Sync(true)
+	} else if switched {
+		log.Infof("endpoint switched to %s, resyncing all services", b.endpoint())
+		b.Sync(true)
+	}
+}
+
+// endpoint returns the endpoint of backend in use, empty If the adapter
+// doesn't fail over
+func (b *Bridge) endpoint() string {
+	if adapter, ok := b.registry.(FailoverAdapter); ok {
+		return adapter.Endpoint()
+	}
+	return ""
+}
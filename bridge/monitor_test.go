@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	backendStatus.Lock()
+	backendStatus.BackendStatus = BackendStatus{State: Connected, Since: time.Now()}
+	backendStatus.Unlock()
+
+	adapter := newFakeAdapter()
+	adapter.endpoint = "10.0.0.1:8500"
+	source := &mapSource{services: map[string]*Service{"web": {Name: "web", Port: 80}}}
+	b := newTestBridge(t, adapter, source, Config{ConfDir: tempDir(t)})
+	b.Sync(false)
+	id := b.services["web"].ID
+	adapter.reset()
+
+	m := &backendMonitor{endpoint: b.endpoint()}
+	ping := func(err error) BackendStatus {
+		adapter.Lock()
+		adapter.pingErr = err
+		adapter.Unlock()
+		b.monitor(m)
+		return Backend()
+	}
+
+	if status := ping(nil); status.State != Connected || status.Endpoint != "10.0.0.1:8500" {
+		t.Errorf("status = %+v", status)
+	}
+
+	// the agent restarted and lost the services meanwhile
+	down := errors.New("connection refused")
+	adapter.Lock()
+	delete(adapter.services, id)
+	adapter.Unlock()
+	for i, state := range []Connectivity{Degraded, Degraded, Disconnected, Disconnected} {
+		if status := ping(down); status.State != state || status.Error != down.Error() {
+			t.Errorf("%d: status = %+v, want %s", i+1, status, state)
+		}
+	}
+	since := Backend().Since
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Errorf("calls while disconnected = %v", calls)
+	}
+
+	// all services are resynced once recovered
+	status := ping(nil)
+	if status.State != Connected || status.Error != "" || !status.Since.After(since) {
+		t.Errorf("status after recovery = %+v", status)
+	}
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Errorf("calls on recovery = %v", calls)
+	}
+	ping(nil)
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Errorf("calls while connected = %v", calls)
+	}
+
+	// a degraded backend recovers before the threshold without being disconnected
+	if status := ping(down); status.State != Degraded {
+		t.Errorf("status = %+v", status)
+	}
+	if status := ping(nil); status.State != Connected {
+		t.Errorf("status = %+v", status)
+	}
+	adapter.reset()
+
+	// and the services are resynced once the endpoint is switched by adapter
+	adapter.Lock()
+	adapter.endpoint = "10.0.0.2:8500"
+	delete(adapter.services, id)
+	adapter.Unlock()
+	if status := ping(nil); status.State != Connected || status.Endpoint != "10.0.0.2:8500" {
+		t.Errorf("status after switch = %+v", status)
+	}
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Errorf("calls on switch = %v", calls)
+	}
+}
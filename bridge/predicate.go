@@ -0,0 +1,291 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultPredicateInterval default interval of re-evaluating predicates
+const DefaultPredicateInterval = 10 * time.Second
+
+// timeouts of the command and listening predicates
+const (
+	commandTimeout = 5 * time.Second
+	dialTimeout    = time.Second
+)
+
+// predicateInterval interval of re-evaluating predicates in nanoseconds, it
+// can be changed while running
+var predicateInterval = int64(DefaultPredicateInterval)
+
+// Predicate conditions of registration, all the specified ones must hold
+type Predicate struct {
+	// FileExists path of file which must exist
+	FileExists string `json:"file_exists,omitempty"`
+	// PIDFile path of pidfile which must point to a running process
+	PIDFile string `json:"pidfile,omitempty"`
+	// Listening local TCP port or address which must be listening, e.g. 9100, 127.0.0.1:9100
+	Listening string `json:"listening,omitempty"`
+	// Command command which must exit 0
+	Command []string `json:"command,omitempty"`
+	// Env environment variables of registrator which must equal the values
+	Env map[string]string `json:"env,omitempty"`
+	// Node attributes of local node which must equal the values, the key is
+	// one of id, name, address or the key of node meta
+	Node map[string]string `json:"node,omitempty"`
+}
+
+// Validate validates predicate
+func (p *Predicate) Validate() error {
+	if p.Command != nil && len(p.Command) == 0 {
+		return errors.New("command is empty")
+	}
+	if p.Listening != "" {
+		if _, err := listeningAddress(p.Listening); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Eval returns whether all the conditions hold, and the first one that doesn't
+func (p *Predicate) Eval() (bool, string) {
+	if p.FileExists != "" {
+		if _, err := os.Stat(p.FileExists); err != nil {
+			return false, "file_exists"
+		}
+	}
+
+	if p.PIDFile != "" && !pidAlive(p.PIDFile) {
+		return false, "pidfile"
+	}
+
+	if p.Listening != "" {
+		address, _ := listeningAddress(p.Listening)
+		conn, err := net.DialTimeout("tcp", address, dialTimeout)
+		if err != nil {
+			return false, "listening"
+		}
+		conn.Close()
+	}
+
+	for k, v := range p.Env {
+		if os.Getenv(k) != v {
+			return false, "env"
+		}
+	}
+
+	for k, v := range p.Node {
+		if nodeAttr(k) != v {
+			return false, "node"
+		}
+	}
+
+	// run command at last as it's the most expensive one
+	if len(p.Command) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer cancel()
+		if err := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...).Run(); err != nil {
+			return false, "command"
+		}
+	}
+
+	return true, ""
+}
+
+// PredicateTracker evaluates the enabled_if predicates of services in the
+// background and caches the results, so that the slow predicates, e.g. command
+// and listening, don't block the bridge. The service is registered only while
+// its predicate holds
+type PredicateTracker struct {
+	sync.Mutex
+	// results of predicates keyed by service id
+	results map[string]*predicateResult
+	// pending signaled each time a new predicate needs evaluating
+	pending chan struct{}
+}
+
+type predicateResult struct {
+	predicate *Predicate
+	known     bool
+	holds     bool
+}
+
+// NewPredicateTracker returns a new predicate tracker
+func NewPredicateTracker() *PredicateTracker {
+	return &PredicateTracker{
+		results: make(map[string]*predicateResult),
+		pending: make(chan struct{}, 1),
+	}
+}
+
+// Holds returns the cached result of the predicate of service, the service
+// which has been registered is kept until the first result is known
+func (t *PredicateTracker) Holds(service *Service, registered bool) bool {
+	if service.EnabledIf == nil {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	r, ok := t.results[service.ID]
+	if !ok {
+		r = &predicateResult{predicate: service.EnabledIf}
+		t.results[service.ID] = r
+		select {
+		case t.pending <- struct{}{}:
+		default:
+		}
+	}
+	if !r.known {
+		return registered
+	}
+	return r.holds
+}
+
+// Pending returns whether the predicate of service has not been evaluated yet
+func (t *PredicateTracker) Pending(service *Service) bool {
+	if service.EnabledIf == nil {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	r, ok := t.results[service.ID]
+	return ok && !r.known
+}
+
+// Run evaluates the new predicates at once and all of them each interval
+// until stop closed, services returns the services to be tracked, changes is
+// signaled each time a predicate flipped
+func (t *PredicateTracker) Run(services func() []*Service, changes chan<- struct{}, stop <-chan struct{}) {
+	next := time.After(time.Duration(atomic.LoadInt64(&predicateInterval)))
+	for {
+		all := false
+		select {
+		case <-next:
+			all = true
+			next = time.After(time.Duration(atomic.LoadInt64(&predicateInterval)))
+		case <-t.pending:
+		case <-stop:
+			return
+		}
+
+		t.track(services())
+		if !t.evaluate(all) {
+			continue
+		}
+		select {
+		case changes <- struct{}{}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// track stops tracking the removed services, the new ones are tracked once
+// they are checked by Holds
+func (t *PredicateTracker) track(services []*Service) {
+	t.Lock()
+	defer t.Unlock()
+
+	ids := make(map[string]bool, len(services))
+	for _, service := range services {
+		ids[service.ID] = true
+	}
+	for id := range t.results {
+		if !ids[id] {
+			delete(t.results, id)
+		}
+	}
+}
+
+// evaluate evaluates the predicates without holding the lock, only the ones
+// which are not known yet unless all, returns whether any result has changed
+func (t *PredicateTracker) evaluate(all bool) bool {
+	t.Lock()
+	predicates := make(map[string]*Predicate)
+	for id, r := range t.results {
+		if all || !r.known {
+			predicates[id] = r.predicate
+		}
+	}
+	t.Unlock()
+
+	holds := make(map[string]bool, len(predicates))
+	for id, predicate := range predicates {
+		ok, failed := predicate.Eval()
+		if !ok {
+			log.Debugf("enabled_if %s doesn't hold: %s", failed, id)
+		}
+		holds[id] = ok
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	changed := false
+	for id, ok := range holds {
+		r, exists := t.results[id]
+		if !exists {
+			continue
+		}
+		// the first result is a change, as the registered services have been
+		// kept while it's unknown
+		changed = changed || ok != r.holds || !r.known
+		r.known, r.holds = true, ok
+	}
+	return changed
+}
+
+// listeningAddress returns the local address to dial, the host defaults to loopback
+func listeningAddress(listening string) (string, error) {
+	if _, err := strconv.Atoi(listening); err == nil {
+		listening = ":" + listening
+	}
+	host, port, err := net.SplitHostPort(listening)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func pidAlive(pidfile string) bool {
+	bs, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func nodeAttr(key string) string {
+	switch key {
+	case "id":
+		return LocalNode.ID
+	case "name":
+		return LocalNode.Name
+	case "address":
+		return LocalNode.Address
+	}
+	return LocalNode.Meta[key]
+}
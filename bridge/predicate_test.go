@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPredicateTracker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "predicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "enabled")
+
+	interval := atomic.SwapInt64(&predicateInterval, int64(50*time.Millisecond))
+	defer atomic.StoreInt64(&predicateInterval, interval)
+
+	tracker := NewPredicateTracker()
+	service := &Service{ID: "mysql", EnabledIf: &Predicate{FileExists: path}}
+	services := func() []*Service { return []*Service{service} }
+
+	if !tracker.Holds(&Service{ID: "static"}, false) {
+		t.Error("Holds() without enabled_if = false")
+	}
+	// unknown until evaluated, the registered service is kept
+	if tracker.Holds(service, false) {
+		t.Error("Holds() of unknown predicate = true")
+	}
+	if !tracker.Holds(service, true) {
+		t.Error("Holds() of unknown predicate of registered service = false")
+	}
+
+	changes := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go tracker.Run(services, changes, stop)
+
+	wait := func() {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatal("change is not sent")
+		}
+	}
+
+	wait()
+	if tracker.Holds(service, true) {
+		t.Error("Holds() of evaluated predicate = true, want false")
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wait()
+	if !tracker.Holds(service, false) {
+		t.Error("Holds() after file created = false")
+	}
+}
+
+func TestPredicateTrackerTrack(t *testing.T) {
+	tracker := NewPredicateTracker()
+	tracker.Holds(&Service{ID: "a", EnabledIf: &Predicate{}}, false)
+	tracker.Holds(&Service{ID: "b", EnabledIf: &Predicate{}}, false)
+
+	tracker.track([]*Service{{ID: "a"}})
+	if !tracker.evaluate(false) {
+		t.Error("evaluate() of new predicate = false, want changed")
+	}
+	if _, ok := tracker.results["b"]; ok {
+		t.Error("predicate of removed service is tracked")
+	}
+	if tracker.evaluate(true) {
+		t.Error("evaluate() of unchanged predicate = true")
+	}
+}
@@ -0,0 +1,270 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Policies of services which never become ready before the timeout
+const (
+	// ReadyPolicyRegister registers the service anyway
+	ReadyPolicyRegister = "register"
+	// ReadyPolicySkip doesn't register the service
+	ReadyPolicySkip = "skip"
+	// ReadyPolicyCritical registers the service with the initial status of
+	// its checks critical
+	ReadyPolicyCritical = "critical"
+)
+
+// defaults of readiness probe
+const (
+	DefaultReadyInterval = time.Second
+	DefaultReadyTimeout  = 30 * time.Second
+)
+
+// Readiness probe polled before the first registration of service, one of
+// http (2xx), tcp (connect) and args (exit 0) is required
+type Readiness struct {
+	HTTP string   `json:"http,omitempty"`
+	TCP  string   `json:"tcp,omitempty"`
+	Args []string `json:"args,omitempty"`
+	// Interval interval of polling, it's also the timeout of each attempt
+	Interval string `json:"interval,omitempty"`
+	// Timeout the policy is applied If the probe never succeeds in it
+	Timeout string `json:"timeout,omitempty"`
+	// Policy one of register, skip and critical, default is the global one
+	Policy string `json:"policy,omitempty"`
+}
+
+// Validate validates readiness probe
+func (r *Readiness) Validate() error {
+	if r.HTTP == "" && r.TCP == "" && len(r.Args) == 0 {
+		return errors.New("one of http, tcp and args is required")
+	}
+	for _, d := range []string{r.Interval, r.Timeout} {
+		if _, err := time.ParseDuration(d); d != "" && err != nil {
+			return fmt.Errorf("invalid duration %s", d)
+		}
+	}
+	return ValidateReadyPolicy(r.Policy)
+}
+
+// ValidateReadyPolicy validates the policy of services which never become ready
+func ValidateReadyPolicy(policy string) error {
+	switch policy {
+	case "", ReadyPolicyRegister, ReadyPolicySkip, ReadyPolicyCritical:
+		return nil
+	}
+	return fmt.Errorf("invalid policy %s", policy)
+}
+
+// ReadinessTracker polls the readiness probes of services, the service is
+// registered only after it becomes ready or the policy allows. Once ready,
+// it's not probed again until the definition changed
+type ReadinessTracker struct {
+	sync.Mutex
+	policy string
+	// probes of services keyed by service id
+	probes map[string]*readinessProbe
+}
+
+type readinessProbe struct {
+	check    *Check
+	interval time.Duration
+	deadline time.Time
+	next     time.Time
+	policy   string
+	running  bool
+	ready    bool
+	expired  bool
+}
+
+// NewReadinessTracker returns a new readiness tracker, policy is the default
+// policy of services which never become ready
+func NewReadinessTracker(policy string) *ReadinessTracker {
+	if policy == "" {
+		policy = ReadyPolicyRegister
+	}
+	return &ReadinessTracker{policy: policy, probes: make(map[string]*readinessProbe)}
+}
+
+// Ready returns whether the service is ready to be registered, the service
+// which has been registered is ready
+func (t *ReadinessTracker) Ready(service *Service, registered bool) bool {
+	if service.ReadyWhen == nil {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.probes[service.ID]
+	if !ok {
+		p = t.newProbe(service)
+		p.ready = registered
+		t.probes[service.ID] = p
+	}
+
+	switch {
+	case p.ready:
+		return true
+	case !p.expired:
+		return false
+	case p.policy == ReadyPolicySkip:
+		return false
+	}
+	return true
+}
+
+// Pending returns whether the service is still being probed, i.e. it has
+// neither become ready nor expired
+func (t *ReadinessTracker) Pending(service *Service) bool {
+	if service.ReadyWhen == nil {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.probes[service.ID]
+	return ok && !p.ready && !p.expired
+}
+
+// Critical returns whether the initial status of the checks of service should
+// be critical, i.e. it has never become ready and the policy is critical
+func (t *ReadinessTracker) Critical(service *Service) bool {
+	if service.ReadyWhen == nil {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.probes[service.ID]
+	return ok && !p.ready && p.expired && p.policy == ReadyPolicyCritical
+}
+
+// Run polls the probes until stop closed, services returns the services to be
+// tracked, changes is signaled each time a service becomes ready or expired
+func (t *ReadinessTracker) Run(services func() []*Service, changes chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(checkTick)
+	defer ticker.Stop()
+
+	results := make(chan checkResult)
+	for {
+		var changed bool
+		select {
+		case now := <-ticker.C:
+			t.track(services())
+			var due []checkResult
+			due, changed = t.due(now)
+			for _, r := range due {
+				go func(r checkResult) {
+					r.err = probe(r.check, r.timeout)
+					select {
+					case results <- r:
+					case <-stop:
+					}
+				}(r)
+			}
+
+		case r := <-results:
+			changed = t.update(r)
+
+		case <-stop:
+			return
+		}
+
+		if !changed {
+			continue
+		}
+		select {
+		case changes <- struct{}{}:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (t *ReadinessTracker) newProbe(service *Service) *readinessProbe {
+	r := service.ReadyWhen
+	p := &readinessProbe{
+		check:    &Check{HTTP: r.HTTP, TCP: r.TCP, Args: r.Args},
+		interval: parseCheckDuration(r.Interval, DefaultReadyInterval),
+		deadline: time.Now().Add(parseCheckDuration(r.Timeout, DefaultReadyTimeout)),
+		policy:   r.Policy,
+	}
+	if p.policy == "" {
+		p.policy = t.policy
+	}
+	return p
+}
+
+// track stops tracking the removed services, the new ones are tracked once
+// they are checked by Ready
+func (t *ReadinessTracker) track(services []*Service) {
+	t.Lock()
+	defer t.Unlock()
+
+	ids := make(map[string]bool, len(services))
+	for _, service := range services {
+		ids[service.ID] = true
+	}
+	for id := range t.probes {
+		if !ids[id] {
+			delete(t.probes, id)
+		}
+	}
+}
+
+// due returns the probes to run and marks them running, and whether any
+// service has expired
+func (t *ReadinessTracker) due(now time.Time) ([]checkResult, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	var due []checkResult
+	expired := false
+	for id, p := range t.probes {
+		if p.ready || p.expired {
+			continue
+		}
+		if now.After(p.deadline) {
+			log.Warnf("not ready in time, %s: %s", p.policy, id)
+			p.expired = true
+			expired = true
+			continue
+		}
+		if p.running || now.Before(p.next) {
+			continue
+		}
+		p.running = true
+		p.next = now.Add(p.interval)
+		due = append(due, checkResult{serviceID: id, check: p.check, timeout: p.interval})
+	}
+	return due, expired
+}
+
+// update applies the probe result, returns whether the service becomes ready
+func (t *ReadinessTracker) update(r checkResult) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	p, ok := t.probes[r.serviceID]
+	if !ok {
+		return false
+	}
+	p.running = false
+	if r.err != nil {
+		log.Debugf("not ready: %s %v", r.serviceID, r.err)
+		return false
+	}
+	if p.ready || p.expired {
+		return false
+	}
+	p.ready = true
+	log.Infof("ready: %s", r.serviceID)
+	return true
+}
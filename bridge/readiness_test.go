@@ -0,0 +1,105 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadinessPolicies(t *testing.T) {
+	tracker := NewReadinessTracker(ReadyPolicyCritical)
+	service := func(id, policy string) *Service {
+		return &Service{
+			ID:        id,
+			ReadyWhen: &Readiness{TCP: "127.0.0.1:1", Timeout: "1ms", Policy: policy},
+			Checks:    []*Check{{TCP: "127.0.0.1:1"}},
+		}
+	}
+	critical, skip, register := service("critical", ""), service("skip", ReadyPolicySkip), service("register", ReadyPolicyRegister)
+
+	for _, s := range []*Service{critical, skip, register} {
+		if tracker.Ready(s, false) {
+			t.Errorf("Ready(%s) before expired = true", s.ID)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, expired := tracker.due(time.Now()); !expired {
+		t.Fatal("probes are not expired")
+	}
+
+	if !tracker.Ready(critical, false) || !tracker.Critical(critical) {
+		t.Error("critical policy doesn't register the service critical")
+	}
+	if tracker.Ready(skip, false) || tracker.Critical(skip) {
+		t.Error("skip policy registers the service")
+	}
+	if !tracker.Ready(register, false) || tracker.Critical(register) {
+		t.Error("register policy doesn't register the service as is")
+	}
+}
+
+func TestRegistrationCritical(t *testing.T) {
+	b := &Bridge{readiness: NewReadinessTracker(ReadyPolicyCritical)}
+	service := &Service{
+		ID:        "web",
+		ReadyWhen: &Readiness{HTTP: "http://127.0.0.1:1/ready", Timeout: "1ms"},
+		Checks:    []*Check{{HTTP: "http://127.0.0.1:1/health", Status: "passing"}},
+	}
+
+	if registration := b.registration(service); registration != service {
+		t.Error("registration() of untracked service is a copy")
+	}
+
+	b.readiness.Ready(service, false)
+	time.Sleep(10 * time.Millisecond)
+	b.readiness.due(time.Now())
+
+	registration := b.registration(service)
+	if registration.Checks[0].Status != "critical" {
+		t.Errorf("status of registered check = %s, want critical", registration.Checks[0].Status)
+	}
+	// the desired service of source is shared, it must not be changed
+	if service.Checks[0].Status != "passing" {
+		t.Errorf("status of desired check = %s, want passing", service.Checks[0].Status)
+	}
+}
+
+func TestEditKeepsReadyService(t *testing.T) {
+	adapter := newFakeAdapter()
+	readyWhen := &Readiness{TCP: "127.0.0.1:80", Policy: ReadyPolicySkip}
+	source := &mapSource{services: map[string]*Service{"web": {Name: "web", Port: 80, ReadyWhen: readyWhen}}}
+	b := newTestBridge(t, adapter, source, Config{ConfDir: tempDir(t)})
+
+	b.Sync(false)
+	id := b.candidates["web"].service.ID
+	b.readiness.update(checkResult{serviceID: id})
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "register "+id {
+		t.Fatalf("ready service is not registered: %v", calls)
+	}
+
+	// the previous registration is kept until the edited definition is ready
+	source.set("web", &Service{Name: "web", Port: 80, Tags: []string{"v2"}, ReadyWhen: readyWhen})
+	b.Sync(false)
+	b.reevaluate()
+	edited := b.candidates["web"].service.ID
+	if calls := adapter.reset(); len(calls) != 0 || edited == id {
+		t.Fatalf("calls on edit before ready = %v", calls)
+	}
+	b.readiness.update(checkResult{serviceID: edited})
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 2 || calls[0] != "deregister "+id || calls[1] != "register "+edited {
+		t.Fatalf("edited service is not replaced once ready: %v", calls)
+	}
+
+	// and withdrawn If the edited one never becomes ready
+	source.set("web", &Service{Name: "web", Port: 80, Tags: []string{"v3"}, ReadyWhen: readyWhen})
+	b.Sync(false)
+	if calls := adapter.reset(); len(calls) != 0 {
+		t.Fatalf("calls on edit before ready = %v", calls)
+	}
+	b.readiness.due(time.Now().Add(time.Hour))
+	b.reevaluate()
+	if calls := adapter.reset(); len(calls) != 1 || calls[0] != "deregister "+edited {
+		t.Fatalf("previous registration is not withdrawn once expired: %v", calls)
+	}
+}
@@ -1,9 +1,13 @@
 package bridge
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/url"
 	"reflect"
 	"sync"
+	"time"
 )
 
 // AdapterFactory adapter registry factory
@@ -20,24 +24,207 @@ type RegistryAdapter interface {
 	Services() ([]*Service, error)
 }
 
+// WatchableAdapter adapter which is able to watch the services of backend, the
+// bridge reconciles the affected services immediately when they have been
+// changed or removed out-of-band rather than waiting for the next resync
+type WatchableAdapter interface {
+	// Watch sends the services of backend each time they changed until stop closed
+	Watch(services chan<- []*Service, stop <-chan struct{})
+}
+
+// CheckingAdapter adapter of which backend runs the health checks of services
+// itself, the services registered to other backends are checked by registrator
+type CheckingAdapter interface {
+	// RunsChecks returns whether backend runs the health checks
+	RunsChecks() bool
+}
+
+// LeasingAdapter adapter of which backend expires the services which are not
+// renewed by Refresh, e.g. eureka, the refresh interval is required
+type LeasingAdapter interface {
+	// RequiresRefresh returns whether backend expires the services
+	RequiresRefresh() bool
+}
+
+// MaintenanceAdapter adapter which is able to put service into maintenance, the
+// draining service is kept registered but taken out of rotation. Services
+// registered to other backends are tagged with DrainingTag instead
+type MaintenanceAdapter interface {
+	EnableMaintenance(service *Service, reason string) error
+	DisableMaintenance(service *Service) error
+}
+
+// FailoverAdapter adapter with multiple endpoints which fails over among them,
+// all services are resynced when the endpoint in use changed as the new one
+// may not have them, e.g. agents of consul
+type FailoverAdapter interface {
+	// Endpoint returns the endpoint in use
+	Endpoint() string
+}
+
+// NormalizingAdapter adapter of which backend can't keep some fields of service
+// as defined, e.g. the checks it doesn't support, the desired service is
+// normalized before compared with the copy of backend, so it doesn't drift forever
+type NormalizingAdapter interface {
+	// Normalize returns the service as it's kept by backend, service must not be modified
+	Normalize(service *Service) *Service
+}
+
+// ClosableAdapter adapter which holds resources to release on exit, e.g. the
+// announcements of mDNS are withdrawn by goodbye packets
+type ClosableAdapter interface {
+	Close() error
+}
+
+// SourceFactory service definition source factory
+type SourceFactory interface {
+	New(uri *url.URL) Source
+}
+
+// Source provides the desired services, e.g. definition files, containers
+type Source interface {
+	// Services returns the snapshot of desired services keyed by an unique key,
+	// the key is the path of definition file or in the form scheme://id
+	Services() (map[string]*Service, error)
+	// Watch sends the change events until stop closed
+	Watch(events chan<- *SourceEvent, stop <-chan struct{})
+}
+
+// Gate decides whether a service should be registered currently, e.g. the
+// unit of service is active, service is registered only when all gates allow
+type Gate interface {
+	Allow(service *Service) bool
+	// Watch sends a signal each time the decisions may have changed until stop closed
+	Watch(changes chan<- struct{}, stop <-chan struct{})
+}
+
+// EventType type of source event
+type EventType int
+
+// Source event types
+const (
+	// EventAdd service has been added
+	EventAdd EventType = iota
+	// EventUpdate service has been changed
+	EventUpdate
+	// EventRemove service has been removed
+	EventRemove
+	// EventResync events may be lost, the whole source needs to be resynced
+	EventResync
+)
+
+// SourceEvent change event of source, the service is nil unless added or updated
+type SourceEvent struct {
+	Type    EventType
+	Key     string
+	Service *Service
+}
+
 // Config represent registry adapter config
 type Config struct {
 	HostIP          string
 	RefreshTTL      int
 	RefreshInterval int
 	ConfDir         string
+	Sources         []string
 	Cleanup         bool
+	// NodeMeta additional attributes of local node
+	NodeMeta map[string]string
+	// PredicateInterval interval in seconds of re-evaluating enabled_if predicates
+	PredicateInterval int
+	// LocalChecks runs health checks locally even if backend runs them
+	LocalChecks bool
+	// Drain period in seconds between taking removed service out of rotation
+	// and deregistering it
+	Drain int
+	// ReadyPolicy default policy of services which never become ready
+	ReadyPolicy string
+	// Tags tags added to all services
+	Tags []string
 }
 
 // Service registry service definition structure
 type Service struct {
-	ID    string
-	Name  string            `json:"name"`
-	Port  int               `json:"port"`
-	IP    string            `json:"address"`
-	Tags  []string          `json:"tags"`
-	Attrs map[string]string `json:"attrs"`
-	TTL   int
+	ID     string
+	Name   string            `json:"name"`
+	Port   int               `json:"port"`
+	IP     string            `json:"address"`
+	Tags   []string          `json:"tags"`
+	Attrs  map[string]string `json:"attrs"`
+	Checks []*Check          `json:"checks"`
+	TTL    int
+	// RefreshInterval interval in seconds of Refresh, it's a runtime setting as TTL
+	RefreshInterval int `json:"-"`
+
+	// ActiveWhen name of systemd unit, service is registered only while the unit is active
+	ActiveWhen string `json:"active_when,omitempty"`
+	// EnabledIf service is registered only while the predicate holds
+	EnabledIf *Predicate `json:"enabled_if,omitempty"`
+	// Drain drain period on removal, e.g. 30s, overrides the global one
+	Drain string `json:"drain,omitempty"`
+	// ReadyWhen service is registered at the first time only after the probe succeeded
+	ReadyWhen *Readiness `json:"ready_when,omitempty"`
+}
+
+// Validate validates service definition
+func (s *Service) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return fmt.Errorf("invalid port %d", s.Port)
+	}
+	if s.IP != "" && net.ParseIP(s.IP) == nil {
+		return fmt.Errorf("invalid address %s", s.IP)
+	}
+	if s.Drain != "" {
+		if d, err := time.ParseDuration(s.Drain); err != nil || d < 0 {
+			return fmt.Errorf("invalid drain %s", s.Drain)
+		}
+	}
+	if s.ReadyWhen != nil {
+		if err := s.ReadyWhen.Validate(); err != nil {
+			return fmt.Errorf("invalid ready_when: %v", err)
+		}
+	}
+	if s.EnabledIf != nil {
+		if err := s.EnabledIf.Validate(); err != nil {
+			return fmt.Errorf("invalid enabled_if: %v", err)
+		}
+	}
+	return nil
+}
+
+// Check health check definition of service, it's up to the backend to run
+// the check or not
+type Check struct {
+	ID                             string              `json:"id"`
+	Name                           string              `json:"name"`
+	HTTP                           string              `json:"http"`
+	Method                         string              `json:"method"`
+	Header                         map[string][]string `json:"header"`
+	TLSSkipVerify                  bool                `json:"tls_skip_verify"`
+	TCP                            string              `json:"tcp"`
+	GRPC                           string              `json:"grpc"`
+	Args                           []string            `json:"args"`
+	TTL                            string              `json:"ttl"`
+	Interval                       string              `json:"interval"`
+	Timeout                        string              `json:"timeout"`
+	Status                         string              `json:"status"`
+	DeregisterCriticalServiceAfter string              `json:"deregister_critical_service_after"`
+
+	// Rise consecutive successes before the check becomes passing
+	Rise int `json:"rise,omitempty"`
+	// Fall consecutive failures before the check becomes critical
+	Fall int `json:"fall,omitempty"`
+}
+
+// Node represent identity of the host which registrator running on
+type Node struct {
+	ID      string
+	Name    string
+	Address string
+	Meta    map[string]string
 }
 
 var registry = struct {
@@ -173,3 +360,71 @@ func (ep *adapterFactoryExt) All() map[string]AdapterFactory {
 	}
 	return all
 }
+
+// SourceFactory
+
+var SourceFactories = &sourceFactoryExt{
+	newExtensionPoint(new(SourceFactory)),
+}
+
+type sourceFactoryExt struct {
+	*extensionPoint
+}
+
+func (ep *sourceFactoryExt) Unregister(name string) bool {
+	return ep.unregister(name)
+}
+
+func (ep *sourceFactoryExt) Register(component SourceFactory, name string) bool {
+	return ep.register(component, name)
+}
+
+func (ep *sourceFactoryExt) Lookup(name string) (SourceFactory, bool) {
+	ext, ok := ep.lookup(name)
+	if !ok {
+		return nil, ok
+	}
+	return ext.(SourceFactory), ok
+}
+
+func (ep *sourceFactoryExt) All() map[string]SourceFactory {
+	all := make(map[string]SourceFactory)
+	for k, v := range ep.all() {
+		all[k] = v.(SourceFactory)
+	}
+	return all
+}
+
+// Gate
+
+var Gates = &gateExt{
+	newExtensionPoint(new(Gate)),
+}
+
+type gateExt struct {
+	*extensionPoint
+}
+
+func (ep *gateExt) Unregister(name string) bool {
+	return ep.unregister(name)
+}
+
+func (ep *gateExt) Register(component Gate, name string) bool {
+	return ep.register(component, name)
+}
+
+func (ep *gateExt) Lookup(name string) (Gate, bool) {
+	ext, ok := ep.lookup(name)
+	if !ok {
+		return nil, ok
+	}
+	return ext.(Gate), ok
+}
+
+func (ep *gateExt) All() map[string]Gate {
+	all := make(map[string]Gate)
+	for k, v := range ep.all() {
+		all[k] = v.(Gate)
+	}
+	return all
+}
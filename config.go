@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefix of the environment variables overriding settings, the name
+// is the flag name in upper case with dashes replaced, e.g. REGISTRATOR_LOG_LEVEL
+const envPrefix = "REGISTRATOR_"
+
+// errUsage the command line is invalid, the usage has been printed
+var errUsage = errors.New("invalid usage")
+
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// loadSettings returns the settings in the order of precedence: command line,
+// environment variables, config file and defaults
+func loadSettings(args []string) (*settings, error) {
+	s := new(settings)
+	fs := newFlagSet(s)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, errUsage
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if v, ok := os.LookupEnv(envName("config")); ok && !explicit["config"] {
+		s.Config = v
+	}
+	var file *fileConfig
+	if s.Config != "" {
+		var err error
+		if file, err = readConfigFile(s.Config, fs); err != nil {
+			return nil, fmt.Errorf("config file %s: %v", s.Config, err)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+
+		_, repeatable := f.Value.(*stringSlice)
+		var values []string
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			values = []string{v}
+			if repeatable {
+				values = strings.Split(v, ",")
+			}
+		} else if file != nil {
+			values = file.flags[f.Name]
+		}
+		if len(values) > 1 && !repeatable {
+			values = []string{strings.Join(values, ",")}
+		}
+
+		for _, v := range values {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, f.Name, serr)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "Extra unparsed arguments:")
+		fmt.Fprintln(os.Stderr, " ", strings.Join(fs.Args()[1:], " "))
+		fmt.Fprintf(os.Stderr, "Options should come before the registry URI argument.\n\n")
+		fs.Usage()
+		return nil, errUsage
+	}
+	if s.Registry = fs.Arg(0); s.Registry == "" {
+		if v, ok := os.LookupEnv(envName("registry")); ok {
+			s.Registry = v
+		} else if file != nil {
+			s.Registry = file.registry
+		}
+	}
+	if s.Registry == "" && !s.Version {
+		fmt.Fprintf(os.Stderr, "Missing required argument for registry URI.\n\n")
+		fs.Usage()
+		return nil, errUsage
+	}
+
+	return s, nil
+}
+
+// fileConfig config file, the keys are the flag names besides the registry and
+// sources sections
+//
+//	registry:
+//	  uri: consul://127.0.0.1:8500
+//	  options: {dc: dc1, token-file: /etc/consul.d/token}
+//	sources:
+//	  - file:///etc/registrator
+//	  - uri: api:///var/run/registrator.sock
+//	    options: {listen: "127.0.0.1:4100"}
+//	log-level: info
+//	resync: 600
+//	tags: [prod, asia]
+//	node-meta: {role: db}
+type fileConfig struct {
+	registry string
+	// values of flags keyed by flag name
+	flags map[string][]string
+}
+
+// endpoint URI of registry or source with options merged into its query
+type endpoint struct {
+	URI     string            `yaml:"uri"`
+	Options map[string]string `yaml:"options"`
+}
+
+// UnmarshalYAML accepts a plain URI as well
+func (e *endpoint) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.URI); err == nil {
+		return nil
+	}
+	type plain endpoint
+	return unmarshal((*plain)(e))
+}
+
+func (e *endpoint) String() (string, error) {
+	if len(e.Options) == 0 {
+		return e.URI, nil
+	}
+	uri, err := url.Parse(e.URI)
+	if err != nil {
+		return "", err
+	}
+	query := uri.Query()
+	for k, v := range e.Options {
+		query.Set(k, v)
+	}
+	uri.RawQuery = query.Encode()
+	return uri.String(), nil
+}
+
+func readConfigFile(path string, fs *flag.FlagSet) (*fileConfig, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is parsed as YAML
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(bs, &raw); err != nil {
+		return nil, err
+	}
+	var sections struct {
+		Registry *endpoint  `yaml:"registry"`
+		Sources  []endpoint `yaml:"sources"`
+	}
+	if err := yaml.Unmarshal(bs, &sections); err != nil {
+		return nil, err
+	}
+
+	c := &fileConfig{flags: make(map[string][]string)}
+	for key, value := range raw {
+		switch key {
+		case "registry", "sources":
+			continue
+		case "config", "version":
+			return nil, fmt.Errorf("%s is not allowed", key)
+		}
+		if fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown key %s", key)
+		}
+		c.flags[key] = flatten(value)
+	}
+
+	if sections.Registry != nil {
+		if c.registry, err = sections.Registry.String(); err != nil {
+			return nil, fmt.Errorf("invalid registry: %v", err)
+		}
+	}
+	for _, source := range sections.Sources {
+		uri, err := source.String()
+		if err != nil {
+			return nil, fmt.Errorf("invalid source: %v", err)
+		}
+		c.flags["source"] = append(c.flags["source"], uri)
+	}
+
+	return c, nil
+}
+
+// flatten converts the value of config file to the values of flag, a list is
+// converted to values of each item, a map is converted to values in the form
+// key=value
+func flatten(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	case map[interface{}]interface{}:
+		values := make([]string, 0, len(v))
+		for k, item := range v {
+			values = append(values, fmt.Sprintf("%v=%v", k, item))
+		}
+		sort.Strings(values)
+		return values
+	}
+	return []string{fmt.Sprint(value)}
+}
+
+// reconfigurable the running bridge, which applies the settings changed while running
+type reconfigurable interface {
+	Reconfigure(config bridge.Config)
+}
+
+// reload reloads settings on SIGHUP, applies the ones which can be changed
+// while running, and reports the others which require restart. It returns
+// the applied settings and whether the periodic loops need to be restarted
+func reload(b reconfigurable, current *settings) (*settings, bool) {
+	next, err := loadSettings(os.Args[1:])
+	if err != nil {
+		log.Errorf("reload failed, keep the current settings: %v", err)
+		return current, false
+	}
+
+	restartRequired := []struct {
+		name    string
+		changed bool
+	}{
+		{"registry", next.Registry != current.Registry},
+		{"config-dir", next.ConfDir != current.ConfDir},
+		{"ip", next.HostIP != current.HostIP},
+		{"ttl", next.RefreshTTL != current.RefreshTTL},
+		// they're only used to connect to backend on startup
+		{"retry-attempts", next.RetryAttempts != current.RetryAttempts},
+		{"retry-interval", next.RetryInterval != current.RetryInterval},
+		{"source", next.Sources.String() != current.Sources.String()},
+		{"node-meta", next.NodeMeta.String() != current.NodeMeta.String()},
+		{"local-checks", next.LocalChecks != current.LocalChecks},
+		{"status-listen", next.StatusListen != current.StatusListen},
+		{"ready-policy", next.ReadyPolicy != current.ReadyPolicy},
+	}
+	// keep what is running, the settings are validated as they will be applied,
+	// e.g. -ttl-refresh against the running -ttl
+	next.Registry = current.Registry
+	next.ConfDir = current.ConfDir
+	next.HostIP = current.HostIP
+	next.RefreshTTL = current.RefreshTTL
+	next.RetryAttempts = current.RetryAttempts
+	next.RetryInterval = current.RetryInterval
+	next.Sources = current.Sources
+	next.NodeMeta = current.NodeMeta
+	next.LocalChecks = current.LocalChecks
+	next.StatusListen = current.StatusListen
+	next.ReadyPolicy = current.ReadyPolicy
+
+	if err := next.validate(); err != nil {
+		log.Errorf("reload failed, keep the current settings: %v", err)
+		return current, false
+	}
+	for _, setting := range restartRequired {
+		if setting.changed {
+			log.Warnf("%s changed, restart is required to apply it", setting.name)
+		}
+	}
+
+	if next.LogLevel != current.LogLevel {
+		setupLogger(next.LogLevel)
+		log.Infof("log-level changed to %s", next.LogLevel)
+	}
+
+	b.Reconfigure(next.bridgeConfig())
+
+	restartLoops := next.ResyncInterval != current.ResyncInterval ||
+		next.RefreshInterval != current.RefreshInterval ||
+		next.PingInterval != current.PingInterval
+
+	log.Infof("settings reloaded")
+	return next, restartLoops
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// setenv sets the environment variables until the test ends
+func setenv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		os.Setenv(k, v)
+		k := k
+		t.Cleanup(func() { os.Unsetenv(k) })
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "registrator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	path := writeConfig(t, "registrator.yml", `
+registry: consul://10.0.0.1:8500
+log-level: warn
+resync: 600
+`)
+
+	for _, c := range []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		logLevel string
+		resync   int
+		registry string
+	}{
+		{"defaults", []string{"consul://"}, nil, "info", 0, "consul://"},
+		{"file", []string{"-config", path}, nil, "warn", 600, "consul://10.0.0.1:8500"},
+		{"env over file", []string{"-config", path},
+			map[string]string{"REGISTRATOR_LOG_LEVEL": "error", "REGISTRATOR_REGISTRY": "etcd://"}, "error", 600, "etcd://"},
+		{"flag over env", []string{"-config", path, "-log-level", "debug", "redis://"},
+			map[string]string{"REGISTRATOR_LOG_LEVEL": "error", "REGISTRATOR_REGISTRY": "etcd://"}, "debug", 600, "redis://"},
+		{"config by env", nil, map[string]string{"REGISTRATOR_CONFIG": path, "REGISTRATOR_RESYNC": "60"}, "warn", 60, "consul://10.0.0.1:8500"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			setenv(t, c.env)
+			s, err := loadSettings(c.args)
+			if err != nil {
+				t.Fatalf("loadSettings() = %v", err)
+			}
+			if s.LogLevel != c.logLevel || s.ResyncInterval != c.resync || s.Registry != c.registry {
+				t.Errorf("settings = %s %d %s, want %s %d %s", s.LogLevel, s.ResyncInterval, s.Registry, c.logLevel, c.resync, c.registry)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	yamlConfig := `
+registry:
+  uri: consul://127.0.0.1:8500
+  options: {dc: dc1}
+sources:
+  - file:///etc/registrator
+  - uri: api:///var/run/registrator.sock
+    options: {listen: "127.0.0.1:4100"}
+tags: [prod, asia]
+node-meta: {role: db, rack: r1}
+cleanup: true
+`
+	jsonConfig := `{
+  "registry": {"uri": "consul://127.0.0.1:8500", "options": {"dc": "dc1"}},
+  "sources": ["file:///etc/registrator", {"uri": "api:///var/run/registrator.sock", "options": {"listen": "127.0.0.1:4100"}}],
+  "tags": ["prod", "asia"],
+  "node-meta": {"role": "db", "rack": "r1"},
+  "cleanup": true
+}`
+	for name, content := range map[string]string{"registrator.yml": yamlConfig, "registrator.json": jsonConfig} {
+		t.Run(name, func(t *testing.T) {
+			s, err := loadSettings([]string{"-config", writeConfig(t, name, content)})
+			if err != nil {
+				t.Fatalf("loadSettings() = %v", err)
+			}
+			if s.Registry != "consul://127.0.0.1:8500?dc=dc1" {
+				t.Errorf("registry = %s", s.Registry)
+			}
+			sources := []string{"file:///etc/registrator", "api:///var/run/registrator.sock?listen=127.0.0.1%3A4100"}
+			if !reflect.DeepEqual([]string(s.Sources), sources) {
+				t.Errorf("sources = %v", s.Sources)
+			}
+			if s.Tags != "prod,asia" || !s.Cleanup {
+				t.Errorf("tags = %s, cleanup = %v", s.Tags, s.Cleanup)
+			}
+			if !reflect.DeepEqual([]string(s.NodeMeta), []string{"rack=r1", "role=db"}) {
+				t.Errorf("node-meta = %v", s.NodeMeta)
+			}
+		})
+	}
+
+	for name, content := range map[string]string{
+		"unknown key":     "registry: consul://\nunknown: 1\n",
+		"config key":      "registry: consul://\nconfig: /etc/registrator.yml\n",
+		"invalid value":   "registry: consul://\nresync: soon\n",
+		"malformed":       "registry: [consul://\n",
+		"invalid options": "registry: {uri: \"consul://%zz\", options: {dc: dc1}}\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadSettings([]string{"-config", writeConfig(t, "registrator.yml", content)}); err == nil {
+				t.Error("loadSettings() succeeded")
+			}
+		})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	for _, c := range []struct {
+		value    interface{}
+		expected []string
+	}{
+		{nil, nil},
+		{10, []string{"10"}},
+		{true, []string{"true"}},
+		{[]interface{}{"a", 1}, []string{"a", "1"}},
+		{map[interface{}]interface{}{"b": 2, "a": "x"}, []string{"a=x", "b=2"}},
+	} {
+		if got := flatten(c.value); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("flatten(%v) = %v, want %v", c.value, got, c.expected)
+		}
+	}
+}
+
+// fakeBridge records the applied config
+type fakeBridge struct {
+	configs []bridge.Config
+}
+
+func (b *fakeBridge) Reconfigure(config bridge.Config) {
+	b.configs = append(b.configs, config)
+}
+
+func TestReload(t *testing.T) {
+	args := os.Args
+	t.Cleanup(func() { os.Args = args })
+
+	path := writeConfig(t, "registrator.yml", `
+registry: consul://
+ttl: 30
+ttl-refresh: 10
+retry-attempts: 3
+tags: [prod]
+`)
+	os.Args = []string{"registrator", "-config", path}
+	current, err := loadSettings(os.Args[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name         string
+		config       string
+		applied      bool
+		restartLoops bool
+		check        func(s *settings) bool
+	}{
+		{"applied", "registry: consul://\nttl: 30\nttl-refresh: 20\nretry-attempts: 3\ntags: [prod, asia]\ndrain: 30\n", true, true,
+			func(s *settings) bool { return s.RefreshInterval == 20 && s.Tags == "prod,asia" && s.Drain == 30 }},
+		{"restart required", "registry: etcd://\nttl: 60\nttl-refresh: 10\nretry-attempts: 5\nretry-interval: 100\ntags: [prod]\n", true, false,
+			func(s *settings) bool {
+				return s.Registry == "consul://" && s.RefreshTTL == 30 && s.RetryAttempts == 3 && s.RetryInterval == 2000
+			}},
+		// validated against the running ttl
+		{"invalid", "registry: consul://\nttl: 60\nttl-refresh: 40\n", false, false, nil},
+		{"malformed", "registry: [consul://\n", false, false, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(c.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			b := new(fakeBridge)
+			next, restartLoops := reload(b, current)
+			if applied := len(b.configs) == 1; applied != c.applied || restartLoops != c.restartLoops {
+				t.Fatalf("reload() applied %v restart loops %v, want %v %v", applied, restartLoops, c.applied, c.restartLoops)
+			}
+			if !c.applied {
+				if next != current {
+					t.Error("reload() failed but the settings are changed")
+				}
+				return
+			}
+			if !c.check(next) {
+				t.Errorf("reloaded settings = %+v", next)
+			}
+		})
+	}
+}
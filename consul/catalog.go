@@ -0,0 +1,226 @@
+package consul
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Node meta used by consul-esm to discover external nodes and run their checks
+const (
+	ExternalNodeMeta  = "external-node"
+	ExternalProbeMeta = "external-probe"
+)
+
+// CatalogAdapter implement adapter with consul catalog, it registers services
+// on behalf of an external node which has no local consul agent
+type CatalogAdapter struct {
+	*ConsulAdapter
+	node     string
+	address  string
+	nodeMeta map[string]string
+	// warned the unsupported checks which have been warned, keyed by service id and index
+	warned sync.Map
+}
+
+// newCatalogAdapter returns catalog adapter, node name and address default to
+// local node identity, they can be overridden with the query parameters of
+// registry URI, e.g. consul-catalog://127.0.0.1:8500?node=switch-01&address=10.0.0.1&node-meta=rack:r1
+func newCatalogAdapter(adapter *ConsulAdapter, uri *url.URL) *CatalogAdapter {
+	query := uri.Query()
+
+	r := &CatalogAdapter{
+		ConsulAdapter: adapter,
+		node:          bridge.LocalNode.Name,
+		address:       bridge.LocalNode.Address,
+		nodeMeta: map[string]string{
+			ExternalNodeMeta:  "true",
+			ExternalProbeMeta: "true",
+		},
+	}
+	for k, v := range bridge.LocalNode.Meta {
+		r.nodeMeta[k] = v
+	}
+
+	if node := query.Get("node"); node != "" {
+		r.node = node
+	}
+	if address := query.Get("address"); address != "" {
+		r.address = address
+	}
+	for _, meta := range query["node-meta"] {
+		kv := strings.SplitN(meta, ":", 2)
+		if len(kv) != 2 {
+			log.Fatalf("consul: invalid node-meta %q, must be in the form key:value", meta)
+		}
+		r.nodeMeta[kv[0]] = kv[1]
+	}
+
+	if r.address == "" {
+		log.Fatal("consul: catalog mode requires node address, use -ip or address option of registry URI")
+	}
+
+	return r
+}
+
+func (r *CatalogAdapter) Register(service *bridge.Service) error {
+	registration := &consulapi.CatalogRegistration{
+		Node:     r.node,
+		Address:  r.address,
+		NodeMeta: r.nodeMeta,
+		Service: &consulapi.AgentService{
+			ID:                service.ID,
+			Service:           service.Name,
+			Port:              service.Port,
+			Address:           service.IP,
+			Tags:              service.Tags,
+			Meta:              service.Attrs,
+			EnableTagOverride: true,
+		},
+		Checks: r.buildHealthChecks(service),
+	}
+
+	log.Debugf("consul: catalog service register: %v", registration)
+	return r.call(func(client *consulapi.Client) error {
+		_, err := client.Catalog().Register(registration, nil)
+		return err
+	})
+}
+
+// Normalize strips the checks which are not supported in catalog mode, as they
+// are not registered
+func (r *CatalogAdapter) Normalize(service *bridge.Service) *bridge.Service {
+	checks := r.supportedChecks(service)
+	if len(checks) == len(service.Checks) {
+		return service
+	}
+	normalized := *service
+	normalized.Checks = checks
+	return &normalized
+}
+
+// supportedChecks returns the checks of service which can be run by consul-esm,
+// i.e. the http and tcp ones with valid durations, the others are warned once
+func (r *CatalogAdapter) supportedChecks(service *bridge.Service) []*bridge.Check {
+	var checks []*bridge.Check
+	for i, check := range service.Checks {
+		var reason string
+		if check.HTTP == "" && check.TCP == "" {
+			reason = "catalog mode supports only http and tcp check"
+		} else if _, err := parseDuration(check.Interval); err != nil {
+			reason = "invalid interval: " + err.Error()
+		} else if _, err := parseDuration(check.Timeout); err != nil {
+			reason = "invalid timeout: " + err.Error()
+		} else if _, err := parseDuration(check.DeregisterCriticalServiceAfter); err != nil {
+			reason = "invalid deregister_critical_service_after: " + err.Error()
+		}
+		if reason == "" {
+			checks = append(checks, check)
+			continue
+		}
+
+		if _, warned := r.warned.LoadOrStore(fmt.Sprintf("%s:%d", service.ID, i), true); !warned {
+			log.Warnf("consul: %s, ignored check %d of %s", reason, i, service.ID)
+		}
+	}
+	return checks
+}
+
+// buildHealthChecks converts the supported checks of service to catalog health
+// checks, the check definition will be run by consul-esm
+func (r *CatalogAdapter) buildHealthChecks(service *bridge.Service) consulapi.HealthChecks {
+	supported := r.supportedChecks(service)
+	checks := make(consulapi.HealthChecks, 0, len(supported))
+	for i, check := range supported {
+		// the durations have been validated
+		definition := consulapi.HealthCheckDefinition{
+			HTTP:          check.HTTP,
+			Header:        check.Header,
+			Method:        check.Method,
+			TLSSkipVerify: check.TLSSkipVerify,
+			TCP:           check.TCP,
+		}
+		definition.IntervalDuration, _ = parseDuration(check.Interval)
+		definition.TimeoutDuration, _ = parseDuration(check.Timeout)
+		definition.DeregisterCriticalServiceAfterDuration, _ = parseDuration(check.DeregisterCriticalServiceAfter)
+
+		healthCheck := &consulapi.HealthCheck{
+			Node:        r.node,
+			CheckID:     check.ID,
+			Name:        check.Name,
+			Status:      check.Status,
+			ServiceID:   service.ID,
+			ServiceName: service.Name,
+			Definition:  definition,
+		}
+		if healthCheck.CheckID == "" {
+			// numbered as the supported checks, the same as toService
+			healthCheck.CheckID = defaultCheckID(service.ID, i, len(supported))
+		}
+		if healthCheck.Name == "" {
+			healthCheck.Name = defaultCheckName(service.Name)
+		}
+		if healthCheck.Status == "" {
+			healthCheck.Status = consulapi.HealthCritical
+		}
+		checks = append(checks, healthCheck)
+	}
+	return checks
+}
+
+func (r *CatalogAdapter) Deregister(service *bridge.Service) error {
+	log.Debugf("consul: catalog service deregister id: %s", service.ID)
+	return r.call(func(client *consulapi.Client) error {
+		_, err := client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      r.node,
+			ServiceID: service.ID,
+		}, nil)
+		return err
+	})
+}
+
+func (r *CatalogAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+func (r *CatalogAdapter) Services() ([]*bridge.Service, error) {
+	node, _, err := r.api().Catalog().Node(r.node, nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	if node == nil {
+		// node has not been registered yet
+		return []*bridge.Service{}, nil
+	}
+	checks, _, err := r.api().Health().Node(r.node, nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+
+	serviceChecks := make(map[string][]*bridge.Check)
+	for _, c := range checks {
+		if c.ServiceID == "" || isMaintenanceCheck(c.CheckID) {
+			continue
+		}
+		serviceChecks[c.ServiceID] = append(serviceChecks[c.ServiceID],
+			toCheck(c.CheckID, c.Name, c.Status, c.Definition))
+	}
+
+	out := make([]*bridge.Service, 0, len(node.Services))
+	for _, v := range node.Services {
+		out = append(out, toService(v, serviceChecks[v.ID]))
+	}
+	return out, nil
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
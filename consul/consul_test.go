@@ -0,0 +1,294 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// agent the stand-in of consul agent
+type agent struct {
+	sync.Mutex
+	*httptest.Server
+	services map[string]*consulapi.AgentService
+	checks   map[string]*consulapi.AgentCheck
+	down     bool
+}
+
+func newAgent(t *testing.T) *agent {
+	a := &agent{services: make(map[string]*consulapi.AgentService), checks: make(map[string]*consulapi.AgentCheck)}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Lock()
+		defer a.Unlock()
+
+		if a.down {
+			// the connection is closed without response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/v1/status/leader":
+			w.Write([]byte(`"127.0.0.1:8300"`))
+		case r.URL.Path == "/v1/agent/services":
+			json.NewEncoder(w).Encode(a.services)
+		case r.URL.Path == "/v1/agent/checks":
+			json.NewEncoder(w).Encode(a.checks)
+		case r.URL.Path == "/v1/agent/service/register":
+			var registration consulapi.AgentServiceRegistration
+			if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+				t.Errorf("decode registration: %v", err)
+			}
+			if registration.Name == "invalid" {
+				http.Error(w, "invalid service", http.StatusBadRequest)
+				return
+			}
+			a.register(&registration)
+		case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+			id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+			delete(a.services, id)
+			for checkID, check := range a.checks {
+				if check.ServiceID == id {
+					delete(a.checks, checkID)
+				}
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return a
+}
+
+// register keeps the service and its checks as consul does, the ids and names
+// of checks are generated If not specified, and the status is the initial one
+func (a *agent) register(registration *consulapi.AgentServiceRegistration) {
+	a.services[registration.ID] = &consulapi.AgentService{
+		ID:      registration.ID,
+		Service: registration.Name,
+		Port:    registration.Port,
+		Address: registration.Address,
+		Tags:    registration.Tags,
+		Meta:    registration.Meta,
+	}
+	for i, check := range registration.Checks {
+		id, name := check.CheckID, check.Name
+		if id == "" {
+			id = "service:" + registration.ID
+			if len(registration.Checks) > 1 {
+				id += ":" + strconv.Itoa(i+1)
+			}
+		}
+		if name == "" {
+			name = "Service '" + registration.Name + "' check"
+		}
+		status := check.Status
+		if status == "" {
+			status = consulapi.HealthCritical
+		}
+		interval, _ := time.ParseDuration(check.Interval)
+		timeout, _ := time.ParseDuration(check.Timeout)
+		deregister, _ := time.ParseDuration(check.DeregisterCriticalServiceAfter)
+		a.checks[id] = &consulapi.AgentCheck{
+			CheckID:     id,
+			Name:        name,
+			Status:      status,
+			ServiceID:   registration.ID,
+			ServiceName: registration.Name,
+			Definition: consulapi.HealthCheckDefinition{
+				HTTP:                                   check.HTTP,
+				Header:                                 check.Header,
+				Method:                                 check.Method,
+				TLSSkipVerify:                          check.TLSSkipVerify,
+				TCP:                                    check.TCP,
+				IntervalDuration:                       interval,
+				TimeoutDuration:                        timeout,
+				DeregisterCriticalServiceAfterDuration: deregister,
+			},
+		}
+	}
+}
+
+func (a *agent) setDown(down bool) {
+	a.Lock()
+	defer a.Unlock()
+	a.down = down
+}
+
+func (a *agent) has(id string) bool {
+	a.Lock()
+	defer a.Unlock()
+	_, ok := a.services[id]
+	return ok
+}
+
+func (a *agent) host() string {
+	return strings.TrimPrefix(a.URL, "http://")
+}
+
+func TestFailover(t *testing.T) {
+	bridge.HardwareID = "test"
+	preferred, fallback := newAgent(t), newAgent(t)
+	defer preferred.Close()
+	defer fallback.Close()
+
+	uri, _ := url.Parse("consul://" + preferred.host() + "," + fallback.host())
+	r := new(Factory).New(uri).(*ConsulAdapter)
+
+	web := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80}
+	api := &bridge.Service{ID: "[test]:api:8080", Name: "api", Port: 8080}
+	other := &consulapi.AgentService{ID: "[other]:db:3306", Service: "db", Port: 3306}
+	fallback.services[other.ID] = other
+
+	if err := r.Register(web); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if !preferred.has(web.ID) {
+		t.Fatal("service is not registered on preferred agent")
+	}
+
+	// the registration fails over at once as the preferred agent is down
+	preferred.setDown(true)
+	if err := r.Register(api); err != nil {
+		t.Fatalf("Register() after preferred agent down = %v", err)
+	}
+	if r.Endpoint() != fallback.host() || !fallback.has(api.ID) {
+		t.Fatalf("endpoint = %s, want %s", r.Endpoint(), fallback.host())
+	}
+
+	// the errors of consul don't fail over
+	if err := r.Register(&bridge.Service{ID: "[test]:x:1", Name: "invalid", Port: 1}); err == nil {
+		t.Error("Register() of invalid service succeeded")
+	}
+	if r.Endpoint() != fallback.host() {
+		t.Errorf("endpoint after invalid registration = %s", r.Endpoint())
+	}
+
+	// fails back, the services of local node are deregistered from the fallback agent
+	preferred.setDown(false)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if r.Endpoint() != preferred.host() {
+		t.Fatalf("endpoint after failback = %s, want %s", r.Endpoint(), preferred.host())
+	}
+	if fallback.has(api.ID) {
+		t.Error("service of local node is orphaned on fallback agent")
+	}
+	if !fallback.has(other.ID) {
+		t.Error("service of other node is deregistered from fallback agent")
+	}
+	if !preferred.has(web.ID) {
+		t.Error("service is deregistered from preferred agent")
+	}
+	if len(r.stale) != 0 {
+		t.Errorf("stale endpoints = %v", r.stale)
+	}
+}
+
+func TestStaleUnreachable(t *testing.T) {
+	bridge.HardwareID = "test"
+	preferred, fallback := newAgent(t), newAgent(t)
+	defer preferred.Close()
+	defer fallback.Close()
+
+	uri, _ := url.Parse("consul://" + preferred.host() + "," + fallback.host())
+	r := new(Factory).New(uri).(*ConsulAdapter)
+
+	// switched to fallback agent, and back to preferred one while fallback is down
+	preferred.setDown(true)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	fallback.services["[test]:api:8080"] = &consulapi.AgentService{ID: "[test]:api:8080"}
+	preferred.setDown(false)
+	fallback.setDown(true)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if !r.stale[1] {
+		t.Fatal("unreachable fallback agent is not stale")
+	}
+
+	// cleaned up once reachable
+	fallback.setDown(false)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if fallback.has("[test]:api:8080") || r.stale[1] {
+		t.Error("stale endpoint is not cleaned up")
+	}
+}
+
+func TestServicesRoundTrip(t *testing.T) {
+	a := newAgent(t)
+	defer a.Close()
+	uri, _ := url.Parse("consul://" + a.host())
+	r := new(Factory).New(uri).(*ConsulAdapter)
+
+	services := []*bridge.Service{
+		{ID: "[test]:web:80", Name: "web", Port: 80, IP: "10.0.0.5", Tags: []string{"http", "prod"},
+			Attrs: map[string]string{"team": "edge", "version": "1.2"},
+			Checks: []*bridge.Check{
+				{HTTP: "http://127.0.0.1:80/health", Method: "HEAD", Header: map[string][]string{"Host": {"web.local"}},
+					TLSSkipVerify: true, Interval: "10s", Timeout: "1s", DeregisterCriticalServiceAfter: "1m", Rise: 2, Fall: 3},
+				{TCP: "127.0.0.1:80", Interval: "5s", Status: "passing"},
+			}},
+		{ID: "[test]:db:5432", Name: "db", Port: 5432,
+			Checks: []*bridge.Check{{ID: "db-alive", Name: "db alive", Args: []string{"pg_isready"}, Interval: "30s"}}},
+		{ID: "[test]:cache:6379", Name: "cache", Port: 6379,
+			Checks: []*bridge.Check{{TCP: "127.0.0.1:6379", Interval: "10s"}}},
+		{ID: "[test]:batch:0", Name: "batch"},
+	}
+	for _, service := range services {
+		if err := r.Register(service); err != nil {
+			t.Fatalf("Register() = %v", err)
+		}
+	}
+
+	actual, err := r.Services()
+	if err != nil || len(actual) != len(services) {
+		t.Fatalf("Services() = %v, %v", actual, err)
+	}
+	registered := make(map[string]*bridge.Service, len(actual))
+	for _, service := range actual {
+		registered[service.ID] = service
+	}
+	// every field registered is read back, the status of checks is ignored
+	for _, service := range services {
+		if fields := bridge.Diff(service, registered[service.ID]); len(fields) > 0 {
+			t.Errorf("%s drifted after round trip: %v", service.ID, fields)
+		}
+	}
+	web := registered["[test]:web:80"]
+	if web.Checks[0].HTTP == "" || web.Checks[1].TCP == "" || web.Checks[0].ID != "" || web.Checks[0].Name != "" {
+		t.Errorf("checks of web = %+v %+v", web.Checks[0], web.Checks[1])
+	}
+	if db := registered["[test]:db:5432"]; db.Checks[0].ID != "db-alive" || db.Checks[0].Name != "db alive" {
+		t.Errorf("checks of db = %+v", db.Checks[0])
+	}
+
+	// the changes out-of-band are detected
+	a.Lock()
+	a.services["[test]:web:80"].Tags = []string{"http"}
+	a.checks["service:[test]:web:80:2"].Definition.TCP = "127.0.0.1:81"
+	a.Unlock()
+	actual, _ = r.Services()
+	for _, service := range actual {
+		if service.ID != "[test]:web:80" {
+			continue
+		}
+		if fields := bridge.Diff(services[0], service); len(fields) != 2 || fields[0] != "tags" || fields[1] != "checks" {
+			t.Errorf("drifted fields = %v", fields)
+		}
+	}
+}
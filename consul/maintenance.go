@@ -0,0 +1,55 @@
+package consul
+
+import (
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// maintenanceCheckPrefix prefix of the check id of service maintenance mode
+const maintenanceCheckPrefix = "_service_maintenance:"
+
+// EnableMaintenance puts service into maintenance mode, it's kept registered
+// but excluded from DNS and health queries
+func (r *ConsulAdapter) EnableMaintenance(service *bridge.Service, reason string) error {
+	return r.api().Agent().EnableServiceMaintenance(service.ID, reason)
+}
+
+func (r *ConsulAdapter) DisableMaintenance(service *bridge.Service) error {
+	return r.api().Agent().DisableServiceMaintenance(service.ID)
+}
+
+// EnableMaintenance registers a critical maintenance check of service in the
+// catalog, as what the agent does in agent mode
+func (r *CatalogAdapter) EnableMaintenance(service *bridge.Service, reason string) error {
+	registration := &consulapi.CatalogRegistration{
+		Node:           r.node,
+		Address:        r.address,
+		SkipNodeUpdate: true,
+		Check: &consulapi.AgentCheck{
+			Node:      r.node,
+			CheckID:   maintenanceCheckPrefix + service.ID,
+			Name:      "Service Maintenance Mode",
+			Notes:     reason,
+			Status:    consulapi.HealthCritical,
+			ServiceID: service.ID,
+		},
+	}
+	_, err := r.api().Catalog().Register(registration, nil)
+	return err
+}
+
+func (r *CatalogAdapter) DisableMaintenance(service *bridge.Service) error {
+	_, err := r.api().Catalog().Deregister(&consulapi.CatalogDeregistration{
+		Node:    r.node,
+		CheckID: maintenanceCheckPrefix + service.ID,
+	}, nil)
+	return err
+}
+
+// isMaintenanceCheck returns whether the check is the maintenance mode of
+// service rather than defined by service
+func isMaintenanceCheck(checkID string) bool {
+	return strings.HasPrefix(checkID, maintenanceCheckPrefix)
+}
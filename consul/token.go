@@ -0,0 +1,102 @@
+package consul
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchTokenFile reloads the ACL token when token file changed, so that tokens
+// can be rotated without restarting registrator.
+func (r *ConsulAdapter) watchTokenFile(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// watch the parent dir rather than the file itself, token file is often
+	// replaced by rename (e.g. vault agent, kubernetes secret volume)
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&fsnotify.Chmod == fsnotify.Chmod || !isTokenEvent(path, event.Name) {
+					continue
+				}
+				log.Debugf("consul: token file received event: %v", event)
+				r.reloadToken(path)
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("consul: token file watcher failed: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isTokenEvent returns whether the event of name in the dir of token file may
+// change the token, i.e. the token file itself or the ..data symlink which is
+// swapped on the updates of kubernetes secret volume
+func isTokenEvent(path, name string) bool {
+	name = filepath.Clean(name)
+	return name == path || (filepath.Dir(name) == filepath.Dir(path) && filepath.Base(name) == "..data")
+}
+
+// readToken reads the token in file
+func readToken(path string) (string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(bs))
+	if token == "" {
+		return "", errors.New("token file is empty")
+	}
+	return token, nil
+}
+
+// reloadToken re-reads token file and replaces client If the token changed
+func (r *ConsulAdapter) reloadToken(path string) {
+	token, err := readToken(path)
+	if err != nil {
+		log.Warnf("consul: read token file %s failed, ignored: %v", path, err)
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if token == r.config.Token {
+		return
+	}
+
+	config := *r.config
+	config.Token = token
+	config.TokenFile = ""
+	clients, err := r.newClients(&config)
+	if err != nil {
+		log.Errorf("consul: reload token failed: %v", err)
+		return
+	}
+
+	r.clients = clients
+	r.config.Token = token
+	log.Infof("consul: token reloaded from %s", path)
+}
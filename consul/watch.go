@@ -0,0 +1,127 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// retryInterval interval between retries when watch failed
+const retryInterval = 5 * time.Second
+
+// watchWaitTime max wait time of blocking queries
+const watchWaitTime = 5 * time.Minute
+
+// Watch watches the agent services with blocking query on the catalog node of
+// agent, /v1/catalog/node/:node, as the agent endpoint /v1/agent/services
+// doesn't return the index. The local services are synced to catalog by the
+// agent, and they are listed from the agent once the node changed
+func (r *ConsulAdapter) Watch(services chan<- []*bridge.Service, stop <-chan struct{}) {
+	r.watchNode(func() (string, error) {
+		return r.api().Agent().NodeName()
+	}, r.Services, services, stop)
+}
+
+// Watch watches the node services with blocking query on /v1/catalog/node/:node
+func (r *CatalogAdapter) Watch(services chan<- []*bridge.Service, stop <-chan struct{}) {
+	r.watchNode(func() (string, error) {
+		return r.node, nil
+	}, r.Services, services, stop)
+}
+
+// watchNode sends the services listed by list each time the catalog node has
+// changed, the node is resolved before each query as the endpoint may switch
+func (r *ConsulAdapter) watchNode(node func() (string, error), list func() ([]*bridge.Service, error),
+	services chan<- []*bridge.Service, stop <-chan struct{}) {
+	var index uint64
+	var last []byte
+	var lastNode string
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	retry := func() bool {
+		select {
+		case <-time.After(retryInterval):
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	for {
+		name, err := node()
+		if err != nil {
+			log.Warnf("consul: watch services failed, get node name: %v", err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		if name != lastNode {
+			// the index is of another node
+			index = 0
+			lastNode = name
+		}
+
+		opts := &consulapi.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime}
+		_, meta, err := r.api().Catalog().Node(name, opts.WithContext(ctx))
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			log.Warnf("consul: watch catalog node %s failed: %v", name, err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+
+		// reset the index If it goes backwards, e.g. consul servers restored from snapshot
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		index = meta.LastIndex
+
+		extServices, err := list()
+		if err != nil {
+			log.Warnf("consul: watch services of node %s failed: %v", name, err)
+			if !retry() {
+				return
+			}
+			continue
+		}
+		if current, changed := snapshotChanged(last, extServices); changed {
+			last = current
+			select {
+			case services <- extServices:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+// snapshotChanged returns the snapshot of services and whether it's different from last one
+func snapshotChanged(last []byte, services []*bridge.Service) ([]byte, bool) {
+	byID := make(map[string]*bridge.Service, len(services))
+	for _, service := range services {
+		byID[service.ID] = service
+	}
+	current, err := json.Marshal(byID)
+	if err != nil {
+		return last, true
+	}
+	return current, !bytes.Equal(last, current)
+}
@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint default docker engine API endpoint
+const DefaultEndpoint = "unix:///var/run/docker.sock"
+
+const requestTimeout = 10 * time.Second
+
+// Client minimal client of docker engine API, the endpoint can be a unix
+// socket (unix:///var/run/docker.sock) or tcp address (tcp://127.0.0.1:2375)
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// Container container details returned by inspect API
+type Container struct {
+	ID     string
+	Name   string
+	Config struct {
+		Image  string
+		Env    []string
+		Labels map[string]string
+	}
+	State struct {
+		Running bool
+	}
+	NetworkSettings struct {
+		Ports map[string][]PortBinding
+	}
+}
+
+// PortBinding published port of container
+type PortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string
+}
+
+// Event docker engine event
+type Event struct {
+	Type   string
+	Action string
+	Actor  struct {
+		ID string
+	}
+}
+
+// NewClient returns a client of docker engine API
+func NewClient(endpoint string) (*Client, error) {
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad docker endpoint %s: %v", endpoint, err)
+	}
+
+	transport := &http.Transport{}
+	c := &Client{http: &http.Client{Transport: transport}}
+	switch uri.Scheme {
+	case "unix":
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", uri.Path)
+		}
+		c.base = "http://docker"
+	case "tcp", "http":
+		c.base = "http://" + uri.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker endpoint: %s", endpoint)
+	}
+
+	return c, nil
+}
+
+// Ping testing docker engine is reachable
+func (c *Client) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := c.get(ctx, "/_ping")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListContainers returns the ids of running containers
+func (c *Client) ListContainers() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := c.get(ctx, "/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var containers []struct {
+		ID string `json:"Id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(containers))
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	return ids, nil
+}
+
+// InspectContainer returns the details of container
+func (c *Client) InspectContainer(id string) (*Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := c.get(ctx, "/containers/"+id+"/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	container := new(Container)
+	if err := json.NewDecoder(resp.Body).Decode(container); err != nil {
+		return nil, err
+	}
+	container.Name = strings.TrimPrefix(container.Name, "/")
+	return container, nil
+}
+
+// Events streams container events until ctx done or the connection broken
+func (c *Client) Events(ctx context.Context, events chan<- *Event) error {
+	filters := url.QueryEscape(`{"type":["container"]}`)
+	resp, err := c.get(ctx, "/events?filters="+filters)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := new(Event)
+		if err := decoder.Decode(event); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("docker: %s %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,320 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "docker")
+
+func init() {
+	bridge.Register(new(Factory), "docker")
+}
+
+// KeyPrefix prefix of the key of container services
+const KeyPrefix = "docker://"
+
+const reconnectInterval = 5 * time.Second
+
+type Factory struct{}
+
+// New returns the source of containers, the endpoint is the path of unix
+// socket or tcp address, e.g. docker:///var/run/docker.sock, docker://127.0.0.1:2375
+func (f *Factory) New(uri *url.URL) bridge.Source {
+	endpoint := DefaultEndpoint
+	if uri.Host != "" {
+		endpoint = "tcp://" + uri.Host
+	} else if uri.Path != "" {
+		endpoint = "unix://" + uri.Path
+	}
+
+	client, err := NewClient(endpoint)
+	if err != nil {
+		log.Fatalf("docker: %v", err)
+	}
+	return &Source{client: client, containers: make(map[string][]string)}
+}
+
+// Source services derived from containers, the container start/stop/die/destroy
+// events drive register/deregister
+type Source struct {
+	sync.Mutex
+	client *Client
+	// keys of services by container id
+	containers map[string][]string
+}
+
+func (s *Source) Services() (map[string]*bridge.Service, error) {
+	ids, err := s.client.ListContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.containers = make(map[string][]string, len(ids))
+	services := make(map[string]*bridge.Service)
+	for _, id := range ids {
+		container, err := s.client.InspectContainer(id)
+		if err != nil {
+			log.Warnf("inspect container %s failed: %v", bridge.TruncateID(id), err)
+			continue
+		}
+		for key, service := range Services(container) {
+			services[key] = service
+			s.containers[id] = append(s.containers[id], key)
+		}
+	}
+
+	return services, nil
+}
+
+// Watch streams container events until stop closed, the source is resynced
+// after reconnecting since events may be lost
+func (s *Source) Watch(events chan<- *bridge.SourceEvent, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	dockerEvents := make(chan *Event)
+	go func() {
+		for {
+			log.Infof("listening for docker events ...")
+			err := s.client.Events(ctx, dockerEvents)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("docker events stream broken: %v", err)
+
+			select {
+			case <-time.After(reconnectInterval):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case events <- &bridge.SourceEvent{Type: bridge.EventResync}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case event := <-dockerEvents:
+			for _, sourceEvent := range s.handle(event) {
+				select {
+				case events <- sourceEvent:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Source) handle(event *Event) []*bridge.SourceEvent {
+	id := event.Actor.ID
+	log.Debugf("docker: received event: %s %s", event.Action, bridge.TruncateID(id))
+
+	var sourceEvents []*bridge.SourceEvent
+	switch event.Action {
+	case "start":
+		container, err := s.client.InspectContainer(id)
+		if err != nil {
+			log.Errorf("inspect container %s failed: %v", bridge.TruncateID(id), err)
+			return nil
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		s.containers[id] = nil
+		for key, service := range Services(container) {
+			s.containers[id] = append(s.containers[id], key)
+			sourceEvents = append(sourceEvents, &bridge.SourceEvent{Type: bridge.EventAdd, Key: key, Service: service})
+		}
+	case "die", "stop", "destroy":
+		// kill is not handled, the container keeps running on the signals
+		// which are not fatal, e.g. docker kill -s HUP
+		s.Lock()
+		defer s.Unlock()
+		for _, key := range s.containers[id] {
+			sourceEvents = append(sourceEvents, &bridge.SourceEvent{Type: bridge.EventRemove, Key: key})
+		}
+		delete(s.containers, id)
+	}
+	return sourceEvents
+}
+
+// Services derives services from the published ports of container, keyed by
+// docker://<container id>/<port>/<protocol>. Service is customized by the
+// SERVICE_* labels or environment variables, the labels take precedence:
+//
+//	SERVICE_NAME, SERVICE_<port>_NAME    service name, default is image name
+//	SERVICE_TAGS, SERVICE_<port>_TAGS    comma separated tags
+//	SERVICE_IGNORE, SERVICE_<port>_IGNORE  don't register the service
+//	SERVICE_CHECK_HTTP                   http check path, e.g. /health
+//	SERVICE_CHECK_TCP                    tcp check If true
+//	SERVICE_CHECK_INTERVAL, SERVICE_CHECK_TIMEOUT
+//	SERVICE_<key>, SERVICE_<port>_<key>  attrs with lowercase key
+func Services(container *Container) map[string]*bridge.Service {
+	metadata := serviceMetadata(container)
+	if _, ok := metadata["ignore"]; ok {
+		return nil
+	}
+
+	ports := make([]string, 0, len(container.NetworkSettings.Ports))
+	for port, bindings := range container.NetworkSettings.Ports {
+		if len(bindings) > 0 {
+			ports = append(ports, port)
+		}
+	}
+	sort.Strings(ports)
+
+	services := make(map[string]*bridge.Service)
+	for _, port := range ports {
+		binding := container.NetworkSettings.Ports[port]
+		exposedPort, protocol := splitPort(port)
+
+		hostPort, err := strconv.Atoi(binding[0].HostPort)
+		if err != nil {
+			continue
+		}
+
+		attrs := make(map[string]string)
+		for k, v := range metadata {
+			if !isPortKey(k) {
+				attrs[k] = v
+			}
+		}
+		for k, v := range metadata {
+			if strings.HasPrefix(k, exposedPort+"_") {
+				attrs[strings.TrimPrefix(k, exposedPort+"_")] = v
+			}
+		}
+		if _, ok := attrs["ignore"]; ok {
+			continue
+		}
+
+		service := &bridge.Service{
+			Name: attrs["name"],
+			Port: hostPort,
+			IP:   binding[0].HostIP,
+		}
+		if service.Name == "" {
+			service.Name = imageName(container.Config.Image)
+			if len(ports) > 1 {
+				service.Name = fmt.Sprintf("%s-%s", service.Name, exposedPort)
+			}
+		}
+		if service.IP == "0.0.0.0" || service.IP == "::" {
+			service.IP = bridge.LocalNode.Address
+		}
+		if tags := attrs["tags"]; tags != "" {
+			for _, tag := range strings.Split(tags, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					service.Tags = append(service.Tags, tag)
+				}
+			}
+		}
+		if protocol != "tcp" {
+			service.Tags = append(service.Tags, protocol)
+		}
+		service.Checks = buildChecks(service, attrs)
+
+		for _, k := range []string{"name", "tags", "id", "check_http", "check_tcp", "check_interval", "check_timeout"} {
+			delete(attrs, k)
+		}
+		if len(attrs) > 0 {
+			service.Attrs = attrs
+		}
+
+		key := fmt.Sprintf("%s%s/%s/%s", KeyPrefix, bridge.TruncateID(container.ID), exposedPort, protocol)
+		services[key] = service
+	}
+
+	return services
+}
+
+func buildChecks(service *bridge.Service, attrs map[string]string) []*bridge.Check {
+	address := service.IP
+	if address == "" {
+		address = "127.0.0.1"
+	}
+
+	check := &bridge.Check{
+		Interval: attrs["check_interval"],
+		Timeout:  attrs["check_timeout"],
+	}
+	if path := attrs["check_http"]; path != "" {
+		check.HTTP = fmt.Sprintf("http://%s:%d%s", address, service.Port, path)
+	} else if tcp, _ := strconv.ParseBool(attrs["check_tcp"]); tcp {
+		check.TCP = fmt.Sprintf("%s:%d", address, service.Port)
+	} else {
+		return nil
+	}
+	if check.Interval == "" {
+		check.Interval = "10s"
+	}
+
+	return []*bridge.Check{check}
+}
+
+// serviceMetadata collects SERVICE_* from environment variables and labels,
+// the keys are lowercase without SERVICE_ prefix
+func serviceMetadata(container *Container) map[string]string {
+	metadata := make(map[string]string)
+	for _, kv := range container.Config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], "SERVICE_") {
+			metadata[strings.ToLower(strings.TrimPrefix(parts[0], "SERVICE_"))] = parts[1]
+		}
+	}
+	for k, v := range container.Config.Labels {
+		if strings.HasPrefix(k, "SERVICE_") {
+			metadata[strings.ToLower(strings.TrimPrefix(k, "SERVICE_"))] = v
+		}
+	}
+	return metadata
+}
+
+// isPortKey returns whether the metadata key is port specific, e.g. 80_name
+func isPortKey(key string) bool {
+	_, err := strconv.Atoi(strings.SplitN(key, "_", 2)[0])
+	return err == nil
+}
+
+func splitPort(port string) (string, string) {
+	parts := strings.SplitN(port, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], "tcp"
+	}
+	return parts[0], parts[1]
+}
+
+// imageName returns image name without registry, repository and tag,
+// e.g. quay.io/prometheus/node-exporter:v1.0.0 returns node-exporter
+func imageName(image string) string {
+	if i := strings.LastIndex(image, "/"); i >= 0 {
+		image = image[i+1:]
+	}
+	if i := strings.IndexAny(image, ":@"); i >= 0 {
+		image = image[:i]
+	}
+	return image
+}
@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+const containerID = "3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c1b2a3f4e"
+
+// engine the stand-in of docker engine API serving a container
+func engine(t *testing.T, events ...string) (*httptest.Server, *Client) {
+	container := map[string]interface{}{
+		"Id":   containerID,
+		"Name": "/web",
+		"Config": map[string]interface{}{
+			"Image":  "registry.example.com/team/nginx:1.19",
+			"Env":    []string{"SERVICE_TAGS=a, b", "SERVICE_80_NAME=web", "SERVICE_CHECK_HTTP=/health", "PATH=/bin"},
+			"Labels": map[string]string{"SERVICE_VERSION": "1", "SERVICE_443_IGNORE": "true"},
+		},
+		"State": map[string]bool{"Running": true},
+		"NetworkSettings": map[string]interface{}{
+			"Ports": map[string][]map[string]string{
+				"80/tcp":   {{"HostIp": "0.0.0.0", "HostPort": "8080"}},
+				"443/tcp":  {{"HostIp": "0.0.0.0", "HostPort": "8443"}},
+				"53/udp":   {{"HostIp": "10.0.0.9", "HostPort": "5353"}},
+				"9000/tcp": nil,
+			},
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_ping":
+			w.Write([]byte("OK"))
+		case "/containers/json":
+			json.NewEncoder(w).Encode([]map[string]string{{"Id": containerID}})
+		case "/containers/" + containerID + "/json":
+			json.NewEncoder(w).Encode(container)
+		case "/events":
+			if got := r.URL.Query().Get("filters"); got != `{"type":["container"]}` {
+				t.Errorf("events filters = %s", got)
+			}
+			for _, action := range events {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"Type": "container", "Action": action, "Actor": map[string]string{"ID": containerID},
+				})
+			}
+		default:
+			http.Error(w, `{"message":"No such container"}`, http.StatusNotFound)
+		}
+	}))
+
+	client, err := NewClient("tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestServices(t *testing.T) {
+	bridge.LocalNode.Address = "10.0.0.5"
+	server, client := engine(t)
+	defer server.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	s := &Source{client: client, containers: make(map[string][]string)}
+	services, err := s.Services()
+	if err != nil {
+		t.Fatalf("Services() = %v", err)
+	}
+
+	expected := map[string]*bridge.Service{
+		"docker://3f4e5d6c7b8a/80/tcp": {
+			Name:   "web",
+			Port:   8080,
+			IP:     "10.0.0.5",
+			Tags:   []string{"a", "b"},
+			Attrs:  map[string]string{"version": "1"},
+			Checks: []*bridge.Check{{HTTP: "http://10.0.0.5:8080/health", Interval: "10s"}},
+		},
+		"docker://3f4e5d6c7b8a/53/udp": {
+			Name:   "nginx-53",
+			Port:   5353,
+			IP:     "10.0.0.9",
+			Tags:   []string{"a", "b", "udp"},
+			Attrs:  map[string]string{"version": "1"},
+			Checks: []*bridge.Check{{HTTP: "http://10.0.0.9:5353/health", Interval: "10s"}},
+		},
+	}
+	if !reflect.DeepEqual(services, expected) {
+		got, _ := json.Marshal(services)
+		t.Errorf("Services() = %s", got)
+	}
+	if keys := s.containers[containerID]; len(keys) != 2 {
+		t.Errorf("keys of container = %v", keys)
+	}
+}
+
+func TestServicesIgnored(t *testing.T) {
+	container := new(Container)
+	container.Config.Env = []string{"SERVICE_IGNORE=1"}
+	container.NetworkSettings.Ports = map[string][]PortBinding{"80/tcp": {{HostPort: "80"}}}
+	if services := Services(container); len(services) != 0 {
+		t.Errorf("Services() = %v, want none", services)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	server, client := engine(t)
+	defer server.Close()
+	s := &Source{client: client, containers: make(map[string][]string)}
+
+	event := func(action string) *Event {
+		e := &Event{Type: "container", Action: action}
+		e.Actor.ID = containerID
+		return e
+	}
+
+	added := s.handle(event("start"))
+	if len(added) != 2 {
+		t.Fatalf("start events = %d, want 2", len(added))
+	}
+	for _, e := range added {
+		if e.Type != bridge.EventAdd || e.Service == nil {
+			t.Errorf("start event = %+v", e)
+		}
+	}
+
+	// the container keeps running on signals which are not fatal
+	if events := s.handle(event("kill")); len(events) != 0 {
+		t.Errorf("kill events = %+v, want none", events)
+	}
+
+	removed := s.handle(event("die"))
+	if len(removed) != 2 {
+		t.Fatalf("die events = %d, want 2", len(removed))
+	}
+	for _, e := range removed {
+		if e.Type != bridge.EventRemove {
+			t.Errorf("die event = %+v", e)
+		}
+	}
+	if events := s.handle(event("destroy")); len(events) != 0 {
+		t.Errorf("destroy events after die = %+v, want none", events)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	server, client := engine(t, "start", "die")
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan *Event, 2)
+	if err := client.Events(ctx, events); err != nil {
+		t.Fatalf("Events() = %v", err)
+	}
+	close(events)
+
+	var actions []string
+	for event := range events {
+		if event.Actor.ID != containerID {
+			t.Errorf("event actor = %s", event.Actor.ID)
+		}
+		actions = append(actions, event.Action)
+	}
+	if !reflect.DeepEqual(actions, []string{"start", "die"}) {
+		t.Errorf("actions = %v", actions)
+	}
+}
+
+func TestImageName(t *testing.T) {
+	for image, expected := range map[string]string{
+		"nginx":      "nginx",
+		"nginx:1.19": "nginx",
+		"quay.io/prometheus/node-exporter:v1.0.0":    "node-exporter",
+		"localhost:5000/app@sha256:0123456789abcdef": "app",
+	} {
+		if got := imageName(image); got != expected {
+			t.Errorf("imageName(%s) = %s, want %s", image, got, expected)
+		}
+	}
+}
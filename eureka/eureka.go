@@ -0,0 +1,263 @@
+package eureka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "eureka")
+
+const requestTimeout = 10 * time.Second
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "eureka")
+	bridge.Register(f, "eureka-tls")
+}
+
+type Factory struct{}
+
+// New returns the eureka adapter, e.g. eureka://127.0.0.1:8761/eureka, the
+// path is the context path of eureka REST API, default is /eureka. The host
+// can be a comma separated list of eureka servers, the first healthy one is used
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	endpoints := bridge.ParseEndpoints(uri)
+	if len(endpoints) == 0 {
+		log.Fatalf("eureka: host of eureka server is required, e.g. %s://127.0.0.1:8761/eureka", uri.Scheme)
+	}
+
+	scheme := "http"
+	if uri.Scheme == "eureka-tls" {
+		scheme = "https"
+	}
+	path := strings.TrimSuffix(uri.Path, "/")
+	if path == "" {
+		path = "/eureka"
+	}
+
+	bases := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		bases = append(bases, scheme+"://"+endpoint+path)
+	}
+
+	return &EurekaAdapter{
+		user:      uri.User,
+		endpoints: bridge.NewEndpoints(bases),
+		http:      &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// EurekaAdapter registers services as eureka instances, the app name is the
+// service name in upper case and the instance id is the service id. Eureka
+// expires the instances which are not renewed, the heartbeats are sent by Refresh
+type EurekaAdapter struct {
+	// user basic auth of eureka server, nil If not required
+	user      *url.Userinfo
+	endpoints *bridge.Endpoints
+	http      *http.Client
+}
+
+// RequiresRefresh eureka expires the instances which are not renewed
+func (r *EurekaAdapter) RequiresRefresh() bool {
+	return true
+}
+
+// Ping pings the servers in the order of preference, and fails over to the
+// first healthy one
+func (r *EurekaAdapter) Ping() error {
+	return r.endpoints.Failover(func(i int) error {
+		resp, err := r.do(r.endpoints.All()[i], http.MethodGet, "/apps/delta", nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+}
+
+// Endpoint returns the server in use
+func (r *EurekaAdapter) Endpoint() string {
+	return r.endpoints.All()[r.endpoints.Current()]
+}
+
+func (r *EurekaAdapter) Register(service *bridge.Service) error {
+	body, err := json.Marshal(map[string]*instance{"instance": toInstance(service)})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("eureka: register instance: %s", body)
+	resp, err := r.call(http.MethodPost, "/apps/"+appName(service.Name), body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (r *EurekaAdapter) Deregister(service *bridge.Service) error {
+	// the name is unknown when the service is deregistered by id only
+	if service.Name == "" {
+		i, err := r.lookup(service.ID)
+		if err != nil || i == nil {
+			return err
+		}
+		service = &bridge.Service{ID: service.ID, Name: i.Metadata[metaName]}
+	}
+
+	log.Debugf("eureka: deregister instance: %s", service.ID)
+	resp, err := r.call(http.MethodDelete, instancePath(service), nil)
+	if err != nil && !isNotFound(err) {
+		return err
+	} else if err == nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Refresh renews the lease of service, it's registered again If eureka lost
+// it, e.g. the server restarted or the lease expired
+func (r *EurekaAdapter) Refresh(service *bridge.Service) error {
+	resp, err := r.call(http.MethodPut, instancePath(service)+"?status=UP", nil)
+	if isNotFound(err) {
+		log.Infof("eureka: instance %s not found, registering it again", service.ID)
+		return r.Register(service)
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Services returns the instances owned by this node
+func (r *EurekaAdapter) Services() ([]*bridge.Service, error) {
+	owned, err := r.instances()
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*bridge.Service, 0, len(owned))
+	for _, i := range owned {
+		services = append(services, toService(i))
+	}
+	return services, nil
+}
+
+// instances returns the instances owned by this node, which are marked by the
+// node metadata
+func (r *EurekaAdapter) instances() ([]*instance, error) {
+	resp, err := r.call(http.MethodGet, "/apps", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var apps applications
+	if err := json.NewDecoder(resp.Body).Decode(&apps); err != nil {
+		return nil, err
+	}
+
+	var owned []*instance
+	for _, app := range apps.Applications.Application {
+		for _, i := range app.Instance {
+			if i.Metadata[metaNode] == bridge.LocalNode.ID {
+				owned = append(owned, i)
+			}
+		}
+	}
+	return owned, nil
+}
+
+// lookup returns the owned instance of id, nil If not found
+func (r *EurekaAdapter) lookup(id string) (*instance, error) {
+	owned, err := r.instances()
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range owned {
+		if i.InstanceID == id {
+			return i, nil
+		}
+	}
+	return nil, nil
+}
+
+func instancePath(service *bridge.Service) string {
+	return "/apps/" + appName(service.Name) + "/" + url.PathEscape(service.ID)
+}
+
+// statusError unexpected status of eureka response
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("eureka: unexpected status %d: %s", e.status, e.body)
+}
+
+func isNotFound(err error) bool {
+	serr, ok := err.(*statusError)
+	return ok && serr.status == http.StatusNotFound
+}
+
+// call sends the request to the server in use, it fails over and retries once
+// on the new server If the server is unreachable
+func (r *EurekaAdapter) call(method, path string, body []byte) (*http.Response, error) {
+	var resp *http.Response
+	err := r.endpoints.Call(func(i int) error {
+		var err error
+		resp, err = r.do(r.endpoints.All()[i], method, path, body)
+		return err
+	}, unreachable, r.Ping)
+	return resp, err
+}
+
+// unreachable returns whether the error is that the server is unreachable,
+// rather than a response of eureka
+func unreachable(err error) bool {
+	_, ok := err.(*statusError)
+	return !ok
+}
+
+// do sends the request to the server, the response of non-2xx status is
+// returned as statusError
+func (r *EurekaAdapter) do(base, method, path string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.user != nil {
+		password, _ := r.user.Password()
+		req.SetBasicAuth(r.user.Username(), password)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(bs))}
+	}
+	return resp, nil
+}
@@ -0,0 +1,214 @@
+package eureka
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// server the stand-in of eureka server keeping the registered instances
+type server struct {
+	sync.Mutex
+	*httptest.Server
+	instances map[string]json.RawMessage
+	renewals  int
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{instances: make(map[string]json.RawMessage)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/eureka")
+		parts := strings.Split(strings.Trim(path, "/"), "/")
+
+		switch {
+		case r.Method == http.MethodGet && path == "/apps/delta":
+			w.Write([]byte(`{"applications":{}}`))
+		case r.Method == http.MethodGet && path == "/apps":
+			var apps []map[string]interface{}
+			for _, i := range s.instances {
+				apps = append(apps, map[string]interface{}{"name": "APP", "instance": i})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"applications": map[string]interface{}{"application": apps}})
+		case r.Method == http.MethodPost && len(parts) == 2:
+			var body struct {
+				Instance json.RawMessage `json:"instance"`
+			}
+			bs, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(bs, &body); err != nil {
+				t.Errorf("decode instance: %v", err)
+			}
+			var i instance
+			json.Unmarshal(body.Instance, &i)
+			s.instances[i.InstanceID] = body.Instance
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPut && len(parts) == 3:
+			if _, ok := s.instances[parts[2]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			s.renewals++
+		case r.Method == http.MethodDelete && len(parts) == 3:
+			if _, ok := s.instances[parts[2]]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(s.instances, parts[2])
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return s
+}
+
+func (s *server) instance(id string) *instance {
+	s.Lock()
+	defer s.Unlock()
+	raw, ok := s.instances[id]
+	if !ok {
+		return nil
+	}
+	i := new(instance)
+	json.Unmarshal(raw, i)
+	return i
+}
+
+func TestAdapter(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Name = "host-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	s := newServer(t)
+	defer s.Close()
+
+	uri, _ := url.Parse("eureka://admin:secret@" + strings.TrimPrefix(s.URL, "http://") + "/eureka")
+	r := new(Factory).New(uri).(*EurekaAdapter)
+	if !r.RequiresRefresh() {
+		t.Error("RequiresRefresh() = false")
+	}
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	service := &bridge.Service{
+		ID:              "[test]:web:8080",
+		Name:            "web",
+		Port:            8080,
+		Tags:            []string{"a", "b"},
+		Attrs:           map[string]string{"version": "1"},
+		TTL:             30,
+		RefreshInterval: 10,
+	}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	i := s.instance(service.ID)
+	if i == nil {
+		t.Fatal("instance is not registered")
+	}
+	if i.App != "WEB" || i.IPAddr != "10.0.0.5" || i.HostName != "host-1" || i.Port.Port != 8080 || !i.Port.Enabled {
+		t.Errorf("instance = %+v", i)
+	}
+	if i.LeaseInfo == nil || i.LeaseInfo.RenewalIntervalInSecs != 10 || i.LeaseInfo.DurationInSecs != 30 {
+		t.Errorf("lease info = %+v", i.LeaseInfo)
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 1 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if fields := bridge.Diff(service, services[0]); len(fields) != 0 {
+		t.Errorf("drifted fields = %v", fields)
+	}
+
+	if err := r.Refresh(service); err != nil || s.renewals != 1 {
+		t.Errorf("Refresh() = %v, renewals %d", err, s.renewals)
+	}
+
+	// deregistered by id only, e.g. cleanup
+	if err := r.Deregister(&bridge.Service{ID: service.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if s.instance(service.ID) != nil {
+		t.Error("instance is not deregistered")
+	}
+	if err := r.Deregister(service); err != nil {
+		t.Errorf("Deregister() of unknown instance = %v", err)
+	}
+
+	// registered again as eureka lost it
+	if err := r.Refresh(service); err != nil || s.instance(service.ID) == nil {
+		t.Errorf("Refresh() of lost instance = %v", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	preferred, fallback := newServer(t), newServer(t)
+	defer fallback.Close()
+
+	host := func(s *server) string { return strings.TrimPrefix(s.URL, "http://") }
+	uri, _ := url.Parse("eureka://admin:secret@" + host(preferred) + "," + host(fallback))
+	r := new(Factory).New(uri).(*EurekaAdapter)
+	if err := r.Ping(); err != nil || r.Endpoint() != preferred.URL+"/eureka" {
+		t.Fatalf("Ping() = %v, endpoint %s", err, r.Endpoint())
+	}
+
+	// the preferred server goes down between pings
+	preferred.Close()
+	service := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if fallback.instance(service.ID) == nil || r.Endpoint() != fallback.URL+"/eureka" {
+		t.Errorf("instance is not registered on the fallback server, endpoint %s", r.Endpoint())
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	uri, _ := url.Parse("eureka://" + strings.TrimPrefix(s.URL, "http://"))
+	r := new(Factory).New(uri).(*EurekaAdapter)
+	err := r.Ping()
+	if serr, ok := err.(*statusError); !ok || serr.status != http.StatusUnauthorized {
+		t.Errorf("Ping() = %v, want unauthorized", err)
+	}
+}
+
+func TestDefaultLease(t *testing.T) {
+	i := toInstance(&bridge.Service{ID: "x", Name: "x", Port: 1})
+	if !reflect.DeepEqual(i.LeaseInfo, &leaseInfo{RenewalIntervalInSecs: DefaultRenewalInterval, DurationInSecs: DefaultLeaseDuration}) {
+		t.Errorf("lease info = %+v", i.LeaseInfo)
+	}
+}
+
+func TestDecodeSingleObjects(t *testing.T) {
+	// some versions of eureka encode the lists of one element as objects
+	data := `{"applications":{"application":{"name":"WEB","instance":{"instanceId":"a","port":{"$":"80","@enabled":"true"}}}}}`
+	var apps applications
+	if err := json.Unmarshal([]byte(data), &apps); err != nil {
+		t.Fatal(err)
+	}
+	if len(apps.Applications.Application) != 1 || len(apps.Applications.Application[0].Instance) != 1 {
+		t.Fatalf("applications = %+v", apps)
+	}
+	if i := apps.Applications.Application[0].Instance[0]; i.InstanceID != "a" || i.Port.Port != 80 || !i.Port.Enabled {
+		t.Errorf("instance = %+v", i)
+	}
+}
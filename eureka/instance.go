@@ -0,0 +1,202 @@
+package eureka
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// metadata keys of the service fields which eureka instance doesn't keep,
+// the node one marks the instances owned by this node
+const (
+	metaNode    = "registrator.node"
+	metaName    = "registrator.name"
+	metaAddress = "registrator.address"
+	metaTags    = "registrator.tags"
+)
+
+// Defaults of the lease of instances If -ttl or -ttl-refresh is not set, they
+// are the defaults of eureka
+const (
+	DefaultLeaseDuration   = 90
+	DefaultRenewalInterval = 30
+)
+
+type instance struct {
+	InstanceID       string            `json:"instanceId"`
+	HostName         string            `json:"hostName"`
+	App              string            `json:"app"`
+	IPAddr           string            `json:"ipAddr"`
+	VIPAddress       string            `json:"vipAddress"`
+	SecureVIPAddress string            `json:"secureVipAddress"`
+	Status           string            `json:"status"`
+	Port             port              `json:"port"`
+	SecurePort       port              `json:"securePort"`
+	DataCenterInfo   dataCenterInfo    `json:"dataCenterInfo"`
+	LeaseInfo        *leaseInfo        `json:"leaseInfo,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type port struct {
+	Port    int
+	Enabled bool
+}
+
+// MarshalJSON encodes port in the form {"$": 8080, "@enabled": "true"}
+func (p port) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"$":        p.Port,
+		"@enabled": strconv.FormatBool(p.Enabled),
+	})
+}
+
+// UnmarshalJSON accepts the port and enabled as either string or literal, as
+// they differ among the versions of eureka
+func (p *port) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Port    json.RawMessage `json:"$"`
+		Enabled json.RawMessage `json:"@enabled"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Port, _ = strconv.Atoi(strings.Trim(string(raw.Port), `"`))
+	p.Enabled, _ = strconv.ParseBool(strings.Trim(string(raw.Enabled), `"`))
+	return nil
+}
+
+type dataCenterInfo struct {
+	Class string `json:"@class"`
+	Name  string `json:"name"`
+}
+
+type leaseInfo struct {
+	RenewalIntervalInSecs int `json:"renewalIntervalInSecs"`
+	DurationInSecs        int `json:"durationInSecs"`
+}
+
+type application struct {
+	Name     string    `json:"name"`
+	Instance instances `json:"instance"`
+}
+
+type applications struct {
+	Applications struct {
+		Application applicationList `json:"application"`
+	} `json:"applications"`
+}
+
+// instances instance list which is encoded as a single object by some
+// versions of eureka If there is only one
+type instances []*instance
+
+func (l *instances) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		i := new(instance)
+		if err := json.Unmarshal(data, i); err != nil {
+			return err
+		}
+		*l = instances{i}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]*instance)(l))
+}
+
+// applicationList application list which is encoded as a single object by
+// some versions of eureka If there is only one
+type applicationList []*application
+
+func (l *applicationList) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		a := new(application)
+		if err := json.Unmarshal(data, a); err != nil {
+			return err
+		}
+		*l = applicationList{a}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]*application)(l))
+}
+
+// appName returns the eureka app name of service, eureka keeps it in upper case
+func appName(name string) string {
+	return strings.ToUpper(name)
+}
+
+// toInstance converts bridge service to eureka instance, the service fields
+// which eureka doesn't keep are kept in metadata besides the attrs
+func toInstance(service *bridge.Service) *instance {
+	address := service.IP
+	if address == "" {
+		address = bridge.LocalNode.Address
+	}
+
+	metadata := make(map[string]string, len(service.Attrs)+4)
+	for k, v := range service.Attrs {
+		metadata[k] = v
+	}
+	metadata[metaNode] = bridge.LocalNode.ID
+	metadata[metaName] = service.Name
+	if service.IP != "" {
+		metadata[metaAddress] = service.IP
+	}
+	if len(service.Tags) > 0 {
+		metadata[metaTags] = strings.Join(service.Tags, ",")
+	}
+
+	duration := service.TTL
+	if duration <= 0 {
+		duration = DefaultLeaseDuration
+	}
+	interval := service.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRenewalInterval
+	}
+
+	return &instance{
+		InstanceID:       service.ID,
+		HostName:         bridge.LocalNode.Name,
+		App:              appName(service.Name),
+		IPAddr:           address,
+		VIPAddress:       service.Name,
+		SecureVIPAddress: service.Name,
+		Status:           "UP",
+		Port:             port{Port: service.Port, Enabled: true},
+		SecurePort:       port{Port: 443},
+		DataCenterInfo: dataCenterInfo{
+			Class: "com.netflix.appinfo.InstanceInfo$DefaultDataCenterInfo",
+			Name:  "MyOwn",
+		},
+		LeaseInfo: &leaseInfo{
+			RenewalIntervalInSecs: interval,
+			DurationInSecs:        duration,
+		},
+		Metadata: metadata,
+	}
+}
+
+// toService converts eureka instance to bridge service, it's the reverse of toInstance
+func toService(i *instance) *bridge.Service {
+	service := &bridge.Service{
+		ID:   i.InstanceID,
+		Name: i.Metadata[metaName],
+		Port: i.Port.Port,
+		IP:   i.Metadata[metaAddress],
+	}
+	if tags := i.Metadata[metaTags]; tags != "" {
+		service.Tags = strings.Split(tags, ",")
+	}
+	for k, v := range i.Metadata {
+		switch k {
+		case metaNode, metaName, metaAddress, metaTags:
+			continue
+		}
+		if service.Attrs == nil {
+			service.Attrs = make(map[string]string)
+		}
+		service.Attrs[k] = v
+	}
+	return service
+}
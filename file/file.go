@@ -0,0 +1,190 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "file")
+
+func init() {
+	bridge.Register(new(Factory), "file")
+}
+
+type Factory struct{}
+
+// New returns the source of service definition config dir, e.g. file:///etc/registrator
+func (f *Factory) New(uri *url.URL) bridge.Source {
+	dir := uri.Path
+	if uri.Host != "" {
+		// relative path, e.g. file://conf.d
+		dir = uri.Host + uri.Path
+	}
+	if dir == "" {
+		log.Fatal("file: config dir is required, e.g. file:///etc/registrator")
+	}
+	return &Source{dir: dir}
+}
+
+// Source service definition files in config dir, include config file must be end in the '.json'
+type Source struct {
+	dir string
+}
+
+func (s *Source) Services() (map[string]*bridge.Service, error) {
+	paths, err := bridge.RecursiveFilesLookup(s.dir, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]*bridge.Service, len(paths))
+	for _, path := range paths {
+		if !isDefinition(path) {
+			continue
+		}
+		service, err := newService(path)
+		if err != nil {
+			log.Errorf("new service with file %s failed, ignored: %v", path, err)
+			continue
+		}
+		services[path] = service
+	}
+
+	return services, nil
+}
+
+func (s *Source) Watch(events chan<- *bridge.SourceEvent, stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("fsnotify: create watcher failed: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	// watched dirs, the ones created later are watched as well
+	watched := make(map[string]bool)
+	if err := watch(watcher, s.dir, watched); err != nil {
+		log.Errorf("fsnotify: %v", err)
+		return
+	}
+
+	log.Infof("listening for fsnotify events ...")
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			log.Debugf("fsnotify: received event: %v", event)
+			var sourceEvent *bridge.SourceEvent
+			switch {
+			case event.Op&fsnotify.Create == fsnotify.Create && isDir(event.Name):
+				if err := watch(watcher, event.Name, watched); err != nil {
+					log.Errorf("fsnotify: %v", err)
+				}
+				// the definitions may have been created before it's watched
+				sourceEvent = &bridge.SourceEvent{Type: bridge.EventResync}
+			case event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 && watched[event.Name]:
+				for dir := range watched {
+					if dir == event.Name || strings.HasPrefix(dir, event.Name+string(filepath.Separator)) {
+						delete(watched, dir)
+						watcher.Remove(dir)
+					}
+				}
+				// the definitions in it are gone without events If it's moved away
+				sourceEvent = &bridge.SourceEvent{Type: bridge.EventResync}
+			case !isDefinition(event.Name):
+				// ignore invalid file, like vim .swap
+				continue
+			case event.Op&fsnotify.Create == fsnotify.Create:
+				service, err := newService(event.Name)
+				if err != nil {
+					log.Warnf("new service with file %s failed, ignored: %v", event.Name, err)
+					continue
+				}
+				sourceEvent = &bridge.SourceEvent{Type: bridge.EventAdd, Key: event.Name, Service: service}
+			case event.Op&fsnotify.Write == fsnotify.Write:
+				// the file may be written partially, e.g. by editors, the last
+				// valid definition is kept until the file is valid or removed
+				service, err := newService(event.Name)
+				if err != nil {
+					log.Warnf("new service with file %s failed, keep the last valid one: %v", event.Name, err)
+					continue
+				}
+				sourceEvent = &bridge.SourceEvent{Type: bridge.EventUpdate, Key: event.Name, Service: service}
+			case event.Op&fsnotify.Rename == fsnotify.Rename, event.Op&fsnotify.Remove == fsnotify.Remove:
+				sourceEvent = &bridge.SourceEvent{Type: bridge.EventRemove, Key: event.Name}
+			default:
+				log.Debugf("fsnotify: ignore event: %v", event)
+				continue
+			}
+
+			select {
+			case events <- sourceEvent:
+			case <-stop:
+				return
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("fsnotify: watcher failed: %v", err)
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watch watches dir and its subdirs, they are looked up again until no more
+// is found, as the subdirs created before their parents are watched are
+// notified by no event
+func watch(watcher *fsnotify.Watcher, dir string, watched map[string]bool) error {
+	for {
+		dirs, err := bridge.RecursiveDirsLookup(dir, "*")
+		if err != nil {
+			return fmt.Errorf("lookup dirs of %s failed: %v", dir, err)
+		}
+		added := false
+		for _, dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				return fmt.Errorf("watch %s failed: %v", dir, err)
+			}
+			watched[dir] = true
+			added = true
+		}
+		if !added {
+			return nil
+		}
+	}
+}
+
+func isDir(path string) bool {
+	dir, err := bridge.IsDirectory(path)
+	return err == nil && dir
+}
+
+// isDefinition returns whether the file is a service definition
+func isDefinition(path string) bool {
+	return filepath.Ext(path) == ".json" && filepath.Base(path) != bridge.StorageName
+}
+
+func newService(path string) (*bridge.Service, error) {
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bridge.ParseService(configBytes)
+}
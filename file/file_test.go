@@ -0,0 +1,144 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+func newSource(t *testing.T) (*Source, string) {
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &Source{dir: dir}, dir
+}
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServices(t *testing.T) {
+	s, dir := newSource(t)
+	os.Mkdir(filepath.Join(dir, "web"), 0755)
+	write(t, filepath.Join(dir, "db.json"), `{"name": "db", "port": 5432}`)
+	write(t, filepath.Join(dir, "web", "web.json"), `{"name": "web", "port": 80}`)
+	write(t, filepath.Join(dir, "broken.json"), `{"name": `)
+	write(t, filepath.Join(dir, "notes.txt"), `{"name": "notes"}`)
+	write(t, filepath.Join(dir, bridge.StorageName), `{}`)
+
+	services, err := s.Services()
+	if err != nil {
+		t.Fatalf("Services() = %v", err)
+	}
+	if len(services) != 2 || services[filepath.Join(dir, "db.json")] == nil || services[filepath.Join(dir, "web", "web.json")] == nil {
+		t.Errorf("Services() = %v", services)
+	}
+}
+
+// watchEvents returns the events of source until the test ends
+func watchEvents(t *testing.T, s *Source) <-chan *bridge.SourceEvent {
+	events := make(chan *bridge.SourceEvent, 16)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go s.Watch(events, stop)
+	// the watches are added asynchronously
+	time.Sleep(100 * time.Millisecond)
+	return events
+}
+
+// next returns the next event of the key, nil If none in time
+func next(events <-chan *bridge.SourceEvent, key string, timeout time.Duration) *bridge.SourceEvent {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-events:
+			if event.Key == key {
+				return event
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// settle drops the following events of the key, e.g. the ones of a write in
+// several syscalls
+func settle(events <-chan *bridge.SourceEvent, key string) {
+	for next(events, key, 200*time.Millisecond) != nil {
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s, dir := newSource(t)
+	events := watchEvents(t, s)
+	path := filepath.Join(dir, "web.json")
+
+	// the create may be seen empty, then the definition comes with the write
+	write(t, path, `{"name": "web", "port": 80}`)
+	if event := next(events, path, time.Second); event == nil || (event.Type != bridge.EventAdd && event.Type != bridge.EventUpdate) || event.Service.Port != 80 {
+		t.Fatalf("event on create = %+v", event)
+	}
+	settle(events, path)
+
+	write(t, path, `{"name": "web", "port": 8080}`)
+	event := next(events, path, time.Second)
+	if event == nil || (event.Type != bridge.EventUpdate && event.Type != bridge.EventAdd) || event.Service.Port != 8080 {
+		t.Fatalf("event on modify = %+v", event)
+	}
+	settle(events, path)
+
+	// the partial write is ignored rather than removing the service
+	write(t, path, `{"name": "web", `)
+	if event := next(events, path, 300*time.Millisecond); event != nil {
+		t.Fatalf("event on invalid write = %+v", event)
+	}
+
+	os.Remove(path)
+	if event := next(events, path, time.Second); event == nil || event.Type != bridge.EventRemove {
+		t.Fatalf("event on delete = %+v", event)
+	}
+}
+
+func TestWatchNewDir(t *testing.T) {
+	s, dir := newSource(t)
+	events := watchEvents(t, s)
+
+	// the definitions of the dir created later are resynced and watched
+	sub := filepath.Join(dir, "web")
+	if err := os.MkdirAll(filepath.Join(sub, "api"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(events, "", time.Second); event == nil || event.Type != bridge.EventResync {
+		t.Fatalf("event on mkdir = %+v", event)
+	}
+	// the nested dir may be watched on its own create
+	settle(events, "")
+	path := filepath.Join(sub, "api", "api.json")
+	// the create may be seen empty, then the definition comes with the write
+	write(t, path, `{"name": "api", "port": 80}`)
+	if event := next(events, path, time.Second); event == nil || (event.Type != bridge.EventAdd && event.Type != bridge.EventUpdate) {
+		t.Fatalf("event on create in new dir = %+v", event)
+	}
+
+	// the dir moved away is resynced as its definitions are gone without events
+	if err := os.Rename(sub, filepath.Join(filepath.Dir(dir), filepath.Base(dir)+"-moved")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Join(filepath.Dir(dir), filepath.Base(dir)+"-moved"))
+	if event := next(events, "", time.Second); event == nil || event.Type != bridge.EventResync {
+		t.Fatalf("event on moving dir away = %+v", event)
+	}
+	services, _ := s.Services()
+	if len(services) != 0 {
+		t.Errorf("Services() = %v", services)
+	}
+}
@@ -0,0 +1,362 @@
+package filesd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "filesd")
+
+func init() {
+	bridge.Register(new(Factory), "file-sd")
+}
+
+// Hidden labels of target groups, labels prefixed with __ are available in
+// relabeling and dropped by prometheus after it
+const (
+	// idLabel the id of registered service
+	idLabel = "__meta_registrator_service_id"
+	// attrLabelPrefix prefix of the labels of attrs with meta-attrs option,
+	// e.g. __meta_registrator_attr_version
+	attrLabelPrefix = "__meta_registrator_attr_"
+)
+
+// labels of target groups which are not attrs
+const (
+	serviceLabel = "service"
+	tagsLabel    = "tags"
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type Factory struct{}
+
+// New returns the adapter maintaining prometheus file_sd target file, e.g.
+// file-sd:///etc/prometheus/targets/registrator.json, or one file per service
+// name in the dir with per-service option, e.g.
+// file-sd:///etc/prometheus/targets?per-service=true. The attrs are written
+// as hidden labels instead of target labels with meta-attrs option
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	if uri.Path == "" {
+		log.Fatal("filesd: path of target file is required, e.g. file-sd:///etc/prometheus/targets/registrator.json")
+	}
+
+	r := &FileSDAdapter{
+		path:       uri.Path,
+		perService: uri.Query().Get("per-service") == "true",
+		groups:     make(map[string]*targetGroup),
+	}
+	if uri.Query().Get("meta-attrs") == "true" {
+		r.attrPrefix = attrLabelPrefix
+	}
+	if err := r.load(); err != nil {
+		log.Fatalf("filesd: load %s failed: %v", r.path, err)
+	}
+	return r
+}
+
+// FileSDAdapter registers services as the target groups of prometheus file_sd,
+// the tags are mapped to the tags label in the form ,tag1,tag2, and the attrs
+// are mapped to the labels of their names with invalid characters replaced by
+// _, or the __meta_registrator_attr_<name> ones with meta-attrs option. Only
+// the groups of this node are managed, the other groups of target files are
+// kept as they are
+type FileSDAdapter struct {
+	sync.Mutex
+	path       string
+	perService bool
+	// attrPrefix prefix of the labels of attrs, empty If written as target labels
+	attrPrefix string
+	// target groups of this node keyed by service id
+	groups map[string]*targetGroup
+}
+
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Ping checks whether the dir of target files is accessible
+func (r *FileSDAdapter) Ping() error {
+	_, err := os.Stat(r.dir())
+	return err
+}
+
+func (r *FileSDAdapter) Register(service *bridge.Service) error {
+	group := r.newTargetGroup(service)
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.groups[service.ID] = group
+	return r.flush(service.Name)
+}
+
+func (r *FileSDAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+
+	group, ok := r.groups[service.ID]
+	if !ok {
+		return nil
+	}
+	delete(r.groups, service.ID)
+	return r.flush(group.Labels[serviceLabel])
+}
+
+// Refresh target files don't expire
+func (r *FileSDAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services returns the services in target files, reading them back so that
+// the ones written by earlier runs can be cleaned up
+func (r *FileSDAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	services := make([]*bridge.Service, 0, len(r.groups))
+	for _, group := range r.groups {
+		if service := r.toService(group); service != nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// Normalize returns the service as it's written, the address defaults to the
+// one of local node, the names of attrs are valid label names without the ones
+// which can't be written, and the checks are not kept
+func (r *FileSDAdapter) Normalize(service *bridge.Service) *bridge.Service {
+	normalized := *service
+	normalized.IP = host(service)
+	normalized.Checks = nil
+	if len(service.Attrs) > 0 {
+		normalized.Attrs = make(map[string]string, len(service.Attrs))
+		for k, v := range service.Attrs {
+			if _, ok := r.attrLabel(k); ok {
+				normalized.Attrs[labelName(k)] = v
+			}
+		}
+	}
+	return &normalized
+}
+
+// attrLabel returns the label of attr name, false If it would clash with the
+// service, tags or hidden labels
+func (r *FileSDAdapter) attrLabel(name string) (string, bool) {
+	name = labelName(name)
+	if r.attrPrefix != "" {
+		return r.attrPrefix + name, true
+	}
+	if name == serviceLabel || name == tagsLabel || strings.HasPrefix(name, "__") {
+		return "", false
+	}
+	return name, true
+}
+
+// host returns the host of target, the address of service defaults to local node
+func host(service *bridge.Service) string {
+	if service.IP != "" {
+		return service.IP
+	}
+	if bridge.LocalNode.Address != "" {
+		return bridge.LocalNode.Address
+	}
+	return bridge.LocalNode.Name
+}
+
+func (r *FileSDAdapter) newTargetGroup(service *bridge.Service) *targetGroup {
+	labels := make(map[string]string, len(service.Attrs)+3)
+	for k, v := range service.Attrs {
+		label, ok := r.attrLabel(k)
+		if !ok {
+			log.Warnf("filesd: attr %s of %s clashes with the labels of registrator, skipped", k, service.ID)
+			continue
+		}
+		labels[label] = v
+	}
+	labels[serviceLabel] = service.Name
+	if len(service.Tags) > 0 {
+		labels[tagsLabel] = "," + strings.Join(service.Tags, ",") + ","
+	}
+	labels[idLabel] = service.ID
+
+	// checks are not kept as prometheus doesn't run them
+	return &targetGroup{
+		Targets: []string{net.JoinHostPort(host(service), strconv.Itoa(service.Port))},
+		Labels:  labels,
+	}
+}
+
+// toService converts target group to service, it's the reverse of
+// newTargetGroup, nil If the group is not written by registrator
+func (r *FileSDAdapter) toService(group *targetGroup) *bridge.Service {
+	id := group.Labels[idLabel]
+	if id == "" || len(group.Targets) != 1 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(group.Targets[0])
+	if err != nil {
+		return nil
+	}
+
+	service := &bridge.Service{
+		ID:   id,
+		Name: group.Labels[serviceLabel],
+		IP:   host,
+	}
+	service.Port, _ = strconv.Atoi(port)
+	if tags := strings.Trim(group.Labels[tagsLabel], ","); tags != "" {
+		service.Tags = strings.Split(tags, ",")
+	}
+	for k, v := range group.Labels {
+		var name string
+		if r.attrPrefix != "" && strings.HasPrefix(k, r.attrPrefix) {
+			name = strings.TrimPrefix(k, r.attrPrefix)
+		} else if r.attrPrefix == "" && k != serviceLabel && k != tagsLabel && !strings.HasPrefix(k, "__") {
+			name = k
+		} else {
+			continue
+		}
+		if service.Attrs == nil {
+			service.Attrs = make(map[string]string)
+		}
+		service.Attrs[name] = v
+	}
+	return service
+}
+
+// labelName returns the valid prometheus label name
+func labelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func (r *FileSDAdapter) dir() string {
+	if r.perService {
+		return r.path
+	}
+	return filepath.Dir(r.path)
+}
+
+// file returns the target file of service name
+func (r *FileSDAdapter) file(name string) string {
+	if r.perService {
+		return filepath.Join(r.path, labelName(name)+".json")
+	}
+	return r.path
+}
+
+// load loads the target groups written by registrator on this node from target files
+func (r *FileSDAdapter) load() error {
+	files := []string{r.path}
+	if r.perService {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(r.path, "*.json")); err != nil {
+			return err
+		}
+	}
+
+	groups := make(map[string]*targetGroup)
+	for _, file := range files {
+		fileGroups, err := readGroups(file)
+		if err != nil {
+			return err
+		}
+		for _, group := range fileGroups {
+			if id := group.Labels[idLabel]; bridge.IsLocalServiceID(id) {
+				groups[id] = group
+			}
+		}
+	}
+	r.groups = groups
+	return nil
+}
+
+// readGroups reads the target groups of file, none If it doesn't exist
+func readGroups(file string) ([]*targetGroup, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var groups []*targetGroup
+	if err := json.Unmarshal(bs, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return groups, nil
+}
+
+// flush writes the target file of service name atomically, the groups which
+// are not written by this node, e.g. the ones of other nodes sharing the file
+// or written by hand, are read again and kept. The target file of per-service
+// mode is removed once it's empty
+func (r *FileSDAdapter) flush(name string) error {
+	file := r.file(name)
+
+	current, err := readGroups(file)
+	if err != nil {
+		return err
+	}
+	groups := make([]*targetGroup, 0, len(current))
+	for _, group := range current {
+		if !bridge.IsLocalServiceID(group.Labels[idLabel]) {
+			groups = append(groups, group)
+		}
+	}
+	for _, group := range r.groups {
+		if r.file(group.Labels[serviceLabel]) == file {
+			groups = append(groups, group)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return firstTarget(groups[i]) < firstTarget(groups[j])
+	})
+
+	if len(groups) == 0 && r.perService {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func firstTarget(group *targetGroup) string {
+	if len(group.Targets) == 0 {
+		return ""
+	}
+	return group.Targets[0]
+}
@@ -0,0 +1,197 @@
+package filesd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+func TestRegister(t *testing.T) {
+	bridge.HardwareID = "test"
+	bridge.LocalNode.Address = "10.0.0.5"
+	dir, err := ioutil.TempDir("", "filesd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrator.json")
+
+	r := &FileSDAdapter{path: path, groups: make(map[string]*targetGroup)}
+	service := &bridge.Service{
+		ID:     "[test]:node:9100",
+		Name:   "node",
+		Port:   9100,
+		Tags:   []string{"linux", "exporter"},
+		Attrs:  map[string]string{"job": "node", "team.name": "infra", "service": "clash"},
+		Checks: []*bridge.Check{{HTTP: "http://127.0.0.1:9100/metrics"}},
+	}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+
+	var groups []*targetGroup
+	bs, _ := ioutil.ReadFile(path)
+	if err := json.Unmarshal(bs, &groups); err != nil || len(groups) != 1 {
+		t.Fatalf("target file = %s", bs)
+	}
+	expected := &targetGroup{
+		Targets: []string{"10.0.0.5:9100"},
+		Labels: map[string]string{
+			"service":                       "node",
+			"tags":                          ",linux,exporter,",
+			"__meta_registrator_service_id": service.ID,
+			"job":                           "node",
+			"team_name":                     "infra",
+		},
+	}
+	if !reflect.DeepEqual(groups[0], expected) {
+		t.Errorf("target group = %s", bs)
+	}
+
+	// read back by a new adapter, e.g. after restart
+	r = &FileSDAdapter{path: path, groups: make(map[string]*targetGroup)}
+	services, err := r.Services()
+	if err != nil || len(services) != 1 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if fields := bridge.Diff(r.Normalize(service), services[0]); len(fields) != 0 {
+		t.Errorf("drifted fields = %v", fields)
+	}
+	if service.IP != "" || service.Attrs["team.name"] != "infra" {
+		t.Error("Normalize() modified service")
+	}
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if services, _ := r.Services(); len(services) != 0 {
+		t.Errorf("Services() after Deregister() = %v", services)
+	}
+}
+
+func TestMetaAttrs(t *testing.T) {
+	bridge.HardwareID = "test"
+	bridge.LocalNode.Address = "10.0.0.5"
+	dir, err := ioutil.TempDir("", "filesd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrator.json")
+
+	uri, _ := url.Parse("file-sd://" + path + "?meta-attrs=true")
+	r := new(Factory).New(uri).(*FileSDAdapter)
+	service := &bridge.Service{ID: "[test]:node:9100", Name: "node", Port: 9100, Attrs: map[string]string{"job": "node", "service": "x"}}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	group := r.groups[service.ID]
+	if group.Labels["__meta_registrator_attr_job"] != "node" || group.Labels["__meta_registrator_attr_service"] != "x" || group.Labels["job"] != "" {
+		t.Errorf("labels = %v", group.Labels)
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 1 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if fields := bridge.Diff(r.Normalize(service), services[0]); len(fields) != 0 {
+		t.Errorf("drifted fields = %v", fields)
+	}
+}
+
+func TestOtherGroupsKept(t *testing.T) {
+	bridge.HardwareID = "test"
+	bridge.LocalNode.Address = "10.0.0.5"
+	dir, err := ioutil.TempDir("", "filesd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrator.json")
+
+	// written by hand and by the registrator of another node sharing the file
+	other := `[
+  {"targets": ["10.0.0.9:9100"], "labels": {"service": "node", "__meta_registrator_service_id": "[other]:node:9100"}},
+  {"targets": ["10.0.0.1:9090"], "labels": {"job": "prometheus"}}
+]`
+	if err := ioutil.WriteFile(path, []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("file-sd://" + path)
+	r := new(Factory).New(uri).(*FileSDAdapter)
+	if services, _ := r.Services(); len(services) != 0 {
+		t.Errorf("Services() of other groups = %v", services)
+	}
+
+	service := &bridge.Service{ID: "[test]:node:9100", Name: "node", Port: 9100}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	// the groups written meanwhile are kept too
+	var groups []*targetGroup
+	bs, _ := ioutil.ReadFile(path)
+	json.Unmarshal(bs, &groups)
+	groups = append(groups, &targetGroup{Targets: []string{"10.0.0.8:9100"}, Labels: map[string]string{idLabel: "[another]:node:9100"}})
+	bs, _ = json.Marshal(groups)
+	ioutil.WriteFile(path, bs, 0644)
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	groups = nil
+	bs, _ = ioutil.ReadFile(path)
+	if err := json.Unmarshal(bs, &groups); err != nil || len(groups) != 3 {
+		t.Fatalf("target file = %s", bs)
+	}
+	for _, group := range groups {
+		if group.Labels[idLabel] == service.ID {
+			t.Errorf("deregistered group is kept: %s", bs)
+		}
+	}
+}
+
+func TestPerService(t *testing.T) {
+	bridge.HardwareID = "test"
+	bridge.LocalNode.Address = "10.0.0.5"
+	dir, err := ioutil.TempDir("", "filesd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &FileSDAdapter{path: dir, perService: true, groups: make(map[string]*targetGroup)}
+	service := &bridge.Service{ID: "[test]:mysql:9104", Name: "mysql-exporter", IP: "10.0.0.6", Port: 9104}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	file := filepath.Join(dir, "mysql_exporter.json")
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("target file of service: %v", err)
+	}
+
+	if err := r.Deregister(service); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("empty target file is not removed: %v", err)
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"version":   "version",
+		"team.name": "team_name",
+		"1st":       "_1st",
+		"":          "_",
+	} {
+		if got := labelName(name); got != expected {
+			t.Errorf("labelName(%q) = %s, want %s", name, got, expected)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const requestTimeout = 10 * time.Second
+
+// inClusterNS namespace of the service account mounted in pods
+const inClusterNS = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// newInClusterClient returns the client with the service account of pod, and
+// the namespace of the service account
+func newInClusterClient() (kubeclient.Interface, string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace := "default"
+	if bs, err := ioutil.ReadFile(inClusterNS); err == nil && len(strings.TrimSpace(string(bs))) > 0 {
+		namespace = strings.TrimSpace(string(bs))
+	}
+	return newClient(config, namespace)
+}
+
+// newKubeconfigClient returns the client with the context of kubeconfig, the
+// current context If context is empty, and the namespace of the context.
+// path is the explicit kubeconfig, KUBECONFIG or ~/.kube/config If empty
+func newKubeconfigClient(path, context string) (kubeclient.Interface, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = path
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	return newClient(config, namespace)
+}
+
+func newClient(config *rest.Config, namespace string) (kubeclient.Interface, string, error) {
+	config.Timeout = requestTimeout
+	config.UserAgent = "registrator"
+	clientset, err := kubeclient.NewForConfig(config)
+	if err != nil {
+		return nil, "", err
+	}
+	return clientset, namespace, nil
+}
+
+// inCluster returns whether running in a pod
+func inCluster() bool {
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != ""
+}
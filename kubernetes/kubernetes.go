@@ -0,0 +1,364 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	kubeclient "k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	typeddiscoveryv1 "k8s.io/client-go/kubernetes/typed/discovery/v1"
+)
+
+var log = logrus.WithField("component", "kubernetes")
+
+// labels and annotations of the objects managed by registrator
+const (
+	labelServiceName = "kubernetes.io/service-name"
+	labelManagedBy   = "endpointslice.kubernetes.io/managed-by"
+	labelAppManaged  = "app.kubernetes.io/managed-by"
+	labelNode        = "registrator/node"
+	annotationSvc    = "registrator/service"
+	managedBy        = "registrator"
+	// portName name of the port of Service and EndpointSlices, which maps
+	// the port of Service to the ones of endpoints
+	portName = "service"
+)
+
+var (
+	invalidNameChars  = regexp.MustCompile(`[^a-z0-9-]`)
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+)
+
+func init() {
+	bridge.Register(new(Factory), "kubernetes")
+}
+
+type Factory struct{}
+
+// New returns the kubernetes adapter, e.g. kubernetes://?namespace=edge. It
+// uses the service account If running in cluster, otherwise the kubeconfig
+// of kubeconfig option, KUBECONFIG or ~/.kube/config
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+
+	var client kubeclient.Interface
+	var namespace string
+	var err error
+	kubeconfig := query.Get("kubeconfig")
+	if kubeconfig == "" && inCluster() {
+		client, namespace, err = newInClusterClient()
+	} else {
+		client, namespace, err = newKubeconfigClient(kubeconfig, query.Get("context"))
+	}
+	if err != nil {
+		log.Fatalf("kubernetes: %v", err)
+	}
+
+	if ns := query.Get("namespace"); ns != "" {
+		namespace = ns
+	}
+	return &KubernetesAdapter{client: client, namespace: namespace}
+}
+
+// KubernetesAdapter publishes services as selector-less kubernetes Services,
+// so they are reachable by in-cluster consumers. The Service is named after
+// the service name, each service registered by this node is an EndpointSlice
+// of it with one endpoint, labelled with the node id.
+type KubernetesAdapter struct {
+	client    kubeclient.Interface
+	namespace string
+}
+
+// Ping lists the EndpointSlices of namespace, which requires the permission
+// the adapter needs
+func (r *KubernetesAdapter) Ping() error {
+	_, err := r.slices().List(context.Background(), metav1.ListOptions{Limit: 1})
+	return err
+}
+
+// Register ensures the Service of service name, and creates or replaces the
+// EndpointSlice of service
+func (r *KubernetesAdapter) Register(service *bridge.Service) error {
+	if err := r.ensureService(service); err != nil {
+		return err
+	}
+
+	slice, err := r.endpointSlice(service)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("kubernetes: apply endpointslice %s", slice.Name)
+	ctx := context.Background()
+	_, err = r.slices().Create(ctx, slice, metav1.CreateOptions{})
+	if !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	// replace the existing one
+	current, err := r.slices().Get(ctx, slice.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	slice.ResourceVersion = current.ResourceVersion
+	_, err = r.slices().Update(ctx, slice, metav1.UpdateOptions{})
+	return err
+}
+
+// Deregister deletes the EndpointSlice of service, and the Service once it
+// has no EndpointSlice
+func (r *KubernetesAdapter) Deregister(service *bridge.Service) error {
+	owned, err := r.owned()
+	if err != nil {
+		return err
+	}
+	slice, ok := owned[service.ID]
+	if !ok {
+		return nil
+	}
+
+	log.Debugf("kubernetes: delete endpointslice %s", slice.Name)
+	ctx := context.Background()
+	err = r.slices().Delete(ctx, slice.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	name := slice.Labels[labelServiceName]
+	rest, err := r.slices().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelServiceName: name}).String(),
+	})
+	if err != nil {
+		return err
+	}
+	if len(rest.Items) > 0 {
+		return nil
+	}
+
+	// keep the Service which is not created by registrator
+	svc, err := r.services().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if svc.Labels[labelAppManaged] != managedBy {
+		return nil
+	}
+	log.Debugf("kubernetes: delete service %s", name)
+	err = r.services().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Refresh objects don't expire
+func (r *KubernetesAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services returns the services of the EndpointSlices labelled with this node
+func (r *KubernetesAdapter) Services() ([]*bridge.Service, error) {
+	owned, err := r.owned()
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*bridge.Service, 0, len(owned))
+	for _, slice := range owned {
+		service := new(bridge.Service)
+		if err := json.Unmarshal([]byte(slice.Annotations[annotationSvc]), service); err != nil {
+			continue
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// owned returns the EndpointSlices of this node keyed by service id
+func (r *KubernetesAdapter) owned() (map[string]*discoveryv1.EndpointSlice, error) {
+	list, err := r.slices().List(context.Background(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelManagedBy: managedBy, labelNode: nodeLabel()}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[string]*discoveryv1.EndpointSlice, len(list.Items))
+	for i := range list.Items {
+		slice := &list.Items[i]
+		var service bridge.Service
+		if err := json.Unmarshal([]byte(slice.Annotations[annotationSvc]), &service); err != nil || service.ID == "" {
+			log.Warnf("kubernetes: invalid annotation of endpointslice %s: %v", slice.Name, err)
+			continue
+		}
+		owned[service.ID] = slice
+	}
+	return owned, nil
+}
+
+// ensureService creates the selector-less Service of service name unless it
+// exists. The port of Service is the lowest one of the registered services of
+// the name, so it doesn't depend on the order of registration, and it's lowered
+// as a service with a lower port is registered
+func (r *KubernetesAdapter) ensureService(service *bridge.Service) error {
+	name := serviceName(service.Name)
+	port, err := r.servicePort(name, service.Port)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	svc, err := r.services().Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		if svc.Labels[labelAppManaged] != managedBy {
+			// keep the Service which is not created by registrator
+			return nil
+		}
+		if len(svc.Spec.Ports) == 1 && svc.Spec.Ports[0].Name == portName && svc.Spec.Ports[0].Port == port {
+			return nil
+		}
+		log.Debugf("kubernetes: update port of service %s to %d", name, port)
+		patch, _ := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{"ports": servicePorts(port)},
+		})
+		_, err = r.services().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	svc = &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: r.namespace,
+			Labels:    map[string]string{labelAppManaged: managedBy},
+		},
+		Spec: corev1.ServiceSpec{Ports: servicePorts(port)},
+	}
+
+	log.Debugf("kubernetes: create service %s", name)
+	_, err = r.services().Create(ctx, svc, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		// created by another node meanwhile, the port is lowered on the next registration
+		return nil
+	}
+	return err
+}
+
+// servicePort returns the lowest port of the EndpointSlices of Service name
+// and the port of the service being registered
+func (r *KubernetesAdapter) servicePort(name string, port int) (int32, error) {
+	list, err := r.slices().List(context.Background(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{labelServiceName: name}).String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	lowest := int32(port)
+	for _, slice := range list.Items {
+		for _, p := range slice.Ports {
+			if p.Port != nil && *p.Port > 0 && *p.Port < lowest {
+				lowest = *p.Port
+			}
+		}
+	}
+	return lowest, nil
+}
+
+// endpointSlice returns the EndpointSlice of service, the service is kept in
+// the annotation so that it can be listed for cleanup
+func (r *KubernetesAdapter) endpointSlice(service *bridge.Service) (*discoveryv1.EndpointSlice, error) {
+	address := service.IP
+	if address == "" {
+		address = bridge.LocalNode.Address
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("kubernetes: invalid address %q of %s", address, service.ID)
+	}
+	addressType := discoveryv1.AddressTypeIPv4
+	if ip.To4() == nil {
+		addressType = discoveryv1.AddressTypeIPv6
+	}
+
+	s := *service
+	s.Checks = nil
+	s.TTL = 0
+	definition, err := json.Marshal(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	name := serviceName(service.Name)
+	sum := sha1.Sum([]byte(service.ID))
+	ready := true
+	port, protocol, pname := int32(service.Port), corev1.ProtocolTCP, portName
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%x", name, sum[:5]),
+			Namespace: r.namespace,
+			Labels: map[string]string{
+				labelServiceName: name,
+				labelManagedBy:   managedBy,
+				labelNode:        nodeLabel(),
+			},
+			Annotations: map[string]string{annotationSvc: string(definition)},
+		},
+		AddressType: addressType,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{ip.String()},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		}},
+		Ports: []discoveryv1.EndpointPort{{Name: &pname, Protocol: &protocol, Port: &port}},
+	}, nil
+}
+
+func (r *KubernetesAdapter) services() typedcorev1.ServiceInterface {
+	return r.client.CoreV1().Services(r.namespace)
+}
+
+func (r *KubernetesAdapter) slices() typeddiscoveryv1.EndpointSliceInterface {
+	return r.client.DiscoveryV1().EndpointSlices(r.namespace)
+}
+
+func servicePorts(port int32) []corev1.ServicePort {
+	return []corev1.ServicePort{{Name: portName, Protocol: corev1.ProtocolTCP, Port: port}}
+}
+
+// serviceName returns the valid name of kubernetes Service, which must be a
+// DNS label starting with a letter
+func serviceName(name string) string {
+	name = strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "svc-" + name
+	}
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// nodeLabel returns the node id as label value
+func nodeLabel() string {
+	value := strings.Trim(invalidLabelChars.ReplaceAllString(bridge.LocalNode.ID, "-"), "-_.")
+	if len(value) > 63 {
+		value = strings.TrimRight(value[:63], "-_.")
+	}
+	return value
+}
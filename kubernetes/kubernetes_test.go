@@ -0,0 +1,235 @@
+package kubernetes
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newAdapter(objects ...runtime.Object) (*KubernetesAdapter, *fake.Clientset) {
+	client := fake.NewSimpleClientset(objects...)
+	return &KubernetesAdapter{client: client, namespace: "edge"}, client
+}
+
+func getService(t *testing.T, client *fake.Clientset, name string) *corev1.Service {
+	t.Helper()
+	svc, err := client.CoreV1().Services("edge").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return svc
+}
+
+// patches returns the number of patches of Services
+func patches(client *fake.Clientset) int {
+	n := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "patch" && action.GetResource().Resource == "services" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAdapter(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	r, client := newAdapter()
+
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	high := &bridge.Service{ID: "[test]:exporter:9200", Name: "node_exporter", Port: 9200}
+	low := &bridge.Service{ID: "[test]:exporter:9100", Name: "node_exporter", Port: 9100, IP: "fd00::1"}
+	if err := r.Register(high); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	svc := getService(t, client, "node-exporter")
+	if svc == nil || len(svc.Spec.Ports) != 1 || svc.Spec.Ports[0].Port != 9200 || svc.Spec.Ports[0].Name != portName {
+		t.Fatalf("service = %+v", svc)
+	}
+	if svc.Labels[labelAppManaged] != managedBy {
+		t.Errorf("labels of service = %v", svc.Labels)
+	}
+
+	// the port of Service is the lowest one regardless of the order of registration
+	if err := r.Register(low); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if svc := getService(t, client, "node-exporter"); svc.Spec.Ports[0].Port != 9100 || svc.Spec.Ports[0].Name != portName {
+		t.Errorf("service ports = %+v", svc.Spec.Ports)
+	}
+	if err := r.Register(high); err != nil {
+		t.Fatalf("Register() again = %v", err)
+	}
+	if svc := getService(t, client, "node-exporter"); svc.Spec.Ports[0].Port != 9100 || patches(client) != 1 {
+		t.Errorf("service ports = %+v, patches %d", svc.Spec.Ports, patches(client))
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 2 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	slice, _ := r.endpointSlice(low)
+	if slice.AddressType != discoveryv1.AddressTypeIPv6 || *slice.Ports[0].Name != portName || *slice.Ports[0].Port != 9100 {
+		t.Errorf("endpointslice = %+v", slice)
+	}
+	if slice.Labels[labelNode] != "node-1" || slice.Endpoints[0].Addresses[0] != "fd00::1" || !*slice.Endpoints[0].Conditions.Ready {
+		t.Errorf("endpointslice = %+v", slice)
+	}
+
+	// the EndpointSlices of other nodes are not listed
+	other := slice.DeepCopy()
+	other.Name, other.Labels[labelNode] = "node-exporter-other", "node-2"
+	if _, err := client.DiscoveryV1().EndpointSlices("edge").Create(context.Background(), other, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if services, _ := r.Services(); len(services) != 2 {
+		t.Errorf("Services() with other node = %v", services)
+	}
+	client.DiscoveryV1().EndpointSlices("edge").Delete(context.Background(), other.Name, metav1.DeleteOptions{})
+
+	// the Service is deleted with the last EndpointSlice
+	if err := r.Deregister(&bridge.Service{ID: high.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if getService(t, client, "node-exporter") == nil {
+		t.Error("service is deleted while it has endpointslices")
+	}
+	if err := r.Deregister(low); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if getService(t, client, "node-exporter") != nil {
+		t.Error("service without endpointslices is kept")
+	}
+}
+
+func TestRegisterReplaces(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	r, client := newAdapter()
+
+	web := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	if err := r.Register(web); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	moved := *web
+	moved.IP = "10.0.0.6"
+	if err := r.Register(&moved); err != nil {
+		t.Fatalf("Register() again = %v", err)
+	}
+	slices, _ := client.DiscoveryV1().EndpointSlices("edge").List(context.Background(), metav1.ListOptions{})
+	if len(slices.Items) != 1 || slices.Items[0].Endpoints[0].Addresses[0] != "10.0.0.6" {
+		t.Errorf("endpointslices = %+v", slices.Items)
+	}
+}
+
+func TestRegisterFailed(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	r, client := newAdapter()
+	client.PrependReactor("create", "endpointslices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+
+	if err := r.Register(&bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}); err == nil {
+		t.Error("Register() succeeded while the endpointslice is not created")
+	}
+	if err := r.Register(&bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80, IP: "invalid"}); err == nil {
+		t.Error("Register() of invalid address succeeded")
+	}
+}
+
+func TestForeignService(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	r, client := newAdapter(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "edge"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80}}},
+	})
+
+	service := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if err := r.Deregister(service); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if svc := getService(t, client, "web"); svc == nil || svc.Spec.Ports[0].Port != 80 || patches(client) != 0 {
+		t.Errorf("service not created by registrator is changed: %+v", svc)
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config")
+	config := `
+apiVersion: v1
+kind: Config
+current-context: edge
+clusters:
+- name: edge
+  cluster:
+    server: https://10.0.0.1:6443/
+    insecure-skip-tls-verify: true
+users:
+- name: registrator
+  user:
+    token: secret
+contexts:
+- name: edge
+  context:
+    cluster: edge
+    user: registrator
+    namespace: monitoring
+- name: default
+  context:
+    cluster: edge
+    user: registrator
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, namespace, err := newKubeconfigClient(path, ""); err != nil || namespace != "monitoring" {
+		t.Errorf("newKubeconfigClient() = %s, %v", namespace, err)
+	}
+	if _, namespace, err := newKubeconfigClient(path, "default"); err != nil || namespace != "default" {
+		t.Errorf("newKubeconfigClient() of context without namespace = %s, %v", namespace, err)
+	}
+	if _, _, err := newKubeconfigClient(path, "missing"); err == nil {
+		t.Error("newKubeconfigClient() of missing context succeeded")
+	}
+	if _, _, err := newKubeconfigClient(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("newKubeconfigClient() of missing kubeconfig succeeded")
+	}
+}
+
+func TestServiceName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"node_exporter": "node-exporter",
+		"Web.API":       "web-api",
+		"9front":        "svc-9front",
+	} {
+		if got := serviceName(name); got != expected {
+			t.Errorf("serviceName(%s) = %s, want %s", name, got, expected)
+		}
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -15,10 +17,23 @@ import (
 
 	nested "github.com/antonfisher/nested-logrus-formatter"
 	"github.com/feifeigood/registrator/bridge"
-	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 
+	_ "github.com/feifeigood/registrator/api"
 	_ "github.com/feifeigood/registrator/consul"
+	_ "github.com/feifeigood/registrator/docker"
+	_ "github.com/feifeigood/registrator/eureka"
+	_ "github.com/feifeigood/registrator/file"
+	_ "github.com/feifeigood/registrator/filesd"
+	_ "github.com/feifeigood/registrator/kubernetes"
+	_ "github.com/feifeigood/registrator/mdns"
+	_ "github.com/feifeigood/registrator/nacos"
+	_ "github.com/feifeigood/registrator/plugin"
+	_ "github.com/feifeigood/registrator/redis"
+	_ "github.com/feifeigood/registrator/rfc2136"
+	_ "github.com/feifeigood/registrator/sql"
+	_ "github.com/feifeigood/registrator/systemd"
+	_ "github.com/feifeigood/registrator/webhook"
 )
 
 const app = "registrator"
@@ -29,16 +44,64 @@ var (
 	GitSHA  string
 )
 
-var printVersion = flag.Bool("version", false, "print version and exit.")
-var confdir = flag.String("config-dir", "/etc/registrator", "service definition config dir, include config file must be end in the '.json'")
-var refreshInterval = flag.Int("ttl-refresh", 0, "frequency with which services are resynchronized")
-var refreshTTL = flag.Int("ttl", 0, "TTL for services (default is no expiry)")
-var retryAttempts = flag.Int("retry-attempts", 0, "max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
-var retryInterval = flag.Int("retry-interval", 2000, "interval (in millisecond) between retry-attempts")
-var resyncInterval = flag.Int("resync", 0, "frequency with which services are resynchronized")
-var hostIP = flag.String("ip", "", "ip for ports mapped to the host")
-var cleanup = flag.Bool("cleanup", false, "remove dangling services")
-var logLevel = flag.String("log-level", "info", "Show log level")
+// settings represent the settings of registrator, given by command line,
+// environment variables or config file
+type settings struct {
+	Version           bool
+	Config            string
+	ConfDir           string
+	RefreshInterval   int
+	RefreshTTL        int
+	RetryAttempts     int
+	RetryInterval     int
+	ResyncInterval    int
+	HostIP            string
+	Cleanup           bool
+	LogLevel          string
+	PredicateInterval int
+	PingInterval      int
+	StatusListen      string
+	LocalChecks       bool
+	Drain             int
+	ReadyPolicy       string
+	Tags              string
+	Sources           stringSlice
+	NodeMeta          stringSlice
+	// Registry registry URI
+	Registry string
+}
+
+// newFlagSet returns the flags bound to settings
+func newFlagSet(s *settings) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.BoolVar(&s.Version, "version", false, "print version and exit.")
+	fs.StringVar(&s.Config, "config", "", "config file in YAML or JSON, reloaded on SIGHUP")
+	fs.StringVar(&s.ConfDir, "config-dir", "/etc/registrator", "service definition config dir, include config file must be end in the '.json'")
+	fs.IntVar(&s.RefreshInterval, "ttl-refresh", 0, "frequency with which services are resynchronized")
+	fs.IntVar(&s.RefreshTTL, "ttl", 0, "TTL for services (default is no expiry)")
+	fs.IntVar(&s.RetryAttempts, "retry-attempts", 0, "max retry attempts to establish a connection with the backend. Use -1 for infinite retries")
+	fs.IntVar(&s.RetryInterval, "retry-interval", 2000, "interval (in millisecond) between retry-attempts")
+	fs.IntVar(&s.ResyncInterval, "resync", 0, "frequency with which services are resynchronized")
+	fs.StringVar(&s.HostIP, "ip", "", "ip for ports mapped to the host")
+	fs.BoolVar(&s.Cleanup, "cleanup", false, "remove dangling services")
+	fs.StringVar(&s.LogLevel, "log-level", "info", "Show log level")
+	fs.IntVar(&s.PredicateInterval, "predicate-interval", 10, "interval (in second) of re-evaluating enabled_if predicates")
+	fs.IntVar(&s.PingInterval, "ping-interval", 5, "interval (in second) of monitoring the backend connectivity, all services are resynchronized once it recovers. Use 0 to disable")
+	fs.StringVar(&s.StatusListen, "status-listen", "", "address serving the backend connectivity on GET /status, e.g. 127.0.0.1:4101")
+	fs.BoolVar(&s.LocalChecks, "local-checks", false, "run health checks of services locally even if the backend runs them")
+	fs.IntVar(&s.Drain, "drain", 0, "period (in second) of draining removed services before deregistering them")
+	fs.StringVar(&s.ReadyPolicy, "ready-policy", bridge.ReadyPolicyRegister, "policy of services which never become ready, one of register, skip and critical")
+	fs.StringVar(&s.Tags, "tags", "", "comma separated tags added to all services")
+	fs.Var(&s.Sources, "source", "service definition source URI, can be repeated, e.g. file:///etc/registrator, docker:///var/run/docker.sock (default file://<config-dir>)")
+	fs.Var(&s.NodeMeta, "node-meta", "attribute of local node in the form key=value, can be repeated, matched by enabled_if predicates")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [options] <registry URI>\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
 var log = logrus.WithField("component", "main")
 
@@ -50,15 +113,27 @@ func init() {
 	})
 }
 
+// stringSlice flag value which can be repeated
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
 func failOnError(err error) {
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func setupLogger() error {
+func setupLogger(logLevel string) error {
 
-	switch *logLevel {
+	switch logLevel {
 	case "debug":
 		logrus.SetLevel(logrus.DebugLevel)
 	case "info":
@@ -72,140 +147,199 @@ func setupLogger() error {
 	case "panic":
 		logrus.SetLevel(logrus.PanicLevel)
 	default:
-		return fmt.Errorf("Unknown log level '%s'", *logLevel)
+		return fmt.Errorf("Unknown log level '%s'", logLevel)
 	}
 
 	return nil
 }
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s [options] <registry URI>\n\n", os.Args[0])
-		flag.PrintDefaults()
+// validate validates settings
+func (s *settings) validate() error {
+	if (s.RefreshInterval > 0 && s.RefreshTTL == 0) || (s.RefreshInterval == 0 && s.RefreshTTL > 0) {
+		return errors.New("-ttl and -ttl-refresh must be specified together or not at all")
+	} else if s.RefreshTTL > 0 && s.RefreshTTL <= s.RefreshInterval {
+		return errors.New("-ttl must be grether than -ttl-refresh")
 	}
 
-	flag.Parse()
+	if s.RetryInterval <= 0 {
+		return errors.New("-retry-interval must be grether than 0")
+	}
 
-	if *printVersion {
-		fmt.Printf("%s Version: %s\n", app, Version)
-		fmt.Printf("Git SHA: %s\n", GitSHA)
-		fmt.Printf("Go Version: %s\n", runtime.Version())
-		fmt.Printf("Go OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
-		os.Exit(0)
+	if s.Drain < 0 {
+		return errors.New("-drain must not be negative")
+	}
+
+	if err := bridge.ValidateReadyPolicy(s.ReadyPolicy); err != nil {
+		return err
+	}
+
+	if s.PingInterval < 0 {
+		return errors.New("-ping-interval must not be negative")
+	}
+
+	if s.PredicateInterval <= 0 {
+		return errors.New("-predicate-interval must be grether than 0")
 	}
 
-	if flag.NArg() != 1 {
-		if flag.NArg() == 0 {
-			fmt.Fprintf(os.Stderr, "Missing required argument for registry URI.\n\n")
-		} else {
-			fmt.Fprintln(os.Stderr, "Extra unparsed arguments:")
-			fmt.Fprintln(os.Stderr, " ", strings.Join(flag.Args()[1:], " "))
-			fmt.Fprintf(os.Stderr, "Options should come before the registry URI argument.\n\n")
+	if _, err := s.nodeMeta(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *settings) nodeMeta() (map[string]string, error) {
+	meta := make(map[string]string, len(s.NodeMeta))
+	for _, kv := range s.NodeMeta {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("-node-meta must be in the form key=value: %s", kv)
 		}
-		flag.Usage()
-		os.Exit(2)
+		meta[parts[0]] = parts[1]
 	}
+	return meta, nil
+}
 
-	failOnError(setupLogger())
+func (s *settings) bridgeConfig() bridge.Config {
+	meta, _ := s.nodeMeta()
+	var tags []string
+	for _, tag := range strings.Split(s.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return bridge.Config{
+		HostIP:            s.HostIP,
+		RefreshInterval:   s.RefreshInterval,
+		RefreshTTL:        s.RefreshTTL,
+		ConfDir:           s.ConfDir,
+		Sources:           s.Sources,
+		Cleanup:           s.Cleanup,
+		NodeMeta:          meta,
+		PredicateInterval: s.PredicateInterval,
+		LocalChecks:       s.LocalChecks,
+		Drain:             s.Drain,
+		ReadyPolicy:       s.ReadyPolicy,
+		Tags:              tags,
+	}
+}
 
-	if *hostIP != "" {
-		log.Infof("using host IP to %s", *hostIP)
+func main() {
+	s, err := loadSettings(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err == errUsage {
+		os.Exit(2)
 	}
+	failOnError(err)
 
-	if (*refreshInterval > 0 && *refreshTTL == 0) || (*refreshInterval == 0 && *refreshTTL > 0) {
-		failOnError(errors.New("-ttl and -ttl-refresh must be specified together or not at all"))
-	} else if *refreshTTL > 0 && *refreshTTL <= *refreshInterval {
-		failOnError(errors.New("-ttl must be grether than -ttl-refresh"))
+	if s.Version {
+		fmt.Printf("%s Version: %s\n", app, Version)
+		fmt.Printf("Git SHA: %s\n", GitSHA)
+		fmt.Printf("Go Version: %s\n", runtime.Version())
+		fmt.Printf("Go OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
 	}
 
-	if *retryInterval <= 0 {
-		failOnError(errors.New("-retry-interval must be grether than 0"))
+	failOnError(setupLogger(s.LogLevel))
+	failOnError(s.validate())
+
+	if s.Config != "" {
+		log.Infof("using config file %s", s.Config)
+	}
+
+	if s.HostIP != "" {
+		log.Infof("using host IP to %s", s.HostIP)
 	}
 
 	log.Infof("starting registrator %s", Version)
 
-	b, err := bridge.New(flag.Arg(0), bridge.Config{
-		HostIP:          *hostIP,
-		RefreshInterval: *refreshInterval,
-		RefreshTTL:      *refreshTTL,
-		ConfDir:         *confdir,
-		Cleanup:         *cleanup,
-	})
+	b, err := bridge.New(s.Registry, s.bridgeConfig())
 
 	failOnError(err)
 
 	attempt := 0
 
-	for *retryAttempts == -1 || attempt <= *retryAttempts {
-		log.Infof("connecting to backend (%v/%v)", attempt, *retryAttempts)
+	for s.RetryAttempts == -1 || attempt <= s.RetryAttempts {
+		log.Infof("connecting to backend (%v/%v)", attempt, s.RetryAttempts)
 		err := b.Ping()
 		if err == nil {
 			break
 		}
 
-		if err != nil && attempt == *retryAttempts {
+		if err != nil && attempt == s.RetryAttempts {
 			failOnError(err)
 		}
-		time.Sleep(time.Duration(*retryInterval) * time.Millisecond)
+		time.Sleep(time.Duration(s.RetryInterval) * time.Millisecond)
 		attempt++
 	}
 
-	// Start fsnotify
-	watcher, err := fsnotify.NewWatcher()
-	failOnError(err)
-	defer watcher.Close()
-
 	quit := make(chan os.Signal, 1)
+	hup := make(chan os.Signal, 1)
 	stop := make(chan struct{})
 	wg := &sync.WaitGroup{}
 
 	b.Sync(false)
 
-	log.Infof("listening for fsnotify events ...")
+	if s.StatusListen != "" {
+		failOnError(serveStatus(s.StatusListen, stop))
+		log.Infof("serving backend connectivity on %s", s.StatusListen)
+	}
+
+	wg.Add(1)
 	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
+		defer wg.Done()
+		b.Listen(stop)
+	}()
 
-				// ignore invalid file, like vim .swap
-				log.Debugf("fsnotify: received event: %v", event)
-				if filepath.Ext(event.Name) != ".json" || filepath.Base(event.Name) == bridge.StorageName {
-					continue
-				}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.Watch(stop)
+	}()
 
-				switch {
-				case event.Op&fsnotify.Create == fsnotify.Create:
-					b.Add(event.Name)
-				case event.Op&fsnotify.Write == fsnotify.Write:
-					b.Update(event.Name)
-				case event.Op&fsnotify.Rename == fsnotify.Rename:
-					b.Rename(event.Name)
-				case event.Op&fsnotify.Rename == fsnotify.Remove:
-					b.Remove(event.Name)
-				default:
-					log.Debugf("fsnotify: ignore event: %v", event)
-				}
+	stopPeriodic := startPeriodic(b, s)
 
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Errorf("fsnotify: watcher failed: %v", err)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case <-hup:
+			var restartLoops bool
+			if s, restartLoops = reload(b, s); restartLoops {
+				stopPeriodic()
+				stopPeriodic = startPeriodic(b, s)
 			}
+			continue
+		case <-quit:
 		}
-	}()
+		break
+	}
+	stopPeriodic()
+	close(stop)
 
-	err = watcher.Add(*confdir)
-	failOnError(err)
+	wg.Wait()
+	b.Close()
+}
+
+// startPeriodic starts the TTL refresh, resync and monitor loops with the
+// intervals of settings, they are stopped by the returned func
+func startPeriodic(b *bridge.Bridge, s *settings) func() {
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	if s.PingInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Monitor(time.Duration(s.PingInterval)*time.Second, stop)
+		}()
+	}
 
 	// Start the TTL refresh timer
-	if *refreshInterval > 0 {
+	if s.RefreshInterval > 0 {
 		wg.Add(1)
-		ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
+		ticker := time.NewTicker(time.Duration(s.RefreshInterval) * time.Second)
 		go func() {
 			defer wg.Done()
 			for {
@@ -221,10 +355,10 @@ func main() {
 	}
 
 	// Start the resync timer if enabled
-	if *resyncInterval > 0 {
-		log.Infof("interval %v for resynchronized", time.Duration(*resyncInterval)*time.Second)
+	if s.ResyncInterval > 0 {
+		log.Infof("interval %v for resynchronized", time.Duration(s.ResyncInterval)*time.Second)
 		wg.Add(1)
-		resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
+		resyncTicker := time.NewTicker(time.Duration(s.ResyncInterval) * time.Second)
 		go func() {
 			defer wg.Done()
 			for {
@@ -239,9 +373,42 @@ func main() {
 		}()
 	}
 
-	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
-	<-quit
-	close(stop)
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
 
-	wg.Wait()
+// serveStatus serves the backend connectivity on GET /status until stop
+// closed, it responds 503 once the backend is disconnected, so that it can
+// be probed without the api source
+func serveStatus(addr string, stop <-chan struct{}) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("status listen: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		backend := bridge.Backend()
+		status := http.StatusOK
+		if backend.State == bridge.Disconnected {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"backend": backend})
+	})
+	server := &http.Server{Handler: mux}
+
+	go server.Serve(l)
+	go func() {
+		<-stop
+		server.Close()
+	}()
+	return nil
 }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeStatus(t *testing.T) {
+	// a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := serveStatus(addr, stop); err != nil {
+		t.Fatalf("serveStatus() = %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		Backend struct {
+			State string `json:"state"`
+		} `json:"backend"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || resp.StatusCode != http.StatusOK || status.Backend.State != "connected" {
+		t.Errorf("GET /status = %d %+v %v", resp.StatusCode, status, err)
+	}
+
+	if err := serveStatus(addr, stop); err == nil {
+		t.Error("serveStatus() on the address in use succeeded")
+	}
+}
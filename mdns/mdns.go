@@ -0,0 +1,452 @@
+package mdns
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "mdns")
+
+// DefaultTTL TTL of records, as recommended by RFC 6762 for host records
+const DefaultTTL = 120
+
+const (
+	domain = "local."
+	// browseName name of the PTR records of all service types
+	browseName = "_services._dns-sd._udp." + domain
+	// announceInterval interval of the repeated announcement
+	announceInterval = time.Second
+	// legacyTTL max TTL of the responses to legacy unicast queries
+	legacyTTL = 10
+	// cacheFlush bit of the class of unique records
+	cacheFlush = 1 << 15
+	// unicastResponse bit of the class of questions requesting unicast responses
+	unicastResponse = 1 << 15
+)
+
+var (
+	groupAddr4        = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]`)
+)
+
+func init() {
+	bridge.Register(new(Factory), "mdns")
+}
+
+type Factory struct{}
+
+// New returns the mDNS adapter responding on the interface of interface
+// option, e.g. mdns://?interface=eth0, default is the one of system
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	var iface *net.Interface
+	if name := uri.Query().Get("interface"); name != "" {
+		var err error
+		if iface, err = net.InterfaceByName(name); err != nil {
+			log.Fatalf("mdns: %v", err)
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", iface, groupAddr4)
+	if err != nil {
+		log.Fatalf("mdns: listen %s failed: %v", groupAddr4, err)
+	}
+
+	r := &MDNSAdapter{
+		conn:     conn,
+		services: make(map[string]*advertisement),
+		closed:   make(chan struct{}),
+	}
+	go r.serve()
+	return r
+}
+
+// MDNSAdapter advertises services on the local link by multicast DNS, each
+// service is the DNS-SD instance <instance>._<name>._tcp.local with SRV and
+// TXT records, browsed by the PTR of _<name>._tcp.local. The target host
+// <instance>.local has the A or AAAA record.
+//
+// The advertisements are announced on registration and withdrawn by goodbye
+// packets on deregistration and exit, they only live while running.
+type MDNSAdapter struct {
+	sync.Mutex
+	conn *net.UDPConn
+	// services advertised services keyed by id
+	services map[string]*advertisement
+	closed   chan struct{}
+}
+
+// advertisement the records of service
+type advertisement struct {
+	service *bridge.Service
+	records []dns.RR
+}
+
+// Ping mDNS has no server, it's healthy while the socket is open
+func (r *MDNSAdapter) Ping() error {
+	select {
+	case <-r.closed:
+		return fmt.Errorf("mdns: closed")
+	default:
+		return nil
+	}
+}
+
+// Register advertises service, the announcement is sent twice a second apart
+func (r *MDNSAdapter) Register(service *bridge.Service) error {
+	records, err := newRecords(service)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	previous, ok := r.services[service.ID]
+	r.services[service.ID] = &advertisement{service: service, records: records}
+	if ok {
+		r.goodbye(r.unshared(stale(previous.records, records)))
+	}
+	r.Unlock()
+
+	log.Debugf("mdns: announce %s", service.ID)
+	r.announce(records)
+	go func() {
+		select {
+		case <-time.After(announceInterval):
+		case <-r.closed:
+			return
+		}
+		r.Lock()
+		current, ok := r.services[service.ID]
+		r.Unlock()
+		if ok {
+			r.announce(current.records)
+		}
+	}()
+	return nil
+}
+
+// Deregister withdraws service by goodbye packet
+func (r *MDNSAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+
+	previous, ok := r.services[service.ID]
+	if !ok {
+		return nil
+	}
+	delete(r.services, service.ID)
+
+	log.Debugf("mdns: goodbye %s", service.ID)
+	r.goodbye(r.unshared(previous.records))
+	return nil
+}
+
+// Refresh advertisements don't expire while running
+func (r *MDNSAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services returns the advertised services
+func (r *MDNSAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, a := range r.services {
+		services = append(services, a.service)
+	}
+	return services, nil
+}
+
+// Close withdraws all advertisements by goodbye packets, and stops responding
+func (r *MDNSAdapter) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	var records []dns.RR
+	for _, a := range r.services {
+		records = append(records, a.records...)
+	}
+	if len(records) > 0 {
+		log.Infof("mdns: goodbye %d services", len(r.services))
+		r.goodbye(dedup(records))
+	}
+	r.services = make(map[string]*advertisement)
+
+	close(r.closed)
+	return r.conn.Close()
+}
+
+// serve responds the queries until closed
+func (r *MDNSAdapter) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.closed:
+				return
+			default:
+			}
+			log.Warnf("mdns: read failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		query := new(dns.Msg)
+		if err := query.Unpack(buf[:n]); err != nil || query.Response || query.Opcode != dns.OpcodeQuery {
+			continue
+		}
+		r.respond(query, from)
+	}
+}
+
+// respond responds the query, by multicast unless the unicast response is
+// requested, or the query is a legacy unicast one which is not from port 5353
+func (r *MDNSAdapter) respond(query *dns.Msg, from *net.UDPAddr) {
+	legacy := from.Port != groupAddr4.Port
+	unicast := legacy
+
+	r.Lock()
+	var answers, extra []dns.RR
+	for _, q := range query.Question {
+		if q.Qclass&unicastResponse != 0 {
+			unicast = true
+		}
+		for _, a := range r.services {
+			answers = append(answers, match(a.records, q)...)
+		}
+	}
+	if len(answers) == 0 {
+		r.Unlock()
+		return
+	}
+	// the SRV and TXT of instances answered by PTR, and the address of SRV
+	// targets are additional
+	queue := append([]dns.RR(nil), answers...)
+	for len(queue) > 0 {
+		rr := queue[0]
+		queue = queue[1:]
+		var target string
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if rr.Hdr.Name != browseName {
+				target = rr.Ptr
+			}
+		case *dns.SRV:
+			target = rr.Target
+		}
+		if target == "" {
+			continue
+		}
+		for _, a := range r.services {
+			records := match(a.records, dns.Question{Name: target, Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+			extra = append(extra, records...)
+			queue = append(queue, records...)
+		}
+	}
+	r.Unlock()
+
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	resp.Answer = dedup(answers)
+	resp.Extra = dedup(extra)
+	if legacy {
+		// legacy resolvers require the id and question, and don't know cache-flush
+		resp.Id = query.Id
+		resp.Question = query.Question
+		for _, rr := range append(resp.Answer, resp.Extra...) {
+			rr.Header().Class &^= cacheFlush
+			if rr.Header().Ttl > legacyTTL {
+				rr.Header().Ttl = legacyTTL
+			}
+		}
+	}
+
+	to := groupAddr4
+	if unicast {
+		to = from
+	}
+	r.send(resp, to)
+}
+
+// announce sends the unsolicited response of records
+func (r *MDNSAdapter) announce(records []dns.RR) {
+	resp := new(dns.Msg)
+	resp.Response = true
+	resp.Authoritative = true
+	resp.Answer = records
+	r.send(resp, groupAddr4)
+}
+
+// goodbye sends the records with TTL 0, so they are removed from caches
+func (r *MDNSAdapter) goodbye(records []dns.RR) {
+	if len(records) == 0 {
+		return
+	}
+	goodbyes := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		goodbyes = append(goodbyes, rr)
+	}
+	r.announce(goodbyes)
+}
+
+func (r *MDNSAdapter) send(msg *dns.Msg, to *net.UDPAddr) {
+	bs, err := msg.Pack()
+	if err != nil {
+		log.Errorf("mdns: pack response failed: %v", err)
+		return
+	}
+	if _, err := r.conn.WriteToUDP(bs, to); err != nil {
+		log.Warnf("mdns: send to %s failed: %v", to, err)
+	}
+}
+
+// newRecords returns the records of service, the records unique to service
+// have the cache-flush bit set
+func newRecords(service *bridge.Service) ([]dns.RR, error) {
+	address := service.IP
+	if address == "" {
+		address = bridge.LocalNode.Address
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("mdns: invalid address %q of %s", address, service.ID)
+	}
+
+	name := label(service.Name)
+	sum := sha1.Sum([]byte(service.ID))
+	instanceLabel := label(fmt.Sprintf("%s-%x", name, sum[:5]))
+	serviceType := "_" + name + "._tcp." + domain
+	instance := instanceLabel + "." + serviceType
+	host := instanceLabel + "." + domain
+
+	header := func(name string, rrtype uint16, unique bool) dns.RR_Header {
+		class := uint16(dns.ClassINET)
+		if unique {
+			class |= cacheFlush
+		}
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: class, Ttl: DefaultTTL}
+	}
+
+	records := []dns.RR{
+		&dns.PTR{Hdr: header(browseName, dns.TypePTR, false), Ptr: serviceType},
+		&dns.PTR{Hdr: header(serviceType, dns.TypePTR, false), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV, true), Port: uint16(service.Port), Target: host},
+		&dns.TXT{Hdr: header(instance, dns.TypeTXT, true), Txt: txtRecord(service)},
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		records = append(records, &dns.A{Hdr: header(host, dns.TypeA, true), A: ip4})
+	} else {
+		records = append(records, &dns.AAAA{Hdr: header(host, dns.TypeAAAA, true), AAAA: ip})
+	}
+	return records, nil
+}
+
+// match returns the records answering the question
+func match(records []dns.RR, q dns.Question) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range records {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, q.Name) {
+			continue
+		}
+		if q.Qtype == dns.TypeANY || q.Qtype == h.Rrtype {
+			answers = append(answers, dns.Copy(rr))
+		}
+	}
+	return answers
+}
+
+// unshared returns the records which are not advertised by the services, e.g.
+// the PTR of service type is kept until the last service of the name is gone
+func (r *MDNSAdapter) unshared(records []dns.RR) []dns.RR {
+	var current []dns.RR
+	for _, a := range r.services {
+		current = append(current, a.records...)
+	}
+	return stale(records, current)
+}
+
+// stale returns the previous records which are not in the current ones
+func stale(previous, current []dns.RR) []dns.RR {
+	var records []dns.RR
+	for _, rr := range previous {
+		found := false
+		for _, c := range current {
+			if dns.IsDuplicate(rr, c) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// dedup removes the duplicated records, e.g. the PTR of service types shared
+// by the services of the same name
+func dedup(records []dns.RR) []dns.RR {
+	var unique []dns.RR
+	for _, rr := range records {
+		duplicated := false
+		for _, u := range unique {
+			if dns.IsDuplicate(rr, u) {
+				duplicated = true
+				break
+			}
+		}
+		if !duplicated {
+			unique = append(unique, rr)
+		}
+	}
+	return unique
+}
+
+// label returns the valid DNS label of s
+func label(s string) string {
+	s = strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(s) > 63 {
+		s = strings.TrimRight(s[:63], "-")
+	}
+	return s
+}
+
+// txtRecord returns the DNS-SD TXT strings of service, the attrs in the form
+// key=value and the tags in the form tags=tag1,tag2
+func txtRecord(service *bridge.Service) []string {
+	txt := make([]string, 0, len(service.Attrs)+1)
+	for k, v := range service.Attrs {
+		txt = append(txt, escape(k+"="+v))
+	}
+	sort.Strings(txt)
+	if len(service.Tags) > 0 {
+		txt = append(txt, escape("tags="+strings.Join(service.Tags, ",")))
+	}
+	if len(txt) == 0 {
+		// DNS-SD requires at least one string
+		txt = append(txt, "")
+	}
+	return txt
+}
+
+// escape escapes the backslashes of TXT string, as they are parsed as the
+// escapes of presentation format
+func escape(s string) string {
+	return strings.Replace(s, `\`, `\\`, -1)
+}
@@ -0,0 +1,174 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/miekg/dns"
+)
+
+// newAdapter returns the adapter on loopback, of which the multicast group is
+// the returned socket
+func newAdapter(t *testing.T) (*MDNSAdapter, *net.UDPConn) {
+	bridge.LocalNode.Address = "10.0.0.5"
+
+	group, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { group.Close() })
+	original := groupAddr4
+	groupAddr4 = group.LocalAddr().(*net.UDPAddr)
+	t.Cleanup(func() { groupAddr4 = original })
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &MDNSAdapter{conn: conn, services: make(map[string]*advertisement), closed: make(chan struct{})}
+	go r.serve()
+	t.Cleanup(func() {
+		select {
+		case <-r.closed:
+		default:
+			r.Close()
+		}
+	})
+	return r, group
+}
+
+// receive returns the first message received by conn which satisfies accept
+func receive(t *testing.T, conn *net.UDPConn, accept func(*dns.Msg) bool) *dns.Msg {
+	t.Helper()
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("receive failed: %v", err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err == nil && accept(msg) {
+			return msg
+		}
+	}
+}
+
+func goodbyes(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl != 0 {
+			return false
+		}
+	}
+	return len(msg.Answer) > 0
+}
+
+func find(records []dns.RR, rrtype uint16) dns.RR {
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			return rr
+		}
+	}
+	return nil
+}
+
+func TestRespond(t *testing.T) {
+	r, group := newAdapter(t)
+
+	service := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80, Tags: []string{"http"}}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	announcement := receive(t, group, func(msg *dns.Msg) bool { return msg.Response })
+	if len(announcement.Answer) != 5 {
+		t.Errorf("announcement = %v", announcement)
+	}
+
+	// legacy unicast query is answered to the sender with its id and capped TTL
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	query := new(dns.Msg)
+	query.SetQuestion("_web._tcp.local.", dns.TypePTR)
+	bs, _ := query.Pack()
+	if _, err := client.WriteToUDP(bs, r.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	resp := receive(t, client, func(msg *dns.Msg) bool { return msg.Response })
+	if resp.Id != query.Id || len(resp.Question) != 1 || len(resp.Answer) != 1 {
+		t.Fatalf("response = %v", resp)
+	}
+	srv, _ := find(resp.Extra, dns.TypeSRV).(*dns.SRV)
+	a, _ := find(resp.Extra, dns.TypeA).(*dns.A)
+	if srv == nil || srv.Port != 80 || a == nil || !a.A.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("additional = %v", resp.Extra)
+	}
+	for _, rr := range append(resp.Answer, resp.Extra...) {
+		if rr.Header().Ttl > legacyTTL || rr.Header().Class&cacheFlush != 0 {
+			t.Errorf("legacy record = %v", rr)
+		}
+	}
+
+	// mDNS query from port 5353 is answered by multicast
+	query = new(dns.Msg)
+	query.SetQuestion(srv.Hdr.Name, dns.TypeTXT)
+	r.respond(query, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: groupAddr4.Port})
+	resp = receive(t, group, func(msg *dns.Msg) bool { return find(msg.Answer, dns.TypeTXT) != nil && len(msg.Answer) == 1 })
+	if txt := resp.Answer[0].(*dns.TXT); txt.Hdr.Ttl != DefaultTTL || txt.Txt[0] != "tags=http" {
+		t.Errorf("txt = %v", txt)
+	}
+
+	// unknown names are not answered
+	query.SetQuestion("_db._tcp.local.", dns.TypePTR)
+	bs, _ = query.Pack()
+	client.WriteToUDP(bs, r.conn.LocalAddr().(*net.UDPAddr))
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(make([]byte, 512)); err == nil {
+		t.Error("unknown name is answered")
+	}
+}
+
+func TestGoodbye(t *testing.T) {
+	r, group := newAdapter(t)
+
+	web1 := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80}
+	web2 := &bridge.Service{ID: "[test]:web:81", Name: "web", Port: 81}
+	for _, service := range []*bridge.Service{web1, web2} {
+		if err := r.Register(service); err != nil {
+			t.Fatalf("Register() = %v", err)
+		}
+	}
+
+	// the PTR of service type is kept while the other service of the name is advertised
+	if err := r.Deregister(web1); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	msg := receive(t, group, goodbyes)
+	if len(msg.Answer) != 4 {
+		t.Errorf("goodbye = %v", msg.Answer)
+	}
+	for _, rr := range msg.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok && ptr.Hdr.Name == browseName {
+			t.Errorf("shared record is withdrawn: %v", rr)
+		}
+	}
+	if services, _ := r.Services(); len(services) != 1 || services[0].ID != web2.ID {
+		t.Errorf("Services() = %v", services)
+	}
+
+	// all are withdrawn on exit
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	msg = receive(t, group, goodbyes)
+	if len(msg.Answer) != 5 || find(msg.Answer, dns.TypePTR) == nil {
+		t.Errorf("goodbye on exit = %v", msg.Answer)
+	}
+	if err := r.Ping(); err == nil {
+		t.Error("Ping() after Close() succeeded")
+	}
+}
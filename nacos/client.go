@@ -0,0 +1,137 @@
+package nacos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// client minimal client of nacos open API, the access token is obtained by
+// the username and password If auth is enabled
+type client struct {
+	sync.Mutex
+	http     *http.Client
+	username string
+	password string
+	// token access token and its expiry, keyed by server as each server may
+	// issue its own
+	tokens map[string]*token
+}
+
+type token struct {
+	value  string
+	expiry time.Time
+}
+
+// statusError unexpected status of nacos response
+type statusError struct {
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("nacos: unexpected status %d: %s", e.status, e.body)
+}
+
+func isNotFound(err error) bool {
+	serr, ok := err.(*statusError)
+	return ok && serr.status == http.StatusNotFound
+}
+
+// unreachable returns whether the error is that the server is unreachable,
+// rather than a response of nacos
+func unreachable(err error) bool {
+	_, ok := err.(*statusError)
+	return !ok
+}
+
+func newClient(user *url.Userinfo) *client {
+	c := &client{
+		http:   &http.Client{Timeout: requestTimeout},
+		tokens: make(map[string]*token),
+	}
+	if user != nil {
+		c.username = user.Username()
+		c.password, _ = user.Password()
+	}
+	return c
+}
+
+// do sends the request with params to the server, and decodes the JSON
+// response into out If it's not nil
+func (c *client) do(base, method, path string, params url.Values, out interface{}) error {
+	if c.username != "" {
+		accessToken, err := c.token(base)
+		if err != nil {
+			return err
+		}
+		params.Set("accessToken", accessToken)
+	}
+
+	req, err := http.NewRequest(method, base+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode == http.StatusForbidden && c.username != "" {
+			// the token may have been revoked, log in again on next request
+			c.Lock()
+			delete(c.tokens, base)
+			c.Unlock()
+		}
+		return &statusError{status: resp.StatusCode, body: strings.TrimSpace(string(bs))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// token returns the access token of server, it logs in once the token is
+// about to expire
+func (c *client) token(base string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if t, ok := c.tokens[base]; ok && time.Now().Before(t.expiry) {
+		return t.value, nil
+	}
+
+	form := url.Values{"username": {c.username}, "password": {c.password}}
+	resp, err := c.http.PostForm(base+"/v1/auth/login", form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("nacos: login failed: %d %s", resp.StatusCode, strings.TrimSpace(string(bs)))
+	}
+
+	var login struct {
+		AccessToken string `json:"accessToken"`
+		TokenTTL    int64  `json:"tokenTtl"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return "", err
+	}
+	// renew it ahead of expiry
+	ttl := time.Duration(login.TokenTTL)*time.Second - time.Minute
+	c.tokens[base] = &token{value: login.AccessToken, expiry: time.Now().Add(ttl)}
+	return login.AccessToken, nil
+}
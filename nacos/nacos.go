@@ -0,0 +1,343 @@
+package nacos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "nacos")
+
+// defaults of nacos
+const (
+	DefaultGroup   = "DEFAULT_GROUP"
+	DefaultCluster = "DEFAULT"
+)
+
+// metadata keys of the service fields which nacos instance doesn't keep, the
+// node one marks the instances owned by this node
+const (
+	metaID      = "registrator.id"
+	metaNode    = "registrator.node"
+	metaAddress = "registrator.address"
+	metaTags    = "registrator.tags"
+)
+
+// preserved metadata of nacos controlling the expiry of ephemeral instances
+const (
+	metaBeatInterval  = "preserved.heart.beat.interval"
+	metaBeatTimeout   = "preserved.heart.beat.timeout"
+	metaDeleteTimeout = "preserved.ip.delete.timeout"
+)
+
+// codeNotFound code of beat response If the instance is unknown
+const codeNotFound = 20404
+
+// pageSize page size of listing services
+const pageSize = 500
+
+func init() {
+	bridge.Register(new(Factory), "nacos")
+}
+
+type Factory struct{}
+
+// New returns the nacos adapter, e.g. nacos://127.0.0.1:8848?namespace=dev&group=web,
+// the path is the context path of nacos open API, default is /nacos. The host
+// can be a comma separated list of nacos servers, the first healthy one is used
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	endpoints := bridge.ParseEndpoints(uri)
+	if len(endpoints) == 0 {
+		log.Fatal("nacos: host of nacos server is required, e.g. nacos://127.0.0.1:8848")
+	}
+
+	path := strings.TrimSuffix(uri.Path, "/")
+	if path == "" {
+		path = "/nacos"
+	}
+	bases := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		bases = append(bases, "http://"+endpoint+path)
+	}
+
+	query := uri.Query()
+	r := &NacosAdapter{
+		client:    newClient(uri.User),
+		endpoints: bridge.NewEndpoints(bases),
+		namespace: query.Get("namespace"),
+		group:     query.Get("group"),
+		cluster:   query.Get("cluster"),
+		ephemeral: true,
+	}
+	if r.group == "" {
+		r.group = DefaultGroup
+	}
+	if r.cluster == "" {
+		r.cluster = DefaultCluster
+	}
+	if ephemeral := query.Get("ephemeral"); ephemeral != "" {
+		var err error
+		if r.ephemeral, err = strconv.ParseBool(ephemeral); err != nil {
+			log.Fatalf("nacos: invalid ephemeral %q", ephemeral)
+		}
+	}
+	return r
+}
+
+// NacosAdapter registers services as nacos instances in the namespace and
+// group. The ephemeral instances expire unless they are renewed by the
+// heartbeats sent by Refresh, the persistent ones are kept until deregistered
+// and checked by nacos itself
+type NacosAdapter struct {
+	client    *client
+	endpoints *bridge.Endpoints
+	namespace string
+	group     string
+	cluster   string
+	ephemeral bool
+}
+
+type instance struct {
+	IP          string            `json:"ip"`
+	Port        int               `json:"port"`
+	ClusterName string            `json:"clusterName"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// RequiresRefresh nacos expires the ephemeral instances which are not renewed
+func (r *NacosAdapter) RequiresRefresh() bool {
+	return r.ephemeral
+}
+
+// Ping pings the servers in the order of preference, and fails over to the
+// first healthy one
+func (r *NacosAdapter) Ping() error {
+	return r.endpoints.Failover(func(i int) error {
+		return r.client.do(r.endpoints.All()[i], http.MethodGet, "/v1/ns/operator/metrics", url.Values{}, nil)
+	})
+}
+
+// Endpoint returns the server in use
+func (r *NacosAdapter) Endpoint() string {
+	return r.endpoints.All()[r.endpoints.Current()]
+}
+
+// call sends the request to the server in use, it fails over and retries once
+// on the new server If the server is unreachable
+func (r *NacosAdapter) call(method, path string, params url.Values, out interface{}) error {
+	return r.endpoints.Call(func(i int) error {
+		return r.client.do(r.endpoints.All()[i], method, path, params, out)
+	}, unreachable, r.Ping)
+}
+
+func (r *NacosAdapter) Register(service *bridge.Service) error {
+	metadata, err := json.Marshal(r.metadata(service))
+	if err != nil {
+		return err
+	}
+
+	params := r.params(service.Name)
+	params.Set("ip", address(service))
+	params.Set("port", strconv.Itoa(service.Port))
+	params.Set("clusterName", r.cluster)
+	params.Set("weight", "1")
+	params.Set("enabled", "true")
+	params.Set("healthy", "true")
+	params.Set("metadata", string(metadata))
+
+	log.Debugf("nacos: register instance: %v", params)
+	return r.call(http.MethodPost, "/v1/ns/instance", params, nil)
+}
+
+func (r *NacosAdapter) Deregister(service *bridge.Service) error {
+	// the name is unknown when the service is deregistered by id only
+	if service.Name == "" {
+		owned, err := r.Services()
+		if err != nil {
+			return err
+		}
+		var found bool
+		for _, s := range owned {
+			if s.ID == service.ID {
+				service, found = s, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	params := r.params(service.Name)
+	params.Set("ip", address(service))
+	params.Set("port", strconv.Itoa(service.Port))
+	params.Set("clusterName", r.cluster)
+
+	log.Debugf("nacos: deregister instance: %s", service.ID)
+	if err := r.call(http.MethodDelete, "/v1/ns/instance", params, nil); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Refresh sends the heartbeat of ephemeral instance, it's registered again If
+// nacos lost it, e.g. the server restarted or the instance expired
+func (r *NacosAdapter) Refresh(service *bridge.Service) error {
+	if !r.ephemeral {
+		return nil
+	}
+
+	beat, err := json.Marshal(map[string]interface{}{
+		"serviceName": r.group + "@@" + service.Name,
+		"ip":          address(service),
+		"port":        service.Port,
+		"cluster":     r.cluster,
+		"weight":      1,
+		"metadata":    r.metadata(service),
+		"scheduled":   true,
+	})
+	if err != nil {
+		return err
+	}
+
+	params := r.params(service.Name)
+	params.Set("beat", string(beat))
+	var resp struct {
+		Code int `json:"code"`
+	}
+	err = r.call(http.MethodPut, "/v1/ns/instance/beat", params, &resp)
+	if isNotFound(err) || (err == nil && resp.Code == codeNotFound) {
+		log.Infof("nacos: instance %s not found, registering it again", service.ID)
+		return r.Register(service)
+	}
+	return err
+}
+
+// Services returns the instances owned by this node in the namespace and
+// group, which are marked by the node metadata
+func (r *NacosAdapter) Services() ([]*bridge.Service, error) {
+	names, err := r.serviceNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*bridge.Service
+	for _, name := range names {
+		params := r.params(name)
+		params.Set("clusters", r.cluster)
+		params.Set("healthyOnly", "false")
+		var list struct {
+			Hosts []*instance `json:"hosts"`
+		}
+		if err := r.call(http.MethodGet, "/v1/ns/instance/list", params, &list); err != nil {
+			return nil, err
+		}
+		for _, i := range list.Hosts {
+			if i.Metadata[metaNode] == bridge.LocalNode.ID {
+				services = append(services, toService(name, i))
+			}
+		}
+	}
+	return services, nil
+}
+
+// serviceNames returns the names of services in the namespace and group
+func (r *NacosAdapter) serviceNames() ([]string, error) {
+	var names []string
+	for page := 1; ; page++ {
+		params := url.Values{}
+		params.Set("pageNo", strconv.Itoa(page))
+		params.Set("pageSize", strconv.Itoa(pageSize))
+		params.Set("groupName", r.group)
+		if r.namespace != "" {
+			params.Set("namespaceId", r.namespace)
+		}
+		var list struct {
+			Count int      `json:"count"`
+			Doms  []string `json:"doms"`
+		}
+		if err := r.call(http.MethodGet, "/v1/ns/service/list", params, &list); err != nil {
+			return nil, err
+		}
+		names = append(names, list.Doms...)
+		if len(list.Doms) < pageSize || len(names) >= list.Count {
+			return names, nil
+		}
+	}
+}
+
+// params returns the common params of instance API
+func (r *NacosAdapter) params(name string) url.Values {
+	params := url.Values{}
+	params.Set("serviceName", name)
+	params.Set("groupName", r.group)
+	params.Set("ephemeral", strconv.FormatBool(r.ephemeral))
+	if r.namespace != "" {
+		params.Set("namespaceId", r.namespace)
+	}
+	return params
+}
+
+// metadata returns the instance metadata of service, the attrs besides the
+// service fields which nacos doesn't keep, and the expiry of ephemeral
+// instance from the TTL
+func (r *NacosAdapter) metadata(service *bridge.Service) map[string]string {
+	metadata := make(map[string]string, len(service.Attrs)+6)
+	for k, v := range service.Attrs {
+		metadata[k] = v
+	}
+	metadata[metaID] = service.ID
+	metadata[metaNode] = bridge.LocalNode.ID
+	if service.IP != "" {
+		metadata[metaAddress] = service.IP
+	}
+	if len(service.Tags) > 0 {
+		metadata[metaTags] = strings.Join(service.Tags, ",")
+	}
+	if r.ephemeral && service.RefreshInterval > 0 {
+		metadata[metaBeatInterval] = strconv.Itoa(service.RefreshInterval * 1000)
+	}
+	if r.ephemeral && service.TTL > 0 {
+		timeout := strconv.Itoa(service.TTL * 1000)
+		metadata[metaBeatTimeout] = timeout
+		metadata[metaDeleteTimeout] = timeout
+	}
+	return metadata
+}
+
+// address returns the instance ip of service, nacos requires it
+func address(service *bridge.Service) string {
+	if service.IP != "" {
+		return service.IP
+	}
+	return bridge.LocalNode.Address
+}
+
+// toService converts nacos instance to bridge service, it's the reverse of Register
+func toService(name string, i *instance) *bridge.Service {
+	service := &bridge.Service{
+		ID:   i.Metadata[metaID],
+		Name: name,
+		Port: i.Port,
+		IP:   i.Metadata[metaAddress],
+	}
+	if tags := i.Metadata[metaTags]; tags != "" {
+		service.Tags = strings.Split(tags, ",")
+	}
+	for k, v := range i.Metadata {
+		switch k {
+		case metaID, metaNode, metaAddress, metaTags, metaBeatInterval, metaBeatTimeout, metaDeleteTimeout:
+			continue
+		}
+		if service.Attrs == nil {
+			service.Attrs = make(map[string]string)
+		}
+		service.Attrs[k] = v
+	}
+	return service
+}
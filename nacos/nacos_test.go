@@ -0,0 +1,232 @@
+package nacos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// server the stand-in of nacos server keeping the instances of a namespace and group
+type server struct {
+	sync.Mutex
+	*httptest.Server
+	// instances keyed by service name and ip:port
+	instances map[string]map[string]*instance
+	logins    int
+	beats     int
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{instances: make(map[string]map[string]*instance)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+
+		query := r.URL.Query()
+		if r.URL.Path == "/nacos/v1/auth/login" {
+			r.ParseForm()
+			if r.PostForm.Get("username") != "nacos" || r.PostForm.Get("password") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			s.logins++
+			json.NewEncoder(w).Encode(map[string]interface{}{"accessToken": "token", "tokenTtl": 18000})
+			return
+		}
+		if query.Get("accessToken") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if group := query.Get("groupName"); query.Get("serviceName") != "" && group != "web" {
+			t.Errorf("group = %s", group)
+		}
+
+		name := query.Get("serviceName")
+		key := query.Get("ip") + ":" + query.Get("port")
+		switch r.Method + " " + r.URL.Path {
+		case "GET /nacos/v1/ns/operator/metrics":
+			w.Write([]byte(`{"status":"UP"}`))
+		case "POST /nacos/v1/ns/instance":
+			port, _ := strconv.Atoi(query.Get("port"))
+			i := &instance{IP: query.Get("ip"), Port: port, ClusterName: query.Get("clusterName")}
+			if err := json.Unmarshal([]byte(query.Get("metadata")), &i.Metadata); err != nil {
+				t.Errorf("decode metadata: %v", err)
+			}
+			if s.instances[name] == nil {
+				s.instances[name] = make(map[string]*instance)
+			}
+			s.instances[name][key] = i
+			w.Write([]byte("ok"))
+		case "DELETE /nacos/v1/ns/instance":
+			if _, ok := s.instances[name][key]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(s.instances[name], key)
+			w.Write([]byte("ok"))
+		case "PUT /nacos/v1/ns/instance/beat":
+			var beat struct {
+				IP   string `json:"ip"`
+				Port int    `json:"port"`
+			}
+			json.Unmarshal([]byte(query.Get("beat")), &beat)
+			if _, ok := s.instances[name][beat.IP+":"+strconv.Itoa(beat.Port)]; !ok {
+				w.Write([]byte(`{"code":20404}`))
+				return
+			}
+			s.beats++
+			w.Write([]byte(`{"code":10200}`))
+		case "GET /nacos/v1/ns/service/list":
+			var names []string
+			for name := range s.instances {
+				names = append(names, name)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"count": len(names), "doms": names})
+		case "GET /nacos/v1/ns/instance/list":
+			hosts := []*instance{}
+			for _, i := range s.instances[name] {
+				hosts = append(hosts, i)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"hosts": hosts})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	return s
+}
+
+func (s *server) instance(name, key string) *instance {
+	s.Lock()
+	defer s.Unlock()
+	return s.instances[name][key]
+}
+
+func TestAdapter(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	s := newServer(t)
+	defer s.Close()
+
+	uri, _ := url.Parse("nacos://nacos:secret@" + strings.TrimPrefix(s.URL, "http://") + "?group=web")
+	r := new(Factory).New(uri).(*NacosAdapter)
+	if !r.RequiresRefresh() {
+		t.Error("RequiresRefresh() of ephemeral instances = false")
+	}
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	service := &bridge.Service{
+		ID:              "[test]:web:8080",
+		Name:            "web",
+		Port:            8080,
+		Tags:            []string{"a", "b"},
+		Attrs:           map[string]string{"version": "1"},
+		TTL:             30,
+		RefreshInterval: 10,
+	}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	i := s.instance("web", "10.0.0.5:8080")
+	if i == nil {
+		t.Fatal("instance is not registered")
+	}
+	for k, v := range map[string]string{
+		metaBeatInterval:  "10000",
+		metaBeatTimeout:   "30000",
+		metaDeleteTimeout: "30000",
+		metaID:            service.ID,
+		metaNode:          "node-1",
+		"version":         "1",
+	} {
+		if i.Metadata[k] != v {
+			t.Errorf("metadata %s = %s, want %s", k, i.Metadata[k], v)
+		}
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 1 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if fields := bridge.Diff(service, services[0]); len(fields) != 0 {
+		t.Errorf("drifted fields = %v", fields)
+	}
+
+	if err := r.Refresh(service); err != nil || s.beats != 1 {
+		t.Errorf("Refresh() = %v, beats %d", err, s.beats)
+	}
+
+	// deregistered by id only, e.g. cleanup
+	if err := r.Deregister(&bridge.Service{ID: service.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if s.instance("web", "10.0.0.5:8080") != nil {
+		t.Error("instance is not deregistered")
+	}
+
+	// registered again as nacos lost it
+	if err := r.Refresh(service); err != nil || s.instance("web", "10.0.0.5:8080") == nil {
+		t.Errorf("Refresh() of lost instance = %v", err)
+	}
+	if s.logins != 1 {
+		t.Errorf("logins = %d, want 1", s.logins)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+	preferred, fallback := newServer(t), newServer(t)
+	defer fallback.Close()
+
+	host := func(s *server) string { return strings.TrimPrefix(s.URL, "http://") }
+	uri, _ := url.Parse("nacos://nacos:secret@" + host(preferred) + "," + host(fallback) + "?group=web")
+	r := new(Factory).New(uri).(*NacosAdapter)
+	if err := r.Ping(); err != nil || r.Endpoint() != preferred.URL+"/nacos" {
+		t.Fatalf("Ping() = %v, endpoint %s", err, r.Endpoint())
+	}
+
+	// the preferred server goes down between pings
+	preferred.Close()
+	service := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if fallback.instance("web", "10.0.0.5:8080") == nil || r.Endpoint() != fallback.URL+"/nacos" {
+		t.Errorf("instance is not registered on the fallback server, endpoint %s", r.Endpoint())
+	}
+	if err := r.Deregister(service); err != nil || fallback.instance("web", "10.0.0.5:8080") != nil {
+		t.Errorf("Deregister() = %v", err)
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	uri, _ := url.Parse("nacos://127.0.0.1:8848?ephemeral=false")
+	r := new(Factory).New(uri).(*NacosAdapter)
+	if r.RequiresRefresh() {
+		t.Error("RequiresRefresh() of persistent instances = true")
+	}
+	metadata := r.metadata(&bridge.Service{ID: "x", TTL: 30, RefreshInterval: 10})
+	if _, ok := metadata[metaBeatInterval]; ok {
+		t.Errorf("metadata of persistent instance = %v", metadata)
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	uri, _ := url.Parse("nacos://nacos:wrong@" + strings.TrimPrefix(s.URL, "http://"))
+	r := new(Factory).New(uri).(*NacosAdapter)
+	if err := r.Ping(); err == nil || !strings.Contains(err.Error(), "login failed") {
+		t.Errorf("Ping() = %v, want login failed", err)
+	}
+}
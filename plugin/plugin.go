@@ -0,0 +1,367 @@
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "plugin")
+
+// DefaultTimeout default timeout of the calls of plugin, they're made with the
+// bridge locked, so a hanging plugin is killed soon
+const DefaultTimeout = 5 * time.Second
+
+// executablePrefix prefix of the executable of plugin in PATH
+const executablePrefix = "registrator-plugin-"
+
+var errNotRunning = errors.New("plugin: not running, it's restarted by the next ping")
+
+func init() {
+	bridge.Register(new(Factory), "plugin")
+}
+
+type Factory struct{}
+
+// New returns the adapter of plugin, e.g. plugin://etcd?endpoints=127.0.0.1:2379,
+// the executable is registrator-plugin-<name> in PATH unless the path option
+// is given. The options other than path and timeout are passed to the plugin
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	name := uri.Host
+	if name == "" {
+		log.Fatal("plugin: name is required, e.g. plugin://name")
+	}
+
+	path := query.Get("path")
+	if path == "" {
+		path = executablePrefix + name
+	}
+	path, err := exec.LookPath(path)
+	if err != nil {
+		log.Fatalf("plugin: %v", err)
+	}
+
+	timeout := DefaultTimeout
+	if value := query.Get("timeout"); value != "" {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			log.Fatalf("plugin: invalid timeout %q", value)
+		}
+	}
+
+	query.Del("path")
+	query.Del("timeout")
+	target := *uri
+	target.RawQuery = query.Encode()
+
+	r := &PluginAdapter{name: name, path: path, uri: target.String(), timeout: timeout}
+	if r.current, err = r.start(); err != nil {
+		log.Fatalf("plugin: start %s failed: %v", path, err)
+	}
+	return r
+}
+
+// PluginAdapter delegates to the external plugin process, which speaks the
+// JSON-RPC protocol mirroring bridge.RegistryAdapter over its stdin and stdout.
+//
+// The plugin is health checked by Ping, it's killed If a call times out, and
+// restarted by the next Ping once it exited. The endpoint is the executable
+// with the pid, so all services are resynced after restart as the Failover
+// ones, the plugin may have lost them.
+type PluginAdapter struct {
+	sync.Mutex
+	name    string
+	path    string
+	uri     string
+	timeout time.Duration
+
+	current    *process
+	runsChecks bool
+	closed     bool
+}
+
+// process the running plugin process
+type process struct {
+	cmd    *exec.Cmd
+	client *rpc.Client
+	// exited closed when the process exited
+	exited chan struct{}
+}
+
+// start starts the plugin process and shakes hands with it
+func (r *PluginAdapter) start() (*process, error) {
+	// the pipes of exec are closed by Wait, which may be before the replies are
+	// read till the end, so they're created by hand
+	stdinReader, stdin, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		closeFiles(stdinReader, stdin)
+		return nil, err
+	}
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		closeFiles(stdinReader, stdin, stdout, stdoutWriter)
+		return nil, err
+	}
+
+	cmd := exec.Command(r.path)
+	cmd.Env = append(os.Environ(), envProtocol+"="+strconv.Itoa(ProtocolVersion))
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = stderrWriter
+	// the plugin must not be killed by the signals of terminal before Close
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = cmd.Start()
+	// the ends of child are inherited by it
+	closeFiles(stdinReader, stdoutWriter, stderrWriter)
+	if err != nil {
+		closeFiles(stdin, stdout, stderr)
+		return nil, err
+	}
+
+	p := &process{
+		cmd:    cmd,
+		client: jsonrpc.NewClient(stdio{stdout, stdin}),
+		exited: make(chan struct{}),
+	}
+	go r.forward(stderr, cmd.Process.Pid)
+	go func() {
+		err := cmd.Wait()
+		close(p.exited)
+		p.client.Close()
+
+		r.Lock()
+		closed := r.closed
+		r.Unlock()
+		if !closed {
+			log.Warnf("plugin: %s (pid %d) exited: %v", r.name, cmd.Process.Pid, exitError(err))
+		}
+	}()
+
+	var resp HandshakeResponse
+	err = r.call(p, methodHandshake, &HandshakeRequest{
+		ProtocolVersions: []int{ProtocolVersion},
+		URI:              r.uri,
+		HardwareID:       bridge.HardwareID,
+		Node:             bridge.LocalNode,
+	}, &resp)
+	if err == nil && resp.ProtocolVersion != ProtocolVersion {
+		err = fmt.Errorf("plugin: unsupported protocol version %d", resp.ProtocolVersion)
+	}
+	if err != nil {
+		p.cmd.Process.Kill()
+		return nil, fmt.Errorf("handshake failed: %v", err)
+	}
+
+	r.runsChecks = resp.RunsChecks
+	log.Infof("plugin: started %s (pid %d), protocol version %d", r.path, cmd.Process.Pid, resp.ProtocolVersion)
+	return p, nil
+}
+
+// forward logs the stderr lines of plugin until it exited
+func (r *PluginAdapter) forward(stderr io.ReadCloser, pid int) {
+	defer stderr.Close()
+	logger := log.WithField("plugin", r.name).WithField("pid", pid)
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logger.Info(scanner.Text())
+	}
+}
+
+// call calls the method of plugin, the plugin is killed If the call times out
+// as it's hanging
+func (r *PluginAdapter) call(p *process, method string, args interface{}, reply interface{}) error {
+	call := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-call.Done:
+		if err, ok := call.Error.(rpc.ServerError); ok {
+			return errors.New(string(err))
+		}
+		if call.Error != nil {
+			return fmt.Errorf("plugin: %s: %v", method, call.Error)
+		}
+		return nil
+	case <-p.exited:
+		return fmt.Errorf("plugin: %s exited during %s", r.name, method)
+	case <-timer.C:
+		log.Warnf("plugin: %s timed out after %v, killing %s (pid %d)", method, r.timeout, r.name, p.cmd.Process.Pid)
+		p.cmd.Process.Kill()
+		return fmt.Errorf("plugin: %s timed out", method)
+	}
+}
+
+// running returns the running plugin process
+func (r *PluginAdapter) running() (*process, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return nil, errors.New("plugin: closed")
+	}
+	if r.current == nil {
+		return nil, errNotRunning
+	}
+	select {
+	case <-r.current.exited:
+		return nil, errNotRunning
+	default:
+		return r.current, nil
+	}
+}
+
+// Ping pings the plugin, which is restarted first If it has exited
+func (r *PluginAdapter) Ping() error {
+	p, err := r.running()
+	if err == errNotRunning {
+		p, err = r.restart()
+	}
+	if err != nil {
+		return err
+	}
+	return r.call(p, methodPing, &Empty{}, &Empty{})
+}
+
+// restart starts the plugin again unless it has been restarted by others or
+// the adapter is closed
+func (r *PluginAdapter) restart() (*process, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return nil, errors.New("plugin: closed")
+	}
+	if r.current != nil {
+		select {
+		case <-r.current.exited:
+		default:
+			return r.current, nil
+		}
+	}
+
+	p, err := r.start()
+	if err != nil {
+		return nil, fmt.Errorf("plugin: restart %s failed: %v", r.path, err)
+	}
+	r.current = p
+	return p, nil
+}
+
+func (r *PluginAdapter) Register(service *bridge.Service) error {
+	p, err := r.running()
+	if err != nil {
+		return err
+	}
+	return r.call(p, methodRegister, service, &Empty{})
+}
+
+func (r *PluginAdapter) Deregister(service *bridge.Service) error {
+	p, err := r.running()
+	if err != nil {
+		return err
+	}
+	return r.call(p, methodDeregister, service, &Empty{})
+}
+
+func (r *PluginAdapter) Refresh(service *bridge.Service) error {
+	p, err := r.running()
+	if err != nil {
+		return err
+	}
+	return r.call(p, methodRefresh, service, &Empty{})
+}
+
+func (r *PluginAdapter) Services() ([]*bridge.Service, error) {
+	p, err := r.running()
+	if err != nil {
+		return nil, err
+	}
+	var resp ServicesResponse
+	if err := r.call(p, methodServices, &Empty{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Services, nil
+}
+
+// RunsChecks returns the capability declared by plugin on handshake
+func (r *PluginAdapter) RunsChecks() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.runsChecks
+}
+
+// Endpoint returns the executable with the pid of plugin, so the services are
+// resynced after the plugin restarted
+func (r *PluginAdapter) Endpoint() string {
+	r.Lock()
+	defer r.Unlock()
+	if r.current == nil {
+		return r.path
+	}
+	return fmt.Sprintf("%s[%d]", r.path, r.current.cmd.Process.Pid)
+}
+
+// Close closes the adapter of plugin and stdin, the plugin is killed If it
+// doesn't exit in time. The adapter is closed first, so the plugin which has
+// exited is not restarted by a concurrent Ping
+func (r *PluginAdapter) Close() error {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil
+	}
+	r.closed = true
+	p := r.current
+	r.Unlock()
+
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+
+	err := r.call(p, methodClose, &Empty{}, &Empty{})
+	p.client.Close()
+
+	select {
+	case <-p.exited:
+	case <-time.After(r.timeout):
+		log.Warnf("plugin: %s (pid %d) didn't exit in %v, killing it", r.name, p.cmd.Process.Pid, r.timeout)
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+	return err
+}
+
+func closeFiles(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// exitError returns the description of exit status
+func exitError(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// TestMain serves the fake adapter when the test binary is launched as the
+// plugin by the tests
+func TestMain(m *testing.M) {
+	if os.Getenv(envProtocol) != "" {
+		Serve(new(fakeFactory))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type fakeFactory struct{}
+
+func (f *fakeFactory) New(uri *url.URL) bridge.RegistryAdapter {
+	if uri.Query().Get("fail") != "" {
+		os.Exit(2)
+	}
+	return &fakeAdapter{runsChecks: uri.Query().Get("checks") != "", services: make(map[string]*bridge.Service)}
+}
+
+// fakeAdapter the adapter in plugin process, it hangs on registering the
+// service named hang and exits on the one named crash
+type fakeAdapter struct {
+	sync.Mutex
+	runsChecks bool
+	services   map[string]*bridge.Service
+}
+
+func (r *fakeAdapter) Ping() error {
+	if bridge.LocalNode.ID != "node-1" || bridge.HardwareID != "hw" {
+		return errors.New("node is not handed over")
+	}
+	return nil
+}
+
+func (r *fakeAdapter) Register(service *bridge.Service) error {
+	switch service.Name {
+	case "hang":
+		select {}
+	case "crash":
+		os.Exit(3)
+	case "invalid":
+		return errors.New("invalid service")
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.services[service.ID] = service
+	return nil
+}
+
+func (r *fakeAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.services, service.ID)
+	return nil
+}
+
+func (r *fakeAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+func (r *fakeAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+func (r *fakeAdapter) RunsChecks() bool {
+	return r.runsChecks
+}
+
+func newAdapter(t *testing.T, options string) *PluginAdapter {
+	bridge.HardwareID = "hw"
+	bridge.LocalNode.ID = "node-1"
+
+	uri, err := url.Parse("plugin://fake?timeout=500ms&path=" + url.QueryEscape(os.Args[0]) + options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(Factory).New(uri).(*PluginAdapter)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestHandshake(t *testing.T) {
+	r := newAdapter(t, "&checks=1")
+	if !r.RunsChecks() {
+		t.Error("RunsChecks() = false")
+	}
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if r.uri != "plugin://fake?checks=1" {
+		t.Errorf("uri = %s", r.uri)
+	}
+
+	// the plugin exited on handshake
+	r.uri = "plugin://fake?fail=1"
+	if _, err := r.start(); err == nil || !strings.Contains(err.Error(), "handshake failed") {
+		t.Errorf("start() = %v", err)
+	}
+}
+
+func TestCalls(t *testing.T) {
+	r := newAdapter(t, "")
+
+	service := &bridge.Service{ID: "hw:web:80", Name: "web", Port: 80}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if err := r.Refresh(service); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	services, err := r.Services()
+	if err != nil || len(services) != 1 || services[0].ID != service.ID || services[0].Port != 80 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if err := r.Register(&bridge.Service{ID: "hw:invalid:80", Name: "invalid"}); err == nil || err.Error() != "invalid service" {
+		t.Errorf("Register() = %v", err)
+	}
+	if err := r.Deregister(&bridge.Service{ID: service.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if services, _ := r.Services(); len(services) != 0 {
+		t.Errorf("Services() after deregister = %v", services)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	r := newAdapter(t, "")
+	endpoint := r.Endpoint()
+
+	if err := r.Register(&bridge.Service{ID: "hw:crash:80", Name: "crash"}); err == nil {
+		t.Fatal("Register() succeeded")
+	}
+	<-r.current.exited
+	if err := r.Register(&bridge.Service{ID: "hw:web:80", Name: "web"}); err != errNotRunning {
+		t.Errorf("Register() while not running = %v", err)
+	}
+
+	// restarted by ping with a new endpoint, so services are resynced
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+	if r.Endpoint() == endpoint {
+		t.Errorf("endpoint %s is not changed after restart", endpoint)
+	}
+	if err := r.Register(&bridge.Service{ID: "hw:web:80", Name: "web"}); err != nil {
+		t.Errorf("Register() after restart = %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	r := newAdapter(t, "")
+	p := r.current
+
+	start := time.Now()
+	if err := r.Register(&bridge.Service{ID: "hw:hang:80", Name: "hang"}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Register() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Register() took %v", elapsed)
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("hanging plugin is not killed")
+	}
+	if err := r.Ping(); err != nil {
+		t.Errorf("Ping() after restart = %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := newAdapter(t, "")
+	p := r.current
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	select {
+	case <-p.exited:
+	default:
+		t.Error("plugin is running after Close()")
+	}
+
+	// the plugin which exited is not restarted once closed
+	r = newAdapter(t, "")
+	r.Register(&bridge.Service{ID: "hw:crash:80", Name: "crash"})
+	<-r.current.exited
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := r.Ping(); err == nil {
+		t.Error("Ping() after Close() succeeded")
+	}
+	if _, err := r.restart(); err == nil {
+		t.Error("restart() after Close() succeeded")
+	}
+}
@@ -0,0 +1,67 @@
+package plugin
+
+import (
+	"io"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// ProtocolVersion version of the plugin protocol, it's bumped on incompatible
+// changes, plugins may support several versions and choose one on handshake
+const ProtocolVersion = 1
+
+// envProtocol environment variable of the protocol version set for plugins,
+// so they know they're launched by registrator rather than run by hand
+const envProtocol = "REGISTRATOR_PLUGIN_PROTOCOL"
+
+// methods of plugin, served by the JSON-RPC 1.0 of net/rpc/jsonrpc
+const (
+	methodHandshake  = "Plugin.Handshake"
+	methodPing       = "Plugin.Ping"
+	methodRegister   = "Plugin.Register"
+	methodDeregister = "Plugin.Deregister"
+	methodRefresh    = "Plugin.Refresh"
+	methodServices   = "Plugin.Services"
+	methodClose      = "Plugin.Close"
+)
+
+// HandshakeRequest the first request after plugin started
+type HandshakeRequest struct {
+	// ProtocolVersions versions supported by registrator
+	ProtocolVersions []int `json:"protocol_versions"`
+	// URI the plugin URI without the options of registrator, passed to the
+	// adapter factory of plugin
+	URI string `json:"uri"`
+	// HardwareID the node id, which is the prefix of service ids
+	HardwareID string      `json:"hardware_id"`
+	Node       bridge.Node `json:"node"`
+}
+
+// HandshakeResponse the version chosen by plugin and its capabilities
+type HandshakeResponse struct {
+	ProtocolVersion int `json:"protocol_version"`
+	// RunsChecks whether the backend runs the health checks of services
+	RunsChecks bool `json:"runs_checks"`
+}
+
+// Empty arguments and replies of the methods without ones
+type Empty struct{}
+
+// ServicesResponse reply of Plugin.Services
+type ServicesResponse struct {
+	Services []*bridge.Service `json:"services"`
+}
+
+// stdio the protocol channel of a pair of pipes, e.g. stdin and stdout
+type stdio struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (s stdio) Close() error {
+	err := s.WriteCloser.Close()
+	if rerr := s.ReadCloser.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// Serve serves the adapter of factory over stdin and stdout until registrator
+// closes stdin, it's the main of plugins, e.g.
+//
+//	func main() {
+//		plugin.Serve(new(etcd.Factory))
+//	}
+//
+// The adapter is created on handshake with the plugin URI, bridge.LocalNode and
+// bridge.HardwareID are set to the ones of registrator before. Stdout is the
+// protocol channel, so the plugin must log to stderr, which is the default of
+// logrus, and its lines are logged by registrator.
+func Serve(factory bridge.AdapterFactory) {
+	if os.Getenv(envProtocol) == "" {
+		fmt.Fprintln(os.Stderr, "This is a registrator plugin, it's launched by registrator with the plugin:// registry URI")
+		os.Exit(1)
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &rpcServer{factory: factory}); err != nil {
+		fmt.Fprintf(os.Stderr, "plugin: %v\n", err)
+		os.Exit(1)
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{os.Stdin, os.Stdout}))
+}
+
+// rpcServer the methods of plugin, which call the adapter created on handshake
+type rpcServer struct {
+	sync.Mutex
+	factory bridge.AdapterFactory
+	adapter bridge.RegistryAdapter
+}
+
+func (s *rpcServer) Handshake(req *HandshakeRequest, resp *HandshakeResponse) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.adapter != nil {
+		return errors.New("plugin: handshake done already")
+	}
+
+	supported := false
+	for _, version := range req.ProtocolVersions {
+		if version == ProtocolVersion {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("plugin: protocol versions %v are not supported, the plugin speaks %d", req.ProtocolVersions, ProtocolVersion)
+	}
+
+	uri, err := url.Parse(req.URI)
+	if err != nil {
+		return fmt.Errorf("plugin: bad uri %s", req.URI)
+	}
+	bridge.HardwareID = req.HardwareID
+	bridge.LocalNode = req.Node
+	if bridge.LocalNode.Meta == nil {
+		bridge.LocalNode.Meta = make(map[string]string)
+	}
+
+	s.adapter = s.factory.New(uri)
+	resp.ProtocolVersion = ProtocolVersion
+	if adapter, ok := s.adapter.(bridge.CheckingAdapter); ok {
+		resp.RunsChecks = adapter.RunsChecks()
+	}
+	return nil
+}
+
+func (s *rpcServer) Ping(_ *Empty, _ *Empty) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return adapter.Ping()
+}
+
+func (s *rpcServer) Register(service *bridge.Service, _ *Empty) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return adapter.Register(service)
+}
+
+func (s *rpcServer) Deregister(service *bridge.Service, _ *Empty) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return adapter.Deregister(service)
+}
+
+func (s *rpcServer) Refresh(service *bridge.Service, _ *Empty) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return adapter.Refresh(service)
+}
+
+func (s *rpcServer) Services(_ *Empty, resp *ServicesResponse) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	resp.Services, err = adapter.Services()
+	return err
+}
+
+// Close closes the adapter If it holds resources, registrator closes stdin
+// after, so Serve returns
+func (s *rpcServer) Close(_ *Empty, _ *Empty) error {
+	adapter, err := s.registry()
+	if err != nil {
+		return err
+	}
+	if closable, ok := adapter.(bridge.ClosableAdapter); ok {
+		return closable.Close()
+	}
+	return nil
+}
+
+// registry returns the adapter created on handshake
+func (s *rpcServer) registry() (bridge.RegistryAdapter, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.adapter == nil {
+		return nil, errors.New("plugin: handshake is required")
+	}
+	return s.adapter, nil
+}
@@ -0,0 +1,267 @@
+package redis
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "redis")
+
+// DefaultPrefix default prefix of keys
+const DefaultPrefix = "registrator"
+
+// events published on changes
+const (
+	EventRegister   = "register"
+	EventDeregister = "deregister"
+)
+
+const requestTimeout = 10 * time.Second
+
+func init() {
+	f := new(Factory)
+	bridge.Register(f, "redis")
+	bridge.Register(f, "rediss")
+}
+
+type Factory struct{}
+
+// New returns the redis adapter, e.g. redis://:password@127.0.0.1:6379/0?prefix=edge,
+// rediss for TLS
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+	r := &RedisAdapter{prefix: query.Get("prefix")}
+	if r.prefix == "" {
+		r.prefix = DefaultPrefix
+	}
+	r.channel = query.Get("channel")
+	if r.channel == "" {
+		r.channel = r.prefix + ":events"
+	}
+
+	// the options are not known by redis
+	target := *uri
+	target.RawQuery = ""
+	address := target.String()
+
+	r.pool = &redis.Pool{
+		MaxIdle:     2,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(address,
+				redis.DialConnectTimeout(requestTimeout),
+				redis.DialReadTimeout(requestTimeout),
+				redis.DialWriteTimeout(requestTimeout))
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+	return r
+}
+
+// RedisAdapter stores each service as the hash <prefix>:service:<name>:<id>,
+// indexed by the set <prefix>:services:<name> of each service name, of which
+// the members are the keys of hashes. The services of this node are indexed
+// by the hash <prefix>:node:<node id> from the keys of hashes to the names.
+// The hashes expire after -ttl unless refreshed, the index entries of expired
+// ones are removed when the services are listed. The changes are published
+// to the channel as JSON events.
+type RedisAdapter struct {
+	pool    *redis.Pool
+	prefix  string
+	channel string
+}
+
+// event message published on changes
+type event struct {
+	Event   string          `json:"event"`
+	Node    string          `json:"node"`
+	Key     string          `json:"key"`
+	Service *bridge.Service `json:"service"`
+}
+
+func (r *RedisAdapter) Ping() error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	return err
+}
+
+func (r *RedisAdapter) Register(service *bridge.Service) error {
+	address := service.IP
+	if address == "" {
+		address = bridge.LocalNode.Address
+	}
+	tags, err := json.Marshal(service.Tags)
+	if err != nil {
+		return err
+	}
+	attrs, err := json.Marshal(service.Attrs)
+	if err != nil {
+		return err
+	}
+	s := *service
+	s.Checks = nil
+	s.TTL = 0
+	definition, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+
+	key := r.serviceKey(service.Name, service.ID)
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	conn.Send("HSET", key,
+		"id", service.ID,
+		"node", bridge.LocalNode.ID,
+		"name", service.Name,
+		"address", address,
+		"port", service.Port,
+		"tags", tags,
+		"attrs", attrs,
+		"service", definition)
+	if service.TTL > 0 {
+		conn.Send("EXPIRE", key, service.TTL)
+	}
+	conn.Send("SADD", r.namesKey(service.Name), key)
+	conn.Send("HSET", r.nodeKey(), key, service.Name)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	log.Debugf("redis: registered %s", key)
+	r.publish(conn, EventRegister, key, service)
+	return nil
+}
+
+func (r *RedisAdapter) Deregister(service *bridge.Service) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// the name is unknown when the service is deregistered by id only
+	key := r.serviceKey(service.Name, service.ID)
+	if service.Name == "" {
+		owned, err := redis.StringMap(conn.Do("HGETALL", r.nodeKey()))
+		if err != nil {
+			return err
+		}
+		key = ""
+		for k, name := range owned {
+			if k == r.serviceKey(name, service.ID) {
+				key = k
+				service = &bridge.Service{ID: service.ID, Name: name}
+				break
+			}
+		}
+		if key == "" {
+			return nil
+		}
+	}
+
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	conn.Send("SREM", r.namesKey(service.Name), key)
+	conn.Send("HDEL", r.nodeKey(), key)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	log.Debugf("redis: deregistered %s", key)
+	r.publish(conn, EventDeregister, key, service)
+	return nil
+}
+
+// Refresh renews the expiry of service, it's registered again If the hash is
+// lost, e.g. it expired or redis restarted without persistence
+func (r *RedisAdapter) Refresh(service *bridge.Service) error {
+	if service.TTL <= 0 {
+		return nil
+	}
+
+	conn := r.pool.Get()
+	ok, err := redis.Bool(conn.Do("EXPIRE", r.serviceKey(service.Name, service.ID), service.TTL))
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Infof("redis: service %s not found, registering it again", service.ID)
+		return r.Register(service)
+	}
+	return nil
+}
+
+// Services returns the services in the index of this node, the members of
+// which the hash has expired are removed from the indexes
+func (r *RedisAdapter) Services() ([]*bridge.Service, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	owned, err := redis.StringMap(conn.Do("HGETALL", r.nodeKey()))
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]*bridge.Service, 0, len(owned))
+	for key, name := range owned {
+		values, err := redis.Strings(conn.Do("HMGET", key, "id", "service"))
+		if err != nil {
+			return nil, err
+		}
+		id, definition := values[0], values[1]
+		if id == "" {
+			log.Debugf("redis: %s expired, removing it from indexes", key)
+			if _, err := conn.Do("SREM", r.namesKey(name), key); err != nil {
+				return nil, err
+			}
+			if _, err := conn.Do("HDEL", r.nodeKey(), key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		service := new(bridge.Service)
+		if err := json.Unmarshal([]byte(definition), service); err != nil {
+			service = &bridge.Service{ID: id, Name: name}
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// publish publishes the event of service, failures are only logged as the
+// subscribers are optional
+func (r *RedisAdapter) publish(conn redis.Conn, name, key string, service *bridge.Service) {
+	message, err := json.Marshal(&event{Event: name, Node: bridge.LocalNode.ID, Key: key, Service: service})
+	if err != nil {
+		return
+	}
+	if _, err := conn.Do("PUBLISH", r.channel, message); err != nil {
+		log.Warnf("redis: publish %s of %s failed: %v", name, service.ID, err)
+	}
+}
+
+func (r *RedisAdapter) serviceKey(name, id string) string {
+	return r.prefix + ":service:" + name + ":" + id
+}
+
+func (r *RedisAdapter) namesKey(name string) string {
+	return r.prefix + ":services:" + name
+}
+
+func (r *RedisAdapter) nodeKey() string {
+	return r.prefix + ":node:" + bridge.LocalNode.ID
+}
@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/feifeigood/registrator/bridge"
+)
+
+func newAdapter(t *testing.T) (*RedisAdapter, *miniredis.Miniredis) {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	uri, _ := url.Parse("redis://" + s.Addr() + "/0?prefix=edge")
+	r := new(Factory).New(uri).(*RedisAdapter)
+	t.Cleanup(func() { r.pool.Close() })
+	return r, s
+}
+
+func TestAdapter(t *testing.T) {
+	r, s := newAdapter(t)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	// the messages of miniredis are unbuffered, PUBLISH waits for them read
+	subscriber := s.NewSubscriber()
+	subscriber.Subscribe("edge:events")
+	events := make(chan miniredis.PubsubMessage, 2)
+	go func() {
+		for message := range subscriber.Messages() {
+			events <- message
+		}
+	}()
+
+	service := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80, Tags: []string{"http"}, TTL: 30}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+
+	key := "edge:service:web:[test]:web:80"
+	if address := s.HGet(key, "address"); address != "10.0.0.5" {
+		t.Errorf("address = %s", address)
+	}
+	if ttl := s.TTL(key); ttl != 30*time.Second {
+		t.Errorf("ttl = %v", ttl)
+	}
+	if ok, _ := s.SIsMember("edge:services:web", key); !ok {
+		t.Error("service is not indexed by name")
+	}
+	if name := s.HGet("edge:node:node-1", key); name != "web" {
+		t.Errorf("node index = %s", name)
+	}
+	select {
+	case message := <-events:
+		var e event
+		json.Unmarshal([]byte(message.Message), &e)
+		if e.Event != EventRegister || e.Key != key || e.Node != "node-1" {
+			t.Errorf("event = %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("register event is not published")
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 1 || services[0].ID != service.ID || services[0].Port != 80 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+
+	// deregistered by id only
+	if err := r.Deregister(&bridge.Service{ID: service.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if s.Exists(key) || s.HGet("edge:node:node-1", key) != "" {
+		t.Error("service is kept after deregistered")
+	}
+	if ok, _ := s.SIsMember("edge:services:web", key); ok {
+		t.Error("service is kept in the index of name")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	r, s := newAdapter(t)
+
+	service := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80, TTL: 30}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	key := "edge:service:web:[test]:web:80"
+
+	s.FastForward(20 * time.Second)
+	if err := r.Refresh(service); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if ttl := s.TTL(key); ttl != 30*time.Second {
+		t.Errorf("ttl after refresh = %v", ttl)
+	}
+
+	// the expired service is removed from the indexes when listed
+	s.FastForward(31 * time.Second)
+	services, err := r.Services()
+	if err != nil || len(services) != 0 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	if s.HGet("edge:node:node-1", key) != "" {
+		t.Error("expired service is kept in the node index")
+	}
+
+	// and registered again on refresh
+	if err := r.Refresh(service); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if !s.Exists(key) {
+		t.Error("expired service is not registered again")
+	}
+}
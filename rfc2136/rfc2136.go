@@ -0,0 +1,494 @@
+package rfc2136
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "rfc2136")
+
+// DefaultTTL TTL of records If -ttl is not set
+const DefaultTTL = 60
+
+const (
+	defaultPort    = "53"
+	requestTimeout = 10 * time.Second
+	// fudge allowed time skew of TSIG
+	fudge = 300
+	// chunkSize max length of a TXT string
+	chunkSize = 255
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+func init() {
+	bridge.Register(new(Factory), "rfc2136")
+}
+
+type Factory struct{}
+
+// New returns the adapter updating the zone by DNS dynamic update, e.g.
+// rfc2136://127.0.0.1:53/example.com?tsig=hmac-sha256:registrator.:c2VjcmV0.
+// The host can be a comma separated list of servers, the first healthy one is used
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	endpoints := bridge.ParseEndpoints(uri)
+	if len(endpoints) == 0 {
+		log.Fatal("rfc2136: host of DNS server is required, e.g. rfc2136://127.0.0.1:53/example.com")
+	}
+	for i, endpoint := range endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			endpoints[i] = net.JoinHostPort(endpoint, defaultPort)
+		}
+	}
+
+	zone := strings.Trim(uri.Path, "/")
+	if zone == "" {
+		log.Fatal("rfc2136: zone is required, e.g. rfc2136://127.0.0.1:53/example.com")
+	}
+	// the node id names the ownership records, it can't be changed once published
+	if label(bridge.LocalNode.ID) == "" {
+		log.Fatalf("rfc2136: node id %q is not a valid DNS label", bridge.LocalNode.ID)
+	}
+
+	r := &RFC2136Adapter{
+		endpoints: bridge.NewEndpoints(endpoints),
+		zone:      dns.Fqdn(strings.ToLower(zone)),
+		client:    &dns.Client{Net: "tcp", Timeout: requestTimeout},
+	}
+	if tsig := uri.Query().Get("tsig"); tsig != "" {
+		var err error
+		if r.tsigAlgorithm, r.tsigName, r.tsigSecret, err = parseTSIG(tsig); err != nil {
+			log.Fatalf("rfc2136: invalid tsig: %v", err)
+		}
+		r.client.TsigSecret = map[string]string{r.tsigName: r.tsigSecret}
+	}
+	return r
+}
+
+// parseTSIG parses TSIG key in the form [algorithm:]name:secret, the algorithm
+// defaults to hmac-sha256 and the secret is base64 encoded
+func parseTSIG(tsig string) (algorithm, name, secret string, err error) {
+	parts := strings.Split(tsig, ":")
+	switch len(parts) {
+	case 2:
+		algorithm, name, secret = "hmac-sha256", parts[0], parts[1]
+	case 3:
+		algorithm, name, secret = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", errors.New("must be in the form [algorithm:]name:secret")
+	}
+
+	algorithms := map[string]string{
+		"hmac-md5":    dns.HmacMD5,
+		"hmac-sha1":   dns.HmacSHA1,
+		"hmac-sha224": dns.HmacSHA224,
+		"hmac-sha256": dns.HmacSHA256,
+		"hmac-sha384": dns.HmacSHA384,
+		"hmac-sha512": dns.HmacSHA512,
+	}
+	if algorithm = algorithms[strings.ToLower(algorithm)]; algorithm == "" {
+		return "", "", "", fmt.Errorf("unsupported algorithm %s", parts[0])
+	}
+	if name == "" || secret == "" {
+		return "", "", "", errors.New("name and secret are required")
+	}
+	return algorithm, dns.Fqdn(name), secret, nil
+}
+
+// RFC2136Adapter publishes services in the zone by DNS dynamic update, each
+// service is published as the DNS-SD instance <instance>._<name>._tcp.<zone>
+// with SRV and TXT records, browsed by the PTR of _<name>._tcp.<zone>, which
+// also has the SRV records of all instances for the clients looking up SRV
+// directly. The target host <instance>.<zone> has the A or AAAA record.
+//
+// The services are tracked by the ownership records of this node, so that they
+// can be listed for cleanup. Each service is encoded in the TXT record of
+// <hash>.<node>._registrator.<zone>, and indexed by the PTR of
+// <node>._registrator.<zone>, so no single record set grows with the services.
+type RFC2136Adapter struct {
+	endpoints     *bridge.Endpoints
+	zone          string
+	client        *dns.Client
+	tsigAlgorithm string
+	tsigName      string
+	tsigSecret    string
+}
+
+// Ping queries the SOA of zone on the servers in the order of preference, and
+// fails over to the first healthy one
+func (r *RFC2136Adapter) Ping() error {
+	return r.endpoints.Failover(func(i int) error {
+		msg := new(dns.Msg)
+		msg.SetQuestion(r.zone, dns.TypeSOA)
+		resp, _, err := r.client.Exchange(msg, r.endpoints.All()[i])
+		if err != nil {
+			return err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("rfc2136: query SOA of %s: %s", r.zone, dns.RcodeToString[resp.Rcode])
+		}
+		return nil
+	})
+}
+
+// Endpoint returns the server in use
+func (r *RFC2136Adapter) Endpoint() string {
+	return r.endpoints.All()[r.endpoints.Current()]
+}
+
+// Register replaces the records of service, and the ownership records of the
+// service with the same id, in a single update
+func (r *RFC2136Adapter) Register(service *bridge.Service) error {
+	rrs, err := r.records(service)
+	if err != nil {
+		return err
+	}
+	owner, err := r.ownerRecord(service)
+	if err != nil {
+		return err
+	}
+
+	previous, err := r.lookup(r.ownerName(service.ID))
+	if err != nil {
+		return err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(r.zone)
+	if previous != nil {
+		r.removeRecords(msg, previous)
+	}
+	msg.Insert(append(rrs, r.indexRecord(service), owner))
+
+	log.Debugf("rfc2136: register %s: %v", service.ID, msg.Ns)
+	return r.update(msg)
+}
+
+func (r *RFC2136Adapter) Deregister(service *bridge.Service) error {
+	previous, err := r.lookup(r.ownerName(service.ID))
+	if err != nil || previous == nil {
+		return err
+	}
+
+	msg := new(dns.Msg)
+	msg.SetUpdate(r.zone)
+	r.removeRecords(msg, previous)
+
+	log.Debugf("rfc2136: deregister %s: %v", service.ID, msg.Ns)
+	return r.update(msg)
+}
+
+// Refresh records don't expire
+func (r *RFC2136Adapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services returns the services in the ownership records indexed by this node
+func (r *RFC2136Adapter) Services() ([]*bridge.Service, error) {
+	resp, err := r.query(r.indexName(), dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []*bridge.Service
+	for _, rr := range resp.Answer {
+		ptr, ok := rr.(*dns.PTR)
+		if !ok {
+			continue
+		}
+		service, err := r.lookup(ptr.Ptr)
+		if err != nil {
+			return nil, err
+		}
+		if service != nil {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+// lookup returns the service in the ownership record of name, nil If not found
+func (r *RFC2136Adapter) lookup(name string) (*bridge.Service, error) {
+	resp, err := r.query(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		service := new(bridge.Service)
+		definition, err := base64.StdEncoding.DecodeString(strings.Join(txt.Txt, ""))
+		if err == nil {
+			err = json.Unmarshal(definition, service)
+		}
+		if err != nil || service.ID == "" {
+			log.Warnf("rfc2136: invalid ownership record %s: %v", txt, err)
+			continue
+		}
+		return service, nil
+	}
+	return nil, nil
+}
+
+// query queries the records of name in type, the nonexistent name is not an error
+func (r *RFC2136Adapter) query(name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qtype)
+	resp, err := r.exchange(msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("rfc2136: query %s: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// records returns the records of service
+func (r *RFC2136Adapter) records(service *bridge.Service) ([]dns.RR, error) {
+	address := service.IP
+	if address == "" {
+		address = bridge.LocalNode.Address
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("rfc2136: invalid address %q of %s", address, service.ID)
+	}
+
+	txt, err := txtRecord(service)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := recordTTL(service)
+	browse, instance, host := r.names(service)
+
+	srv := func(name string) dns.RR {
+		return &dns.SRV{
+			Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl},
+			Port:   uint16(service.Port),
+			Target: host,
+		}
+	}
+	rrs := []dns.RR{
+		srv(browse),
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: browse, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: instance,
+		},
+		srv(instance),
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: txt,
+		},
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		rrs = append(rrs, &dns.A{
+			Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip4,
+		})
+	} else {
+		rrs = append(rrs, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+			AAAA: ip,
+		})
+	}
+	return rrs, nil
+}
+
+// ownerRecord returns the ownership record of service, the service is encoded
+// in base64 of JSON and split into strings of max length
+func (r *RFC2136Adapter) ownerRecord(service *bridge.Service) (dns.RR, error) {
+	s := *service
+	s.Checks = nil
+	s.TTL = 0
+	bs, err := json.Marshal(&s)
+	if err != nil {
+		return nil, err
+	}
+	definition := base64.StdEncoding.EncodeToString(bs)
+
+	var chunks []string
+	for len(definition) > chunkSize {
+		chunks = append(chunks, definition[:chunkSize])
+		definition = definition[chunkSize:]
+	}
+	chunks = append(chunks, definition)
+
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.ownerName(service.ID), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: recordTTL(service)},
+		Txt: chunks,
+	}, nil
+}
+
+// indexRecord returns the PTR record indexing the ownership record of service
+func (r *RFC2136Adapter) indexRecord(service *bridge.Service) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: r.indexName(), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: recordTTL(service)},
+		Ptr: r.ownerName(service.ID),
+	}
+}
+
+// removeRecords adds the deletions of the records of service and its
+// ownership records to the update, the records shared by the instances of
+// service name and by the services of this node are deleted by data
+func (r *RFC2136Adapter) removeRecords(msg *dns.Msg, service *bridge.Service) {
+	browse, instance, host := r.names(service)
+	owner := r.ownerName(service.ID)
+	msg.Remove([]dns.RR{
+		&dns.SRV{
+			Hdr:    dns.RR_Header{Name: browse, Rrtype: dns.TypeSRV, Class: dns.ClassINET},
+			Port:   uint16(service.Port),
+			Target: host,
+		},
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: browse, Rrtype: dns.TypePTR, Class: dns.ClassINET},
+			Ptr: instance,
+		},
+		&dns.PTR{
+			Hdr: dns.RR_Header{Name: r.indexName(), Rrtype: dns.TypePTR, Class: dns.ClassINET},
+			Ptr: owner,
+		},
+	})
+	msg.RemoveName([]dns.RR{
+		&dns.ANY{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeANY, Class: dns.ClassINET}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeANY, Class: dns.ClassINET}},
+		&dns.ANY{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeANY, Class: dns.ClassINET}},
+	})
+}
+
+// recordTTL returns the TTL of the records of service
+func recordTTL(service *bridge.Service) uint32 {
+	if service.TTL > 0 {
+		return uint32(service.TTL)
+	}
+	return DefaultTTL
+}
+
+// names returns the browse name _<name>._tcp.<zone>, the instance name
+// <instance>._<name>._tcp.<zone> and the host name <instance>.<zone> of
+// service. The instance label is the service name with the hash of id, as the
+// id is not a valid label
+func (r *RFC2136Adapter) names(service *bridge.Service) (browse, instance, host string) {
+	name := label(service.Name)
+	sum := sha1.Sum([]byte(service.ID))
+	instanceLabel := label(fmt.Sprintf("%s-%x", name, sum[:5]))
+
+	browse = "_" + name + "._tcp." + r.zone
+	return browse, instanceLabel + "." + browse, instanceLabel + "." + r.zone
+}
+
+// indexName returns the name of the PTR records indexing the ownership
+// records of this node
+func (r *RFC2136Adapter) indexName() string {
+	return label(bridge.LocalNode.ID) + "._registrator." + r.zone
+}
+
+// ownerName returns the name of the ownership record of service id, the label
+// is the hash of id, as the id is not a valid label
+func (r *RFC2136Adapter) ownerName(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return fmt.Sprintf("%x.%s", sum[:10], r.indexName())
+}
+
+// label returns the valid DNS label of s
+func label(s string) string {
+	s = strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(s) > 63 {
+		s = strings.TrimRight(s[:63], "-")
+	}
+	return s
+}
+
+// txtRecord returns the DNS-SD TXT strings of service, the attrs in the form
+// key=value and the tags in the form tags=tag1,tag2. Each pair is a single
+// string of max 255 bytes, it can't be split as the rest would be read as
+// another pair (RFC 6763 6.1), so the longer ones are rejected
+func txtRecord(service *bridge.Service) ([]string, error) {
+	keys := make([]string, 0, len(service.Attrs))
+	for k := range service.Attrs {
+		if k == "" || strings.Contains(k, "=") {
+			return nil, fmt.Errorf("rfc2136: invalid attr %q of %s, the key of TXT must be non-empty without =", k, service.ID)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	txt := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pair := k + "=" + service.Attrs[k]
+		if len(pair) > chunkSize {
+			return nil, fmt.Errorf("rfc2136: attr %s of %s is %d bytes as key=value, longer than the %d bytes of a TXT string", k, service.ID, len(pair), chunkSize)
+		}
+		txt = append(txt, escape(pair))
+	}
+	if len(service.Tags) > 0 {
+		pair := "tags=" + strings.Join(service.Tags, ",")
+		if len(pair) > chunkSize {
+			return nil, fmt.Errorf("rfc2136: tags of %s are %d bytes as tags=tag1,tag2, longer than the %d bytes of a TXT string", service.ID, len(pair), chunkSize)
+		}
+		txt = append(txt, escape(pair))
+	}
+	if len(txt) == 0 {
+		// DNS-SD requires at least one string
+		txt = append(txt, "")
+	}
+	return txt, nil
+}
+
+// escape escapes the backslashes of TXT string, as they are parsed as the
+// escapes of presentation format
+func escape(s string) string {
+	return strings.Replace(s, `\`, `\\`, -1)
+}
+
+// update sends the update to the server in use, signed If the TSIG key is set
+func (r *RFC2136Adapter) update(msg *dns.Msg) error {
+	resp, err := r.exchange(msg)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update %s: %s", r.zone, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// exchange sends the message to the server in use, it fails over and retries
+// once on the new server If the server is unreachable
+func (r *RFC2136Adapter) exchange(msg *dns.Msg) (*dns.Msg, error) {
+	var resp *dns.Msg
+	err := r.endpoints.Call(func(i int) error {
+		// signed on each attempt as the TSIG is stripped once sent
+		if r.tsigName != "" && msg.IsTsig() == nil {
+			msg.SetTsig(r.tsigName, r.tsigAlgorithm, fudge, time.Now().Unix())
+		}
+		var err error
+		resp, _, err = r.client.Exchange(msg, r.endpoints.All()[i])
+		return err
+	}, unreachable, r.Ping)
+	return resp, err
+}
+
+// unreachable returns whether the error is that the server is unreachable,
+// rather than an invalid response
+func unreachable(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
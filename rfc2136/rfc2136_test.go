@@ -0,0 +1,342 @@
+package rfc2136
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/miekg/dns"
+)
+
+const (
+	zone       = "example.com."
+	tsigName   = "registrator."
+	tsigSecret = "c2VjcmV0"
+)
+
+// server the in-process DNS server applying dynamic updates to the zone
+type server struct {
+	sync.Mutex
+	*dns.Server
+	records []dns.RR
+}
+
+func newServer(t *testing.T) *server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{}
+	s.Server = &dns.Server{
+		Listener:   listener,
+		TsigSecret: map[string]string{tsigName: tsigSecret},
+		Handler:    dns.HandlerFunc(s.serve),
+		// updates are rejected by default
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	started := make(chan struct{})
+	s.NotifyStartedFunc = func() { close(started) }
+	go s.ActivateAndServe()
+	<-started
+	return s
+}
+
+func (s *server) serve(w dns.ResponseWriter, req *dns.Msg) {
+	s.Lock()
+	defer s.Unlock()
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if req.Opcode == dns.OpcodeUpdate {
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			resp.Rcode = dns.RcodeNotAuth
+		} else {
+			s.apply(req.Ns)
+		}
+	} else {
+		q := req.Question[0]
+		if q.Qtype == dns.TypeSOA && q.Name == zone {
+			resp.Answer = append(resp.Answer, &dns.SOA{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+				Ns:  "ns." + zone, Mbox: "admin." + zone, Serial: 1,
+			})
+		}
+		for _, rr := range s.records {
+			if rr.Header().Name == q.Name && rr.Header().Rrtype == q.Qtype {
+				resp.Answer = append(resp.Answer, rr)
+			}
+		}
+		if len(resp.Answer) == 0 {
+			resp.Rcode = dns.RcodeNameError
+		}
+	}
+	if t := req.IsTsig(); t != nil {
+		resp.SetTsig(t.Hdr.Name, t.Algorithm, fudge, int64(t.TimeSigned))
+	}
+	w.WriteMsg(resp)
+}
+
+// apply applies the update section, the deletions by name, by rrset and by
+// data, and the insertions
+func (s *server) apply(updates []dns.RR) {
+	for _, update := range updates {
+		h := update.Header()
+		kept := s.records[:0]
+		for _, rr := range s.records {
+			deleted := false
+			switch h.Class {
+			case dns.ClassANY:
+				deleted = rr.Header().Name == h.Name && (h.Rrtype == dns.TypeANY || h.Rrtype == rr.Header().Rrtype)
+			case dns.ClassNONE:
+				deleted = sameData(rr, update)
+			case dns.ClassINET:
+				// replaced
+				deleted = sameData(rr, update)
+			}
+			if !deleted {
+				kept = append(kept, rr)
+			}
+		}
+		s.records = kept
+		if h.Class == dns.ClassINET {
+			s.records = append(s.records, update)
+		}
+	}
+}
+
+func sameData(x, y dns.RR) bool {
+	a, b := dns.Copy(x), dns.Copy(y)
+	a.Header().Class, b.Header().Class = dns.ClassINET, dns.ClassINET
+	a.Header().Ttl, b.Header().Ttl = 0, 0
+	return dns.IsDuplicate(a, b)
+}
+
+// lookup returns the records of name in type
+func (s *server) lookup(name string, rrtype uint16) []dns.RR {
+	s.Lock()
+	defer s.Unlock()
+	var rrs []dns.RR
+	for _, rr := range s.records {
+		if rr.Header().Name == name && rr.Header().Rrtype == rrtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+func newAdapter(t *testing.T, s *server, query string) *RFC2136Adapter {
+	uri, _ := url.Parse("rfc2136://" + s.Listener.Addr().String() + "/example.com?" + query)
+	return new(Factory).New(uri).(*RFC2136Adapter)
+}
+
+func TestAdapter(t *testing.T) {
+	bridge.LocalNode.ID = "Node_01"
+	bridge.LocalNode.Address = "10.0.0.5"
+	s := newServer(t)
+	defer s.Shutdown()
+
+	r := newAdapter(t, s, "tsig=registrator.:"+tsigSecret)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	web1 := &bridge.Service{ID: "[test]:web1:8080", Name: "web", Port: 8080, Attrs: map[string]string{"version": "1"}, TTL: 30}
+	web2 := &bridge.Service{ID: "[test]:web2:8081", Name: "web", Port: 8081, IP: "fd00::1"}
+	for _, service := range []*bridge.Service{web1, web2} {
+		if err := r.Register(service); err != nil {
+			t.Fatalf("Register(%s) = %v", service.ID, err)
+		}
+	}
+
+	if ptrs := s.lookup("_web._tcp.example.com.", dns.TypePTR); len(ptrs) != 2 {
+		t.Errorf("browse records = %v", ptrs)
+	}
+	_, instance, host := r.names(web1)
+	if txt := s.lookup(instance, dns.TypeTXT); len(txt) != 1 || txt[0].(*dns.TXT).Txt[0] != "version=1" {
+		t.Errorf("TXT of instance = %v", txt)
+	}
+	if a := s.lookup(host, dns.TypeA); len(a) != 1 || a[0].Header().Ttl != 30 {
+		t.Errorf("A of host = %v", a)
+	}
+	if _, _, host := r.names(web2); len(s.lookup(host, dns.TypeAAAA)) != 1 {
+		t.Error("AAAA of host is not published")
+	}
+
+	// one ownership record per service, indexed by the node
+	index := "node-01._registrator.example.com."
+	if ptrs := s.lookup(index, dns.TypePTR); len(ptrs) != 2 {
+		t.Errorf("index records = %v", ptrs)
+	}
+	if owner := s.lookup(r.ownerName(web1.ID), dns.TypeTXT); len(owner) != 1 {
+		t.Errorf("ownership records of service = %v", owner)
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 2 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+
+	// re-registered in place
+	web1.Port = 9090
+	if err := r.Register(web1); err != nil {
+		t.Fatalf("Register() of changed service = %v", err)
+	}
+	if srv := s.lookup(instance, dns.TypeSRV); len(srv) != 1 || srv[0].(*dns.SRV).Port != 9090 {
+		t.Errorf("SRV of changed instance = %v", srv)
+	}
+	if ptrs := s.lookup(index, dns.TypePTR); len(ptrs) != 2 {
+		t.Errorf("index records after re-registration = %v", ptrs)
+	}
+
+	if err := r.Deregister(&bridge.Service{ID: web1.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if len(s.lookup(instance, dns.TypeSRV)) != 0 || len(s.lookup(host, dns.TypeA)) != 0 || len(s.lookup(r.ownerName(web1.ID), dns.TypeTXT)) != 0 {
+		t.Error("records of deregistered service are left")
+	}
+	if ptrs := s.lookup("_web._tcp.example.com.", dns.TypePTR); len(ptrs) != 1 {
+		t.Errorf("browse records after deregistration = %v", ptrs)
+	}
+	services, err = r.Services()
+	if err != nil || len(services) != 1 || services[0].ID != web2.ID {
+		t.Errorf("Services() after deregistration = %v, %v", services, err)
+	}
+	if err := r.Deregister(web1); err != nil {
+		t.Errorf("Deregister() of unknown service = %v", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	bridge.LocalNode.ID = "node-01"
+	bridge.LocalNode.Address = "10.0.0.5"
+	preferred, fallback := newServer(t), newServer(t)
+	defer fallback.Shutdown()
+
+	uri, _ := url.Parse("rfc2136://" + preferred.Listener.Addr().String() + "," + fallback.Listener.Addr().String() + "/example.com?tsig=registrator.:" + tsigSecret)
+	r := new(Factory).New(uri).(*RFC2136Adapter)
+	if err := r.Ping(); err != nil || r.Endpoint() != preferred.Listener.Addr().String() {
+		t.Fatalf("Ping() = %v, endpoint %s", err, r.Endpoint())
+	}
+
+	// the preferred server goes down between pings
+	preferred.Shutdown()
+	service := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if len(fallback.lookup(r.ownerName(service.ID), dns.TypeTXT)) != 1 || r.Endpoint() != fallback.Listener.Addr().String() {
+		t.Errorf("service is not registered on the fallback server, endpoint %s", r.Endpoint())
+	}
+	if err := r.Deregister(service); err != nil || len(fallback.lookup(r.ownerName(service.ID), dns.TypeTXT)) != 0 {
+		t.Errorf("Deregister() = %v", err)
+	}
+}
+
+func TestRetrySigned(t *testing.T) {
+	bridge.LocalNode.ID = "node-01"
+	bridge.LocalNode.Address = "10.0.0.5"
+	s := newServer(t)
+	defer s.Shutdown()
+
+	// the preferred server accepts the update but never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	uri, _ := url.Parse("rfc2136://" + silent.Addr().String() + "," + s.Listener.Addr().String() + "/example.com?tsig=registrator.:" + tsigSecret)
+	r := new(Factory).New(uri).(*RFC2136Adapter)
+	r.client.Timeout = 100 * time.Millisecond
+	service := &bridge.Service{ID: "[test]:web:8080", Name: "web", Port: 8080}
+	rrs, _ := r.records(service)
+	msg := new(dns.Msg)
+	msg.SetUpdate(r.zone)
+	msg.Insert(rrs)
+	if err := r.update(msg); err != nil {
+		t.Fatalf("update() retried on the fallback server = %v", err)
+	}
+	if _, _, host := r.names(service); len(s.lookup(host, dns.TypeA)) != 1 {
+		t.Error("update is not applied on the fallback server")
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	bridge.LocalNode.ID = "node-01"
+	bridge.LocalNode.Address = "10.0.0.5"
+	s := newServer(t)
+	defer s.Shutdown()
+
+	r := newAdapter(t, s, "")
+	err := r.Register(&bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80})
+	if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("Register() without TSIG = %v, want NOTAUTH", err)
+	}
+}
+
+func TestParseTSIG(t *testing.T) {
+	algorithm, name, secret, err := parseTSIG("registrator:c2VjcmV0")
+	if err != nil || algorithm != dns.HmacSHA256 || name != "registrator." || secret != "c2VjcmV0" {
+		t.Errorf("parseTSIG() = %s %s %s %v", algorithm, name, secret, err)
+	}
+	for _, tsig := range []string{"c2VjcmV0", "md4:registrator:c2VjcmV0", "hmac-sha1::c2VjcmV0"} {
+		if _, _, _, err := parseTSIG(tsig); err == nil {
+			t.Errorf("parseTSIG(%s) succeeded", tsig)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	for s, expected := range map[string]string{
+		"web":                   "web",
+		"My_Service.v1":         "my-service-v1",
+		"-edge-":                "edge",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+		"[0123]":                "0123",
+	} {
+		if got := label(s); got != expected {
+			t.Errorf("label(%s) = %s, want %s", s, got, expected)
+		}
+	}
+}
+
+func TestTXTRecord(t *testing.T) {
+	service := &bridge.Service{ID: "web", Attrs: map[string]string{"version": "1", "path": `C:\web`}, Tags: []string{"a", "b"}}
+	txt, err := txtRecord(service)
+	if err != nil || !reflect.DeepEqual(txt, []string{`path=C:\\web`, "version=1", "tags=a,b"}) {
+		t.Errorf("txtRecord() = %q, %v", txt, err)
+	}
+	if txt, err := txtRecord(&bridge.Service{ID: "web"}); err != nil || len(txt) != 1 || txt[0] != "" {
+		t.Errorf("txtRecord() without attrs = %q, %v", txt, err)
+	}
+
+	// a pair of 255 bytes fits, the longer ones can't be split
+	service.Attrs = map[string]string{"k": strings.Repeat("v", 253)}
+	if _, err := txtRecord(service); err != nil {
+		t.Errorf("txtRecord() of 255 bytes = %v", err)
+	}
+	for _, service := range []*bridge.Service{
+		{ID: "web", Attrs: map[string]string{"k": strings.Repeat("v", 254)}},
+		{ID: "web", Tags: []string{strings.Repeat("t", 251)}},
+		{ID: "web", Attrs: map[string]string{"a=b": "c"}},
+		{ID: "web", Attrs: map[string]string{"": "c"}},
+	} {
+		if _, err := txtRecord(service); err == nil {
+			t.Errorf("txtRecord(%v %v) succeeded", service.Attrs, service.Tags)
+		}
+	}
+}
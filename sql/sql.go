@@ -0,0 +1,318 @@
+package sql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+
+	// drivers of the supported databases
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var log = logrus.WithField("component", "sql")
+
+// DefaultTable default table of services
+const DefaultTable = "registrator_services"
+
+var tablePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func init() {
+	bridge.Register(new(Factory), "sql")
+}
+
+type Factory struct{}
+
+// New returns the sql adapter, the host is the driver, one of sqlite3,
+// postgres and mysql, e.g. sql://sqlite3?dsn=/var/lib/registrator/services.db.
+// The schema is migrated to the latest version
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	query := uri.Query()
+
+	d, ok := dialects[uri.Host]
+	if !ok {
+		log.Fatalf("sql: unsupported driver %q, must be one of sqlite3, postgres and mysql", uri.Host)
+	}
+	if uri.Host == "sqlite3" && !sqliteSupported {
+		log.Fatal("sql: sqlite3 requires registrator built with cgo (CGO_ENABLED=1), use postgres or mysql instead")
+	}
+
+	dsn := query.Get("dsn")
+	if file := query.Get("dsn-file"); file != "" {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("sql: read dsn-file failed: %v", err)
+		}
+		dsn = strings.TrimSpace(string(bs))
+	}
+	if dsn == "" {
+		log.Fatal("sql: dsn is required")
+	}
+
+	table := query.Get("table")
+	if table == "" {
+		table = DefaultTable
+	}
+	if !tablePattern.MatchString(table) {
+		log.Fatalf("sql: invalid table %q", table)
+	}
+
+	db, err := sql.Open(uri.Host, dsn)
+	if err != nil {
+		log.Fatalf("sql: %v", err)
+	}
+	if uri.Host == "sqlite3" {
+		// sqlite allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+
+	r := &SQLAdapter{db: db, dialect: d, table: table}
+	if err := r.migrate(); err != nil {
+		log.Fatalf("sql: migrate schema of %s failed: %v", table, err)
+	}
+	return r
+}
+
+// SQLAdapter stores services in the table, one row per service with the id,
+// node, name, address, port, tags and attrs in JSON, and updated_at which is
+// renewed by Refresh, so the rows of dead nodes can be found by it
+type SQLAdapter struct {
+	db      *sql.DB
+	dialect *dialect
+	table   string
+}
+
+// dialect the SQL differences of databases
+type dialect struct {
+	// placeholder returns the placeholder of the nth argument, from 1
+	placeholder func(n int) string
+	// upsert returns the clause of updating the columns on conflict of id
+	upsert func(columns []string) string
+	// migrations schema migrations of the table, the version is the index
+	// plus 1. The table name is %[1]s
+	migrations []string
+}
+
+var dialects = map[string]*dialect{
+	"sqlite3": {
+		placeholder: func(int) string { return "?" },
+		upsert:      onConflict,
+		migrations: []string{
+			`CREATE TABLE %[1]s (
+				id VARCHAR(191) NOT NULL PRIMARY KEY,
+				node VARCHAR(191) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				port INTEGER NOT NULL,
+				tags TEXT NOT NULL,
+				attrs TEXT NOT NULL,
+				updated_at TIMESTAMP NOT NULL
+			);
+			CREATE INDEX %[1]s_node ON %[1]s (node)`,
+		},
+	},
+	"postgres": {
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		upsert:      onConflict,
+		migrations: []string{
+			`CREATE TABLE %[1]s (
+				id VARCHAR(191) NOT NULL PRIMARY KEY,
+				node VARCHAR(191) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				port INTEGER NOT NULL,
+				tags JSONB NOT NULL,
+				attrs JSONB NOT NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NOT NULL
+			);
+			CREATE INDEX %[1]s_node ON %[1]s (node)`,
+		},
+	},
+	"mysql": {
+		placeholder: func(int) string { return "?" },
+		upsert: func(columns []string) string {
+			sets := make([]string, 0, len(columns))
+			for _, column := range columns {
+				sets = append(sets, fmt.Sprintf("%s = VALUES(%s)", column, column))
+			}
+			return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+		},
+		migrations: []string{
+			`CREATE TABLE %[1]s (
+				id VARCHAR(191) NOT NULL PRIMARY KEY,
+				node VARCHAR(191) NOT NULL,
+				name VARCHAR(255) NOT NULL,
+				address VARCHAR(255) NOT NULL,
+				port INTEGER NOT NULL,
+				tags JSON NOT NULL,
+				attrs JSON NOT NULL,
+				updated_at TIMESTAMP(3) NOT NULL,
+				INDEX %[1]s_node (node)
+			)`,
+		},
+	},
+}
+
+func onConflict(columns []string) string {
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+	return "ON CONFLICT (id) DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// migrate applies the migrations newer than the version in the schema table
+// <table>_schema, each one in a transaction
+func (r *SQLAdapter) migrate() error {
+	schema := r.table + "_schema"
+	if _, err := r.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL)", schema)); err != nil {
+		return err
+	}
+
+	var version int
+	if err := r.db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s", schema)).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(r.dialect.migrations); i++ {
+		log.Infof("sql: migrating schema of %s to version %d", r.table, i+1)
+		tx, err := r.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range strings.Split(fmt.Sprintf(r.dialect.migrations[i], r.table), ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("version %d: %v", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (version) VALUES (%s)", schema, r.dialect.placeholder(1)), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLAdapter) Ping() error {
+	return r.db.Ping()
+}
+
+func (r *SQLAdapter) Register(service *bridge.Service) error {
+	tags := service.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	attrs := service.Attrs
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	attrsJSON, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	columns := []string{"id", "node", "name", "address", "port", "tags", "attrs", "updated_at"}
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = r.dialect.placeholder(i + 1)
+	}
+	statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) %s", r.table,
+		strings.Join(columns, ", "), strings.Join(placeholders, ", "), r.dialect.upsert(columns[1:]))
+
+	log.Debugf("sql: upsert %s", service.ID)
+	_, err = r.db.Exec(statement, service.ID, bridge.LocalNode.ID, service.Name, address(service), service.Port,
+		string(tagsJSON), string(attrsJSON), time.Now().UTC())
+	return err
+}
+
+func (r *SQLAdapter) Deregister(service *bridge.Service) error {
+	log.Debugf("sql: delete %s", service.ID)
+	_, err := r.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = %s AND node = %s", r.table,
+		r.dialect.placeholder(1), r.dialect.placeholder(2)), service.ID, bridge.LocalNode.ID)
+	return err
+}
+
+// Refresh renews updated_at of service as heartbeat, it's inserted again If
+// the row is lost, e.g. it was purged as stale
+func (r *SQLAdapter) Refresh(service *bridge.Service) error {
+	result, err := r.db.Exec(fmt.Sprintf("UPDATE %s SET updated_at = %s WHERE id = %s AND node = %s", r.table,
+		r.dialect.placeholder(1), r.dialect.placeholder(2), r.dialect.placeholder(3)),
+		time.Now().UTC(), service.ID, bridge.LocalNode.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		log.Infof("sql: service %s not found, inserting it again", service.ID)
+		return r.Register(service)
+	}
+	return nil
+}
+
+// Normalize returns the service as it's stored, the address defaults to the
+// one of local node
+func (r *SQLAdapter) Normalize(service *bridge.Service) *bridge.Service {
+	normalized := *service
+	normalized.IP = address(service)
+	return &normalized
+}
+
+// address returns the address of service, it defaults to the one of local node
+func address(service *bridge.Service) string {
+	if service.IP != "" {
+		return service.IP
+	}
+	return bridge.LocalNode.Address
+}
+
+// Services returns the services of this node as they're stored
+func (r *SQLAdapter) Services() ([]*bridge.Service, error) {
+	rows, err := r.db.Query(fmt.Sprintf("SELECT id, name, address, port, tags, attrs FROM %s WHERE node = %s",
+		r.table, r.dialect.placeholder(1)), bridge.LocalNode.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []*bridge.Service
+	for rows.Next() {
+		service := new(bridge.Service)
+		var tags, attrs string
+		if err := rows.Scan(&service.ID, &service.Name, &service.IP, &service.Port, &tags, &attrs); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &service.Tags); err != nil {
+			return nil, fmt.Errorf("sql: invalid tags of %s: %v", service.ID, err)
+		}
+		if err := json.Unmarshal([]byte(attrs), &service.Attrs); err != nil {
+			return nil, fmt.Errorf("sql: invalid attrs of %s: %v", service.ID, err)
+		}
+		if len(service.Tags) == 0 {
+			service.Tags = nil
+		}
+		if len(service.Attrs) == 0 {
+			service.Attrs = nil
+		}
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
@@ -0,0 +1,118 @@
+//go:build cgo
+// +build cgo
+
+package sql
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+func newAdapter(t *testing.T) *SQLAdapter {
+	bridge.LocalNode.ID = "node-1"
+	bridge.LocalNode.Address = "10.0.0.5"
+
+	dir, err := ioutil.TempDir("", "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	uri, _ := url.Parse("sql://sqlite3?table=edge&dsn=" + url.QueryEscape(filepath.Join(dir, "services.db")))
+	r := new(Factory).New(uri).(*SQLAdapter)
+	t.Cleanup(func() { r.db.Close() })
+	return r
+}
+
+func TestMigrate(t *testing.T) {
+	r := newAdapter(t)
+	// migrated already
+	if err := r.migrate(); err != nil {
+		t.Fatalf("migrate() = %v", err)
+	}
+	var versions int
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM edge_schema").Scan(&versions); err != nil || versions != len(r.dialect.migrations) {
+		t.Errorf("schema versions = %d, %v", versions, err)
+	}
+}
+
+func TestAdapter(t *testing.T) {
+	r := newAdapter(t)
+	if err := r.Ping(); err != nil {
+		t.Fatalf("Ping() = %v", err)
+	}
+
+	web := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80, Tags: []string{"http"}, Attrs: map[string]string{"team": "edge"}}
+	db := &bridge.Service{ID: "[test]:db:5432", Name: "db", Port: 5432, IP: "10.0.0.5"}
+	for _, service := range []*bridge.Service{web, db, web} {
+		if err := r.Register(service); err != nil {
+			t.Fatalf("Register() = %v", err)
+		}
+	}
+	// the services of other nodes are not listed
+	if _, err := r.db.Exec(`INSERT INTO edge (id, node, name, address, port, tags, attrs, updated_at)
+		VALUES ('[other]:web:80', 'node-2', 'web', '10.0.0.6', 80, '[]', '{}', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := r.Services()
+	if err != nil || len(services) != 2 {
+		t.Fatalf("Services() = %v, %v", services, err)
+	}
+	actual := make(map[string]*bridge.Service)
+	for _, service := range services {
+		actual[service.ID] = service
+	}
+	// the stored services don't drift from the normalized desired ones
+	for _, desired := range []*bridge.Service{web, db} {
+		if fields := bridge.Diff(r.Normalize(desired), actual[desired.ID]); len(fields) > 0 {
+			t.Errorf("%s drifts on %v", desired.ID, fields)
+		}
+	}
+	if web.IP != "" {
+		t.Error("Normalize() modified the service")
+	}
+
+	if err := r.Deregister(&bridge.Service{ID: web.ID}); err != nil {
+		t.Fatalf("Deregister() = %v", err)
+	}
+	if services, _ := r.Services(); len(services) != 1 || services[0].ID != db.ID {
+		t.Errorf("Services() after deregister = %v", services)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	r := newAdapter(t)
+
+	service := &bridge.Service{ID: "[test]:web:80", Name: "web", Port: 80}
+	if err := r.Register(service); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if _, err := r.db.Exec("UPDATE edge SET updated_at = '2000-01-01 00:00:00'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Refresh(service); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	var stale int
+	r.db.QueryRow("SELECT COUNT(*) FROM edge WHERE updated_at < '2001-01-01'").Scan(&stale)
+	if stale != 0 {
+		t.Error("updated_at is not renewed")
+	}
+
+	// the lost row is inserted again
+	if _, err := r.db.Exec("DELETE FROM edge"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Refresh(service); err != nil {
+		t.Fatalf("Refresh() = %v", err)
+	}
+	if services, _ := r.Services(); len(services) != 1 {
+		t.Errorf("Services() after refresh = %v", services)
+	}
+}
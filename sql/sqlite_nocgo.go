@@ -0,0 +1,7 @@
+//go:build !cgo
+// +build !cgo
+
+package sql
+
+// sqliteSupported the sqlite3 driver requires cgo
+const sqliteSupported = false
@@ -0,0 +1,281 @@
+package systemd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("component", "systemd")
+
+func init() {
+	bridge.Register(new(Factory), "systemd")
+	bridge.Register(&UnitGate{states: make(map[string]string), ready: make(chan struct{})}, "systemd")
+}
+
+// Manager the subset of systemd manager used by registrator, it's implemented
+// over D-Bus and can be replaced by a stand-in
+type Manager interface {
+	// ActiveState returns the active state of unit, e.g. active, inactive, failed
+	ActiveState(unit string) (string, error)
+	// Subscribe sends the active state changes of units until stop closed, a
+	// nil change means some changes have been lost
+	Subscribe(changes chan<- *UnitState, stop <-chan struct{}) error
+}
+
+// UnitState active state of unit
+type UnitState struct {
+	Unit        string
+	ActiveState string
+}
+
+// retry intervals of connecting to systemd manager, doubled after every failure
+var (
+	minReconnect = time.Second
+	maxReconnect = time.Minute
+)
+
+// NewManager returns the systemd manager, connected to system bus by default
+var NewManager = func() (Manager, error) {
+	conn, err := dbus.New()
+	if err != nil {
+		return nil, err
+	}
+	return &dbusManager{conn: conn}, nil
+}
+
+type dbusManager struct {
+	conn *dbus.Conn
+}
+
+func (m *dbusManager) ActiveState(unit string) (string, error) {
+	property, err := m.conn.GetUnitProperty(unit, "ActiveState")
+	if err != nil {
+		return "", err
+	}
+	state, ok := property.Value.Value().(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected ActiveState of %s: %v", unit, property.Value)
+	}
+	return state, nil
+}
+
+func (m *dbusManager) Subscribe(changes chan<- *UnitState, stop <-chan struct{}) error {
+	if err := m.conn.Subscribe(); err != nil {
+		return err
+	}
+
+	updates := make(chan *dbus.PropertiesUpdate, 256)
+	errs := make(chan error, 1)
+	m.conn.SetPropertiesSubscriber(updates, errs)
+
+	go func() {
+		defer m.conn.Unsubscribe()
+		for {
+			var change *UnitState
+			select {
+			case update := <-updates:
+				value, ok := update.Changed["ActiveState"]
+				if !ok {
+					continue
+				}
+				state, _ := value.Value().(string)
+				change = &UnitState{Unit: update.UnitName, ActiveState: state}
+			case err := <-errs:
+				log.Warnf("systemd: properties subscriber failed: %v", err)
+			case <-stop:
+				return
+			}
+
+			select {
+			case changes <- change:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// UnitGate allows the service with active_when to be registered only while
+// the unit is active, the states are updated by systemd D-Bus signals
+type UnitGate struct {
+	sync.Mutex
+	manager Manager
+	ready   chan struct{}
+	// the next connection attempt is made after retryAt If the last one failed
+	retryAt time.Time
+	backoff time.Duration
+	// active states of units referred by services
+	states map[string]string
+}
+
+func (g *UnitGate) Allow(service *bridge.Service) bool {
+	if service.ActiveWhen == "" {
+		return true
+	}
+	manager := g.connect()
+	if manager == nil {
+		return false
+	}
+
+	unit := UnitName(service.ActiveWhen)
+	g.Lock()
+	state, ok := g.states[unit]
+	g.Unlock()
+	if !ok {
+		var err error
+		if state, err = manager.ActiveState(unit); err != nil {
+			log.Errorf("systemd: get active state of %s failed: %v", unit, err)
+			return false
+		}
+		g.Lock()
+		g.states[unit] = state
+		g.Unlock()
+	}
+
+	return isActive(state)
+}
+
+// Watch subscribes the unit state changes once any service refers to a unit.
+// If the connection failed, it's retried in background and the services are
+// reevaluated once connected
+func (g *UnitGate) Watch(changes chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(minReconnect)
+	defer ticker.Stop()
+	for connected := false; !connected; {
+		select {
+		case <-g.ready:
+			connected = true
+		case <-ticker.C:
+			if g.disconnected() {
+				g.connect()
+			}
+		case <-stop:
+			return
+		}
+	}
+	if g.reconnected() {
+		select {
+		case changes <- struct{}{}:
+		case <-stop:
+			return
+		}
+	}
+
+	updates := make(chan *UnitState)
+	if err := g.manager.Subscribe(updates, stop); err != nil {
+		log.Errorf("systemd: subscribe unit changes failed: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case update := <-updates:
+			if !g.update(update) {
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// update updates the cached state, returns whether any unit has become active
+// or inactive. The states of all units are refreshed If changes have been lost
+func (g *UnitGate) update(update *UnitState) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if update == nil {
+		changed := false
+		for unit, last := range g.states {
+			state, err := g.manager.ActiveState(unit)
+			if err != nil {
+				log.Errorf("systemd: get active state of %s failed: %v", unit, err)
+				continue
+			}
+			g.states[unit] = state
+			changed = changed || isActive(state) != isActive(last)
+		}
+		return changed
+	}
+
+	last, ok := g.states[update.Unit]
+	if !ok {
+		// not referred by any service
+		return false
+	}
+	g.states[update.Unit] = update.ActiveState
+	if isActive(last) != isActive(update.ActiveState) {
+		log.Infof("systemd: %s is %s", update.Unit, update.ActiveState)
+		return true
+	}
+	return false
+}
+
+// connect connects to systemd manager, nil If failed. The failed connection
+// is retried with backoff by the later calls rather than given up
+func (g *UnitGate) connect() Manager {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.manager != nil || time.Now().Before(g.retryAt) {
+		return g.manager
+	}
+	manager, err := NewManager()
+	if err != nil {
+		g.backoff *= 2
+		if g.backoff < minReconnect {
+			g.backoff = minReconnect
+		} else if g.backoff > maxReconnect {
+			g.backoff = maxReconnect
+		}
+		g.retryAt = time.Now().Add(g.backoff)
+		log.Errorf("systemd: connect failed, services with active_when will not be registered, retry in %s: %v", g.backoff, err)
+		return nil
+	}
+	if g.backoff > 0 {
+		log.Infof("systemd: connected")
+	}
+	g.manager = manager
+	close(g.ready)
+	return manager
+}
+
+// disconnected returns whether the connection has been attempted and failed
+func (g *UnitGate) disconnected() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.manager == nil && g.backoff > 0
+}
+
+// reconnected returns whether connected after failures
+func (g *UnitGate) reconnected() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.backoff > 0
+}
+
+// UnitName returns the full unit name, the .service suffix is appended If omitted
+func UnitName(name string) string {
+	if !strings.Contains(name, ".") {
+		return name + ".service"
+	}
+	return name
+}
+
+func isActive(state string) bool {
+	return state == "active" || state == "reloading"
+}
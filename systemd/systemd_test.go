@@ -0,0 +1,204 @@
+package systemd
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// manager the stand-in of systemd manager
+type manager struct {
+	sync.Mutex
+	states  map[string]string
+	queries int
+	changes chan<- *UnitState
+}
+
+func (m *manager) ActiveState(unit string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.queries++
+	state, ok := m.states[unit]
+	if !ok {
+		return "", errors.New("no such unit")
+	}
+	return state, nil
+}
+
+func (m *manager) Subscribe(changes chan<- *UnitState, stop <-chan struct{}) error {
+	m.Lock()
+	defer m.Unlock()
+	m.changes = changes
+	return nil
+}
+
+func (m *manager) set(unit, state string) {
+	m.Lock()
+	defer m.Unlock()
+	m.states[unit] = state
+}
+
+// subscriber returns the channel of subscribed changes
+func (m *manager) subscriber(t *testing.T) chan<- *UnitState {
+	for i := 0; i < 100; i++ {
+		m.Lock()
+		changes := m.changes
+		m.Unlock()
+		if changes != nil {
+			return changes
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("unit changes are not subscribed")
+	return nil
+}
+
+func newGate(t *testing.T, m Manager, err error) *UnitGate {
+	original := NewManager
+	NewManager = func() (Manager, error) { return m, err }
+	t.Cleanup(func() { NewManager = original })
+	return &UnitGate{states: make(map[string]string), ready: make(chan struct{})}
+}
+
+func TestAllow(t *testing.T) {
+	m := &manager{states: map[string]string{"nginx.service": "active", "mysqld.service": "failed"}}
+	g := newGate(t, m, nil)
+
+	if !g.Allow(&bridge.Service{Name: "static"}) {
+		t.Error("Allow() without active_when = false")
+	}
+	if !g.Allow(&bridge.Service{ActiveWhen: "nginx"}) {
+		t.Error("Allow() of active unit = false")
+	}
+	if g.Allow(&bridge.Service{ActiveWhen: "mysqld.service"}) {
+		t.Error("Allow() of failed unit = true")
+	}
+	if g.Allow(&bridge.Service{ActiveWhen: "missing"}) {
+		t.Error("Allow() of unknown unit = true")
+	}
+
+	// the states are cached until changed
+	g.Allow(&bridge.Service{ActiveWhen: "nginx"})
+	if m.queries != 3 {
+		t.Errorf("queries = %d, want 3", m.queries)
+	}
+}
+
+func TestAllowNotConnected(t *testing.T) {
+	g := newGate(t, nil, errors.New("no system bus"))
+	if g.Allow(&bridge.Service{ActiveWhen: "nginx"}) {
+		t.Error("Allow() without manager = true")
+	}
+	if !g.Allow(&bridge.Service{Name: "static"}) {
+		t.Error("Allow() without active_when = false")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	m := &manager{states: map[string]string{"nginx.service": "active"}}
+	g := newGate(t, nil, nil)
+	var mu sync.Mutex
+	attempts, reachable := 0, false
+	NewManager = func() (Manager, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if !reachable {
+			return nil, errors.New("no system bus")
+		}
+		return m, nil
+	}
+	min := minReconnect
+	minReconnect = 20 * time.Millisecond
+	t.Cleanup(func() { minReconnect = min })
+
+	// the failure is not retried until backoff elapsed
+	if g.Allow(&bridge.Service{ActiveWhen: "nginx"}) || g.Allow(&bridge.Service{ActiveWhen: "nginx"}) {
+		t.Fatal("Allow() without manager = true")
+	}
+	if attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", attempts)
+	}
+
+	// retried in background, the services are reevaluated once connected
+	changes := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.Watch(changes, stop)
+	mu.Lock()
+	reachable = true
+	mu.Unlock()
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("services are not reevaluated once connected")
+	}
+	if !g.Allow(&bridge.Service{ActiveWhen: "nginx"}) {
+		t.Error("Allow() of active unit after reconnected = false")
+	}
+	m.subscriber(t)
+}
+
+func TestWatch(t *testing.T) {
+	m := &manager{states: map[string]string{"nginx.service": "active", "mysqld.service": "inactive"}}
+	g := newGate(t, m, nil)
+	g.Allow(&bridge.Service{ActiveWhen: "nginx"})
+	g.Allow(&bridge.Service{ActiveWhen: "mysqld"})
+
+	changes := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go g.Watch(changes, stop)
+	updates := m.subscriber(t)
+
+	expect := func(changed bool) {
+		t.Helper()
+		select {
+		case <-changes:
+			if !changed {
+				t.Error("unexpected change")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if changed {
+				t.Error("change is not sent")
+			}
+		}
+	}
+
+	// unit not referred by any service
+	updates <- &UnitState{Unit: "sshd.service", ActiveState: "inactive"}
+	expect(false)
+	// reloading is still active
+	updates <- &UnitState{Unit: "nginx.service", ActiveState: "reloading"}
+	expect(false)
+	updates <- &UnitState{Unit: "nginx.service", ActiveState: "deactivating"}
+	expect(true)
+	if g.Allow(&bridge.Service{ActiveWhen: "nginx"}) {
+		t.Error("Allow() of deactivating unit = true")
+	}
+
+	// the states are refreshed once changes have been lost
+	m.set("mysqld.service", "active")
+	updates <- nil
+	expect(true)
+	if !g.Allow(&bridge.Service{ActiveWhen: "mysqld"}) {
+		t.Error("Allow() of refreshed unit = false")
+	}
+}
+
+func TestUnitName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"nginx":         "nginx.service",
+		"nginx.service": "nginx.service",
+		"docker.socket": "docker.socket",
+		"backup.timer":  "backup.timer",
+		"getty@tty1":    "getty@tty1.service",
+	} {
+		if got := UnitName(name); got != expected {
+			t.Errorf("UnitName(%s) = %s, want %s", name, got, expected)
+		}
+	}
+}
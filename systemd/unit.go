@@ -0,0 +1,314 @@
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feifeigood/registrator/bridge"
+	"github.com/fsnotify/fsnotify"
+)
+
+// KeyPrefix prefix of the key of services declared in units
+const KeyPrefix = "systemd://"
+
+// Section the unit file section which declares service
+const Section = "X-Registrator"
+
+// DefaultUnitDirs unit dirs in the order of precedence
+var DefaultUnitDirs = []string{
+	"/etc/systemd/system",
+	"/run/systemd/system",
+	"/usr/lib/systemd/system",
+	"/lib/systemd/system",
+}
+
+// debounce delay of resync after unit files changed
+const debounce = time.Second
+
+type Factory struct{}
+
+// New returns the source of services declared in the [X-Registrator] section
+// of unit files or drop-ins, e.g. systemd://?dir=/etc/systemd/system
+func (f *Factory) New(uri *url.URL) bridge.Source {
+	dirs := uri.Query()["dir"]
+	if len(dirs) == 0 {
+		dirs = DefaultUnitDirs
+	}
+	return &Source{dirs: dirs}
+}
+
+// Source services declared in units, they are registered only while the unit
+// is active unless ActiveWhen is specified:
+//
+//	[X-Registrator]
+//	Name=node_exporter
+//	Port=9100
+//	Address=127.0.0.1
+//	Tags=exporter linux
+//	Attr=region=asia
+//	CheckHTTP=http://127.0.0.1:9100/metrics
+//	CheckInterval=10s
+type Source struct {
+	dirs []string
+}
+
+func (s *Source) Services() (map[string]*bridge.Service, error) {
+	units := make(map[string]string)
+	dropins := make(map[string]map[string]string)
+
+	// walk in reverse order, so that files in the dir of higher precedence win
+	for i := len(s.dirs) - 1; i >= 0; i-- {
+		paths, err := filepath.Glob(filepath.Join(s.dirs[i], "*.service"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			units[filepath.Base(path)] = path
+		}
+
+		paths, err = filepath.Glob(filepath.Join(s.dirs[i], "*.service.d", "*.conf"))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			unit := strings.TrimSuffix(filepath.Base(filepath.Dir(path)), ".d")
+			if dropins[unit] == nil {
+				dropins[unit] = make(map[string]string)
+			}
+			dropins[unit][filepath.Base(path)] = path
+		}
+	}
+
+	services := make(map[string]*bridge.Service)
+	for unit := range units {
+		if strings.Contains(unit, "@.") {
+			// template unit
+			continue
+		}
+
+		paths := []string{units[unit]}
+		names := make([]string, 0, len(dropins[unit]))
+		for name := range dropins[unit] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			paths = append(paths, dropins[unit][name])
+		}
+
+		service, err := parseUnit(unit, paths)
+		if err != nil {
+			log.Errorf("systemd: parse service of %s failed, ignored: %v", unit, err)
+			continue
+		}
+		if service != nil {
+			services[KeyPrefix+unit] = service
+		}
+	}
+
+	return services, nil
+}
+
+// Watch resyncs the source each time unit files changed
+func (s *Source) Watch(events chan<- *bridge.SourceEvent, stop <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("systemd: create watcher failed: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	s.watchDirs(watcher)
+
+	var resync <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debugf("systemd: received event: %v", event)
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				// watch the new drop-in dir
+				s.watchDirs(watcher)
+			}
+			if resync == nil {
+				resync = time.After(debounce)
+			}
+
+		case <-resync:
+			resync = nil
+			select {
+			case events <- &bridge.SourceEvent{Type: bridge.EventResync}:
+			case <-stop:
+				return
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("systemd: watcher failed: %v", err)
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Source) watchDirs(watcher *fsnotify.Watcher) {
+	for _, dir := range s.dirs {
+		dropins, _ := filepath.Glob(filepath.Join(dir, "*.service.d"))
+		for _, path := range append([]string{dir}, dropins...) {
+			if err := watcher.Add(path); err != nil && !os.IsNotExist(err) {
+				log.Warnf("systemd: watch %s failed: %v", path, err)
+			}
+		}
+	}
+}
+
+// parseUnit parses the [X-Registrator] section of unit file and its drop-ins,
+// returns nil If the section doesn't exist
+func parseUnit(unit string, paths []string) (*bridge.Service, error) {
+	values := make(map[string][]string)
+	declared := false
+	for _, path := range paths {
+		section, err := parseSection(path, Section)
+		if err != nil {
+			return nil, err
+		}
+		if section == nil {
+			continue
+		}
+		declared = true
+		for _, kv := range section {
+			if kv[1] == "" {
+				// empty assignment resets the list
+				delete(values, kv[0])
+				continue
+			}
+			values[kv[0]] = append(values[kv[0]], kv[1])
+		}
+	}
+	if !declared {
+		return nil, nil
+	}
+
+	last := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[len(v)-1]
+		}
+		return ""
+	}
+
+	service := &bridge.Service{
+		Name:       last("Name"),
+		IP:         last("Address"),
+		ActiveWhen: last("ActiveWhen"),
+	}
+	if service.Name == "" {
+		service.Name = strings.TrimSuffix(unit, ".service")
+	}
+	if service.ActiveWhen == "" {
+		service.ActiveWhen = unit
+	}
+	if port := last("Port"); port != "" {
+		var err error
+		if service.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid Port %s", port)
+		}
+	}
+	for _, tags := range values["Tags"] {
+		service.Tags = append(service.Tags, strings.FieldsFunc(tags, func(r rune) bool {
+			return r == ',' || r == ' '
+		})...)
+	}
+	for _, attr := range values["Attr"] {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid Attr %s, must be in the form key=value", attr)
+		}
+		if service.Attrs == nil {
+			service.Attrs = make(map[string]string)
+		}
+		service.Attrs[kv[0]] = kv[1]
+	}
+
+	check := &bridge.Check{
+		HTTP:     last("CheckHTTP"),
+		TCP:      last("CheckTCP"),
+		Interval: last("CheckInterval"),
+		Timeout:  last("CheckTimeout"),
+	}
+	if check.HTTP != "" || check.TCP != "" {
+		if check.Interval == "" {
+			check.Interval = "10s"
+		}
+		service.Checks = []*bridge.Check{check}
+	}
+
+	if err := service.Validate(); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// parseSection returns the key-value pairs of the section in unit file in
+// order, nil If the section doesn't exist
+func parseSection(path string, name string) ([][2]string, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs [][2]string
+	found := false
+	current := ""
+	scanner := bufio.NewScanner(strings.NewReader(string(bs)))
+	var line string
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		// line continuation
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line, text = "", line+text
+
+		if text == "" || text[0] == '#' || text[0] == ';' {
+			continue
+		}
+		if text[0] == '[' && text[len(text)-1] == ']' {
+			current = text[1 : len(text)-1]
+			found = found || current == name
+			continue
+		}
+		if current != name {
+			continue
+		}
+		kv := strings.SplitN(text, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s: invalid line: %s", path, text)
+		}
+		pairs = append(pairs, [2]string{strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, nil
+	}
+	if pairs == nil {
+		pairs = [][2]string{}
+	}
+	return pairs, nil
+}
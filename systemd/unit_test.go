@@ -0,0 +1,117 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/feifeigood/registrator/bridge"
+)
+
+// write writes the files relative to dir
+func write(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServices(t *testing.T) {
+	root, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	etc, lib := filepath.Join(root, "etc"), filepath.Join(root, "lib")
+
+	write(t, lib, map[string]string{
+		"node_exporter.service": `[Unit]
+Description=node exporter
+
+[Service]
+ExecStart=/usr/bin/node_exporter
+
+[X-Registrator]
+Port=9100
+Tags=exporter, \
+  linux
+Attr=region=asia
+CheckHTTP=http://127.0.0.1:9100/metrics
+`,
+		"mysqld.service":    "[X-Registrator]\nName=mysql\nPort=3306\n",
+		"getty@.service":    "[X-Registrator]\nPort=1\n",
+		"sshd.service":      "[Service]\nExecStart=/usr/sbin/sshd\n",
+		"broken.service":    "[X-Registrator]\nPort=http\n",
+		"redis.service":     "[X-Registrator]\nPort=6379\n",
+		"redis.service.d/x": "[X-Registrator]\nPort=1\n",
+	})
+	write(t, etc, map[string]string{
+		// overrides the unit of lower precedence
+		"mysqld.service": "[X-Registrator]\nName=mysql\nPort=3307\nActiveWhen=mariadb\n",
+		// drop-ins are applied in the order of names, the empty assignment resets the list
+		"node_exporter.service.d/10-tags.conf": "[X-Registrator]\nTags=\nTags=prometheus\n",
+		"node_exporter.service.d/20-port.conf": "[X-Registrator]\nPort=9101\nAddress=127.0.0.1\n",
+	})
+
+	services, err := (&Source{dirs: []string{etc, lib}}).Services()
+	if err != nil {
+		t.Fatalf("Services() = %v", err)
+	}
+
+	expected := map[string]*bridge.Service{
+		KeyPrefix + "node_exporter.service": {
+			Name:       "node_exporter",
+			Port:       9101,
+			IP:         "127.0.0.1",
+			Tags:       []string{"prometheus"},
+			Attrs:      map[string]string{"region": "asia"},
+			Checks:     []*bridge.Check{{HTTP: "http://127.0.0.1:9100/metrics", Interval: "10s"}},
+			ActiveWhen: "node_exporter.service",
+		},
+		KeyPrefix + "mysqld.service": {
+			Name:       "mysql",
+			Port:       3307,
+			ActiveWhen: "mariadb",
+		},
+		KeyPrefix + "redis.service": {
+			Name:       "redis",
+			Port:       6379,
+			ActiveWhen: "redis.service",
+		},
+	}
+	if len(services) != len(expected) {
+		t.Fatalf("Services() = %v", services)
+	}
+	for key, service := range expected {
+		if !reflect.DeepEqual(services[key], service) {
+			t.Errorf("service %s = %+v, want %+v", key, services[key], service)
+		}
+	}
+}
+
+func TestParseSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write(t, dir, map[string]string{
+		"empty.service":   "[Unit]\n[X-Registrator]\n# comment\n",
+		"invalid.service": "[X-Registrator]\nPort\n",
+	})
+
+	pairs, err := parseSection(filepath.Join(dir, "empty.service"), Section)
+	if err != nil || pairs == nil || len(pairs) != 0 {
+		t.Errorf("parseSection() of empty section = %v, %v", pairs, err)
+	}
+	if _, err := parseSection(filepath.Join(dir, "invalid.service"), Section); err == nil {
+		t.Error("parseSection() of invalid line succeeded")
+	}
+}